@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,9 +33,19 @@ func startAPIServer() {
 	mux.Handle("/api/status", authMiddleware(http.HandlerFunc(api.handleStatus)))
 	mux.Handle("/api/tunnels", authMiddleware(http.HandlerFunc(api.handleTunnels)))
 	mux.Handle("/api/tunnels/edit", authMiddleware(http.HandlerFunc(api.handleTunnelsEdit)))
+	mux.Handle("/api/tunnels/capture", authMiddleware(http.HandlerFunc(api.handleTunnelsCapture)))
+	mux.Handle("/api/tunnels/balance", authMiddleware(http.HandlerFunc(api.handleTunnelsBalance)))
+	mux.Handle("/api/tunnels/access", authMiddleware(http.HandlerFunc(api.handleTunnelsAccess)))
+	mux.Handle("/api/tunnels/limit", authMiddleware(http.HandlerFunc(api.handleTunnelsLimit)))
+	mux.Handle("/api/connections", authMiddleware(http.HandlerFunc(api.handleConnections)))
 	mux.Handle("/api/domains", authMiddleware(http.HandlerFunc(api.handleDomains)))
+	mux.Handle("/api/domains/pages", authMiddleware(http.HandlerFunc(api.handleDomainPages)))
+	mux.Handle("/api/cache/purge", authMiddleware(http.HandlerFunc(api.handleCachePurge)))
+	mux.Handle("/api/certs", authMiddleware(http.HandlerFunc(api.handleCerts)))
+	mux.Handle("/api/certs/action", authMiddleware(http.HandlerFunc(api.handleCertAction)))
 	mux.Handle("/api/inspect", authMiddleware(http.HandlerFunc(api.handleInspect)))
 	mux.Handle("/api/replay", authMiddleware(http.HandlerFunc(api.handleReplay)))
+	mux.Handle("/api/audit", authMiddleware(http.HandlerFunc(api.handleAudit)))
 
 	addr := fmt.Sprintf(":%d", tunnel.DefaultDashboardPort)
 	log.Printf("Dashboard API listening on %s", addr)
@@ -98,8 +111,10 @@ func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 			MaxAge:   86400,
 			SameSite: http.SameSiteLaxMode,
 		})
+		audit(r, "login", "", "", nil)
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	} else {
+		audit(r, "login", "", "", fmt.Errorf("invalid password"))
 		http.Error(w, "Invalid Password", 401)
 	}
 }
@@ -112,6 +127,7 @@ func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		MaxAge:   -1,
 	})
+	audit(r, "logout", "", "", nil)
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
@@ -120,14 +136,32 @@ func (s *APIServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	connected := State.IsConnected()
 
 	tunnels := make(map[int]int)
+	captures := make(map[int]*ConnCaptureConfig)
+	balances := make(map[int]*tunnel.BalanceConfig)
+	portConfigs := make(map[int]*tunnel.PortConfig)
+	var edgeStats tunnel.EdgeStatsPayload
 	domains := make(map[string]interface{})
+	certs := make(map[string]tunnel.CertInfo)
 	if connected && mgr != nil {
 		mgr.Mu.RLock()
 		for k, v := range mgr.Tunnels {
 			tunnels[k] = v
 		}
+		for k, v := range mgr.Captures {
+			captures[k] = v
+		}
+		for k, v := range mgr.Balances {
+			balances[k] = v
+		}
+		for k, v := range mgr.PortConfigs {
+			portConfigs[k] = v
+		}
+		edgeStats = mgr.EdgeStats
 		for k, v := range mgr.Domains {
-			domains[k] = v
+			domains[k] = v.redacted()
+		}
+		for _, v := range mgr.Certs {
+			certs[v.Domain] = v
 		}
 		mgr.Mu.RUnlock()
 	}
@@ -137,7 +171,12 @@ func (s *APIServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 		"server_addr":    State.ServerAddr,
 		"dashboard_port": State.DashboardPort,
 		"tunnels":        tunnels,
+		"captures":       captures,
+		"balances":       balances,
+		"port_configs":   portConfigs,
+		"edge_stats":     edgeStats,
 		"domains":        domains,
+		"certs":          certs,
 		"stats":          tunnel.GlobalStats,
 		"uptime":         time.Since(State.StartTime).Seconds(),
 	}
@@ -163,7 +202,9 @@ func (s *APIServer) handleTunnels(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := mgr.AddRange(req.PublicPort, req.LocalPort); err != nil {
+		err := mgr.AddRange(req.PublicPort, req.LocalPort)
+		audit(r, "tunnel.add", req.PublicPort+"->"+req.LocalPort, "", err)
+		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
@@ -184,10 +225,12 @@ func (s *APIServer) handleTunnels(w http.ResponseWriter, r *http.Request) {
 		if len(req.PublicPorts) > 0 {
 			for _, p := range req.PublicPorts {
 				mgr.RemoveTunnel(p)
+				audit(r, "tunnel.remove", strconv.Itoa(p), "", nil)
 				count++
 			}
 		} else if req.PublicPort > 0 {
 			mgr.RemoveTunnel(req.PublicPort)
+			audit(r, "tunnel.remove", strconv.Itoa(req.PublicPort), "", nil)
 			count = 1
 		}
 
@@ -217,7 +260,13 @@ func (s *APIServer) handleTunnelsEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := mgr.EditTunnel(req.PublicPort, req.LocalPort, req.NewPublicPort); err != nil {
+	err := mgr.EditTunnel(req.PublicPort, req.LocalPort, req.NewPublicPort)
+	detail := "local " + strconv.Itoa(req.LocalPort)
+	if req.NewPublicPort != nil {
+		detail += ", public " + strconv.Itoa(*req.NewPublicPort)
+	}
+	audit(r, "tunnel.edit", strconv.Itoa(req.PublicPort), detail, err)
+	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -226,6 +275,196 @@ func (s *APIServer) handleTunnelsEdit(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+func (s *APIServer) handleTunnelsCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req struct {
+		PublicPort int `json:"public_port"`
+		ConnCaptureConfig
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	err := mgr.SetCapture(req.PublicPort, req.ConnCaptureConfig)
+	audit(r, "tunnel.capture", strconv.Itoa(req.PublicPort), "", err)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *APIServer) handleTunnelsBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req struct {
+		PublicPort int                   `json:"public_port"`
+		Balance    *tunnel.BalanceConfig `json:"balance"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	err := mgr.SetBalance(req.PublicPort, req.Balance)
+	audit(r, "tunnel.balance", strconv.Itoa(req.PublicPort), "", err)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *APIServer) handleTunnelsAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req struct {
+		PublicPort int                  `json:"public_port"`
+		Access     *tunnel.AccessConfig `json:"access"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	err := mgr.SetPortAccess(req.PublicPort, req.Access)
+	audit(r, "tunnel.access", strconv.Itoa(req.PublicPort), "", err)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *APIServer) handleTunnelsLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req struct {
+		PublicPort int                     `json:"public_port"`
+		ConnLimit  *tunnel.RateLimitConfig `json:"conn_limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	err := mgr.SetPortConnLimit(req.PublicPort, req.ConnLimit)
+	audit(r, "tunnel.limit", strconv.Itoa(req.PublicPort), "", err)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *APIServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	port, _ := strconv.Atoi(r.URL.Query().Get("port"))
+	json.NewEncoder(w).Encode(connRecords(port))
+}
+
+type domainUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Expires  int64  `json:"expires"`
+}
+
+// hashDomainUsers turns the logins from a request into stored users. A user
+// sent without a password keeps the hash it already has.
+func hashDomainUsers(reqs []domainUserRequest, existing []tunnel.DomainUser) ([]tunnel.DomainUser, error) {
+	users := make([]tunnel.DomainUser, 0, len(reqs))
+	for _, req := range reqs {
+		if req.Password == "" {
+			found := false
+			for _, u := range existing {
+				if u.Name == req.Name {
+					u.Expires = req.Expires
+					users = append(users, u)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("user %q needs a password", req.Name)
+			}
+			continue
+		}
+		u, err := tunnel.NewDomainUser(req.Name, req.Password, req.Expires)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// hashAPIKeys replaces plaintext keys with their SHA-256. A key sent without
+// its value keeps the hash it already has.
+func hashAPIKeys(cfg, existing *tunnel.TokenAuthConfig) error {
+	for i, k := range cfg.APIKeys {
+		if k.Key != "" {
+			sum := sha256.Sum256([]byte(k.Key))
+			cfg.APIKeys[i] = tunnel.APIKey{Name: k.Name, Hash: hex.EncodeToString(sum[:])}
+			continue
+		}
+		found := false
+		if existing != nil {
+			for _, old := range existing.APIKeys {
+				if old.Name == k.Name {
+					cfg.APIKeys[i].Hash = old.Hash
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("API key %q needs a value", k.Name)
+		}
+	}
+	return nil
+}
+
 func (s *APIServer) handleDomains(w http.ResponseWriter, r *http.Request) {
 	mgr := State.GetManager()
 	if mgr == nil || !State.IsConnected() {
@@ -239,17 +478,162 @@ func (s *APIServer) handleDomains(w http.ResponseWriter, r *http.Request) {
 			Domain      string `json:"domain"`
 			PublicPort  int    `json:"public_port"`
 			Mode        string `json:"mode"`
-			AuthUser    string `json:"auth_user"`
-			AuthPass    string `json:"auth_pass"`
 			RateLimit   int    `json:"rate_limit"`
 			SmartShield bool   `json:"smart_shield"`
+			Maintenance *bool  `json:"maintenance"`
+
+			// A single login, as sent by older dashboards.
+			AuthUser *string `json:"auth_user"`
+			AuthPass string  `json:"auth_pass"`
+
+			Users    *[]domainUserRequest `json:"users"`
+			Pipeline *[]string            `json:"pipeline"`
+
+			Inspect     *tunnel.InspectConfig     `json:"inspect"`
+			Routes      *[]tunnel.RouteRule       `json:"routes"`
+			Upstream    *tunnel.UpstreamConfig    `json:"upstream"`
+			Access      *tunnel.AccessConfig      `json:"access"`
+			Limiter     *tunnel.RateLimitConfig   `json:"limiter"`
+			Shield      *tunnel.ShieldConfig      `json:"shield"`
+			OIDC        *tunnel.OIDCConfig        `json:"oidc"`
+			TokenAuth   *tunnel.TokenAuthConfig   `json:"token_auth"`
+			MTLS        *tunnel.MTLSConfig        `json:"mtls"`
+			Headers     *tunnel.HeaderConfig      `json:"headers"`
+			Compression *tunnel.CompressionConfig `json:"compression"`
+			Cache       *tunnel.CacheConfig       `json:"cache"`
+			Limits      *tunnel.LimitsConfig      `json:"limits"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), 400)
 			return
 		}
 
-		if err := mgr.AddDomain(req.Domain, req.PublicPort, req.Mode, req.AuthUser, req.AuthPass, req.RateLimit, req.SmartShield); err != nil {
+		entry := ClientDomainEntry{
+			PublicPort:  req.PublicPort,
+			Mode:        req.Mode,
+			RateLimit:   req.RateLimit,
+			SmartShield: req.SmartShield,
+			Inspect:     req.Inspect,
+			Upstream:    req.Upstream,
+			Access:      req.Access,
+			Limiter:     req.Limiter,
+			Shield:      req.Shield,
+			OIDC:        req.OIDC,
+			TokenAuth:   req.TokenAuth,
+			MTLS:        req.MTLS,
+			Headers:     req.Headers,
+			Compression: req.Compression,
+			Cache:       req.Cache,
+			Limits:      req.Limits,
+		}
+
+		// Settings omitted from the request are carried over from the
+		// existing mapping so older dashboards don't wipe them on edit.
+		mgr.Mu.RLock()
+		existing, exists := mgr.Domains[req.Domain]
+		mgr.Mu.RUnlock()
+		if req.Maintenance != nil {
+			entry.Maintenance = *req.Maintenance
+		} else if exists {
+			entry.Maintenance = existing.Maintenance
+		}
+		if req.Routes != nil {
+			entry.Routes = *req.Routes
+		}
+		if req.Pipeline != nil {
+			entry.Pipeline = *req.Pipeline
+		}
+
+		users := req.Users
+		if users == nil && req.AuthUser != nil {
+			users = &[]domainUserRequest{}
+			if *req.AuthUser != "" {
+				*users = append(*users, domainUserRequest{Name: *req.AuthUser, Password: req.AuthPass})
+			}
+		}
+		if users != nil {
+			hashed, err := hashDomainUsers(*users, existing.Users)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			entry.Users = hashed
+		} else if exists {
+			entry.Users = existing.Users
+		}
+
+		if exists {
+			if req.Inspect == nil {
+				entry.Inspect = existing.Inspect
+			}
+			if req.Routes == nil {
+				entry.Routes = existing.Routes
+			}
+			if req.Pipeline == nil {
+				entry.Pipeline = existing.Pipeline
+			}
+			if req.Upstream == nil {
+				entry.Upstream = existing.Upstream
+			}
+			if req.Access == nil {
+				entry.Access = existing.Access
+			}
+			if req.Limiter == nil {
+				entry.Limiter = existing.Limiter
+			}
+			if req.Shield == nil {
+				entry.Shield = existing.Shield
+			}
+			if req.OIDC == nil {
+				entry.OIDC = existing.OIDC
+			} else if req.OIDC.ClientSecret == "" && existing.OIDC != nil && existing.OIDC.ClientID == req.OIDC.ClientID {
+				// The dashboard never sees the secret, so keep it on edit.
+				entry.OIDC.ClientSecret = existing.OIDC.ClientSecret
+			}
+			if req.TokenAuth == nil {
+				entry.TokenAuth = existing.TokenAuth
+			}
+			if req.MTLS == nil {
+				entry.MTLS = existing.MTLS
+			}
+			if req.Headers == nil {
+				entry.Headers = existing.Headers
+			}
+			if req.Compression == nil {
+				entry.Compression = existing.Compression
+			}
+			if req.Cache == nil {
+				entry.Cache = existing.Cache
+			}
+			if req.Limits == nil {
+				entry.Limits = existing.Limits
+			}
+		}
+		if req.MTLS != nil && req.MTLS.CA == "" && req.MTLS.CAFile == "" {
+			entry.MTLS = nil
+		}
+		if req.Headers != nil && len(req.Headers.Request) == 0 && len(req.Headers.Response) == 0 {
+			entry.Headers = nil
+		}
+		if req.Limits != nil && *req.Limits == (tunnel.LimitsConfig{}) {
+			entry.Limits = nil
+		}
+		if req.TokenAuth != nil {
+			if req.TokenAuth.JWKSURL == "" && len(req.TokenAuth.JWKS) == 0 && req.TokenAuth.JWKSFile == "" && len(req.TokenAuth.APIKeys) == 0 {
+				entry.TokenAuth = nil
+			} else if err := hashAPIKeys(req.TokenAuth, existing.TokenAuth); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+
+		err := mgr.AddDomain(req.Domain, entry)
+		action := "domain.map"
+		if exists {
+			action = "domain.edit"
+		}
+		audit(r, action, req.Domain, "port "+strconv.Itoa(entry.PublicPort)+", mode "+entry.Mode, err)
+		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
@@ -263,12 +647,150 @@ func (s *APIServer) handleDomains(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := mgr.RemoveDomain(req.Domain); err != nil {
+		err := mgr.RemoveDomain(req.Domain)
+		audit(r, "domain.unmap", req.Domain, "", err)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	}
+}
+
+func (s *APIServer) handleDomainPages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	var req struct {
+		Domain string `json:"domain"`
+		Kind   string `json:"kind"`
+		HTML   string `json:"html"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		req.HTML = ""
+	} else if req.HTML == "" {
+		http.Error(w, "html is required", 400)
+		return
+	}
+
+	if err := mgr.SetDomainPage(req.Domain, req.Kind, req.HTML); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *APIServer) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	var req struct {
+		Domain string `json:"domain"`
+		Path   string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := mgr.PurgeCache(req.Domain, req.Path); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *APIServer) handleCerts(w http.ResponseWriter, r *http.Request) {
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("refresh") != "" {
+			mgr.CertAction(tunnel.CertActionList, "")
+		}
+		json.NewEncoder(w).Encode(mgr.ListCerts())
+	case "POST":
+		var req struct {
+			Domain  string `json:"domain"`
+			CertPEM string `json:"cert_pem"`
+			KeyPEM  string `json:"key_pem"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := mgr.UploadCert(req.Domain, req.CertPEM, req.KeyPEM); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	case "DELETE":
+		var req struct {
+			Domain string `json:"domain"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := mgr.DeleteCert(req.Domain); err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+func (s *APIServer) handleCertAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req struct {
+		Action string `json:"action"`
+		Domain string `json:"domain"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	mgr := State.GetManager()
+	if mgr == nil || !State.IsConnected() {
+		http.Error(w, "Not connected to server", 503)
+		return
+	}
+
+	if err := mgr.CertAction(req.Action, req.Domain); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "requested"})
 }
 
 func (s *APIServer) handleInspect(w http.ResponseWriter, r *http.Request) {
@@ -365,6 +887,7 @@ func (s *APIServer) handleReplay(w http.ResponseWriter, r *http.Request) {
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(newReq)
+	audit(r, "replay", logEntry.Method+" "+targetURL, "request "+req.ID, err)
 	if err != nil {
 		http.Error(w, "Replay failed: "+err.Error(), 502)
 		return
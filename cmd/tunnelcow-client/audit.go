@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const auditQueryTimeout = 10 * time.Second
+
+var clientAudit = &tunnel.AuditLog{Path: "data/client_audit.log"}
+
+// audit records a dashboard action. err, if set, says why it failed.
+func audit(r *http.Request, action, target, detail string, err error) {
+	e := tunnel.AuditEntry{
+		Action: action,
+		Target: target,
+		Actor:  "dashboard",
+		Addr:   r.RemoteAddr,
+		Detail: detail,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := clientAudit.Record(e); err != nil {
+		log.Printf("[AUDIT] Failed to record %s: %v", action, err)
+	}
+}
+
+// Server audit queries waiting for their AUDIT_LOG reply, by ID.
+var (
+	auditReplies sync.Map
+	auditQueryID atomic.Uint64
+)
+
+// QueryServerAudit fetches entries from the server's audit log.
+func (m *ClientManager) QueryServerAudit(q tunnel.AuditQuery) ([]tunnel.AuditEntry, error) {
+	id := strconv.FormatUint(auditQueryID.Add(1), 10)
+	reply := make(chan tunnel.AuditLogPayload, 1)
+	auditReplies.Store(id, reply)
+	defer auditReplies.Delete(id)
+
+	msg := tunnel.ControlMessage{
+		Type:    tunnel.MsgTypeReqAuditLog,
+		Payload: mustMarshal(tunnel.ReqAuditLogPayload{ID: id, AuditQuery: q}),
+	}
+	m.Mu.Lock()
+	err := json.NewEncoder(m.Control).Encode(msg)
+	m.Mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case p := <-reply:
+		if p.Error != "" {
+			return nil, fmt.Errorf("%s", p.Error)
+		}
+		return p.Entries, nil
+	case <-time.After(auditQueryTimeout):
+		return nil, fmt.Errorf("server did not answer")
+	}
+}
+
+func (m *ClientManager) handleAuditLog(payload json.RawMessage) {
+	var p tunnel.AuditLogPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+	if ch, ok := auditReplies.Load(p.ID); ok {
+		select {
+		case ch.(chan tunnel.AuditLogPayload) <- p:
+		default:
+		}
+	}
+}
+
+// parseAuditTime accepts RFC 3339 or Unix seconds.
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// handleAudit serves the client's audit log, or the server's with
+// ?source=server, filtered by since, until, action and limit.
+func (s *APIServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var q tunnel.AuditQuery
+	var err error
+	if q.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		http.Error(w, "Invalid since: "+err.Error(), 400)
+		return
+	}
+	if q.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		http.Error(w, "Invalid until: "+err.Error(), 400)
+		return
+	}
+	q.Action = query.Get("action")
+	q.Limit, _ = strconv.Atoi(query.Get("limit"))
+
+	var entries []tunnel.AuditEntry
+	switch query.Get("source") {
+	case "", "client":
+		entries, err = clientAudit.Query(q)
+	case "server":
+		mgr := State.GetManager()
+		if mgr == nil || !State.IsConnected() {
+			http.Error(w, "Not connected to server", 503)
+			return
+		}
+		entries, err = mgr.QueryServerAudit(q)
+	default:
+		http.Error(w, "source must be client or server", 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"tunnelcow/internal/tunnel"
+)
+
+func (m *ClientManager) UploadCert(domain, certPEM, keyPEM string) error {
+	if domain == "" || certPEM == "" || keyPEM == "" {
+		return fmt.Errorf("domain, certificate and key are required")
+	}
+
+	msg := tunnel.ControlMessage{
+		Type: tunnel.MsgTypeReqCertUpload,
+		Payload: mustMarshal(tunnel.ReqCertUploadPayload{
+			Domain:  domain,
+			CertPEM: certPEM,
+			KeyPEM:  keyPEM,
+		}),
+	}
+	if err := json.NewEncoder(m.Control).Encode(msg); err != nil {
+		return err
+	}
+	log.Printf("Uploaded certificate for %s", domain)
+	return nil
+}
+
+func (m *ClientManager) DeleteCert(domain string) error {
+	msg := tunnel.ControlMessage{
+		Type:    tunnel.MsgTypeReqCertDelete,
+		Payload: mustMarshal(tunnel.ReqCertDeletePayload{Domain: domain}),
+	}
+	return json.NewEncoder(m.Control).Encode(msg)
+}
+
+// CertAction asks the server to list, renew or revoke certificates. Results
+// arrive asynchronously as CERT_STATUS messages.
+func (m *ClientManager) CertAction(action, domain string) error {
+	switch action {
+	case tunnel.CertActionList:
+	case tunnel.CertActionRenew, tunnel.CertActionRevoke:
+		m.Mu.RLock()
+		_, exists := m.Domains[domain]
+		m.Mu.RUnlock()
+		if !exists {
+			return fmt.Errorf("domain %s is not mapped", domain)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	msg := tunnel.ControlMessage{
+		Type: tunnel.MsgTypeReqCertAction,
+		Payload: mustMarshal(tunnel.ReqCertActionPayload{
+			Action: action,
+			Domain: domain,
+		}),
+	}
+	if err := json.NewEncoder(m.Control).Encode(msg); err != nil {
+		return err
+	}
+	if action != tunnel.CertActionList {
+		log.Printf("Requested certificate %s for %s", action, domain)
+	}
+	return nil
+}
+
+func (m *ClientManager) handleCertStatus(payload json.RawMessage) {
+	var status tunnel.CertStatusPayload
+	if err := json.Unmarshal(payload, &status); err != nil {
+		log.Printf("Invalid CERT_STATUS: %v", err)
+		return
+	}
+
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	if status.Full {
+		m.Certs = make(map[string]tunnel.CertInfo)
+	}
+	for _, info := range status.Certs {
+		key := info.Source + ":" + info.Domain
+		if info.Removed {
+			delete(m.Certs, key)
+			continue
+		}
+		m.Certs[key] = info
+		if info.Error != "" {
+			log.Printf("Certificate for %s: %s", info.Domain, info.Error)
+		}
+	}
+}
+
+func (m *ClientManager) ListCerts() []tunnel.CertInfo {
+	m.Mu.RLock()
+	defer m.Mu.RUnlock()
+
+	list := []tunnel.CertInfo{}
+	for _, info := range m.Certs {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultCaptureBytes = 256
+	maxCaptureBytes     = 64 * 1024
+	maxConnLogs         = 200
+)
+
+// ConnCaptureConfig enables connection records for a raw TCP tunnel.
+// MaxBytes is how much of each direction is kept (default 256) and Format
+// is "hex" (default) or "text".
+type ConnCaptureConfig struct {
+	Enabled  bool   `json:"enabled"`
+	MaxBytes int    `json:"max_bytes,omitempty"`
+	Format   string `json:"format,omitempty"`
+}
+
+type ConnRecord struct {
+	ID         string `json:"id"`
+	PublicPort int    `json:"public_port"`
+	LocalPort  int    `json:"local_port"`
+	RemoteAddr string `json:"remote_addr"`
+	State      string `json:"state"`
+	OpenedAt   int64  `json:"opened_at"`
+	ClosedAt   int64  `json:"closed_at,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+	HeadIn     string `json:"head_in,omitempty"`
+	HeadOut    string `json:"head_out,omitempty"`
+	Format     string `json:"format"`
+	Error      string `json:"error,omitempty"`
+}
+
+var (
+	ConnLogs   []*connCapture
+	ConnLogsMu sync.RWMutex
+)
+
+type connCapture struct {
+	mu       sync.Mutex
+	record   ConnRecord
+	opened   time.Time
+	maxBytes int
+	headIn   []byte
+	headOut  []byte
+}
+
+func (m *ClientManager) SetCapture(publicPort int, cfg ConnCaptureConfig) error {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	if _, exists := m.Tunnels[publicPort]; !exists {
+		return fmt.Errorf("public port %d is not active", publicPort)
+	}
+	if cfg.Format != "" && cfg.Format != "hex" && cfg.Format != "text" {
+		return fmt.Errorf("unknown capture format %q", cfg.Format)
+	}
+
+	if cfg.Enabled {
+		m.Captures[publicPort] = &cfg
+	} else {
+		delete(m.Captures, publicPort)
+	}
+	m.saveTunnels()
+	log.Printf("Connection capture for :%d: %v", publicPort, cfg.Enabled)
+	return nil
+}
+
+func startConnCapture(cfg ConnCaptureConfig, conn tunnel.NewConnPayload, localPort int) *connCapture {
+	maxBytes := cfg.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultCaptureBytes
+	}
+	if maxBytes > maxCaptureBytes {
+		maxBytes = maxCaptureBytes
+	}
+	format := cfg.Format
+	if format == "" {
+		format = "hex"
+	}
+
+	now := time.Now()
+	c := &connCapture{
+		opened:   now,
+		maxBytes: maxBytes,
+		record: ConnRecord{
+			ID:         uuid.New().String(),
+			PublicPort: conn.PublicPort,
+			LocalPort:  localPort,
+			RemoteAddr: conn.RemoteAddr,
+			State:      "open",
+			OpenedAt:   now.UnixMilli(),
+			Format:     format,
+		},
+	}
+
+	ConnLogsMu.Lock()
+	ConnLogs = append(ConnLogs, c)
+	if len(ConnLogs) > maxConnLogs {
+		ConnLogs = ConnLogs[len(ConnLogs)-maxConnLogs:]
+	}
+	ConnLogsMu.Unlock()
+
+	return c
+}
+
+// reader wraps one direction of the connection. inbound is visitor → local
+// service, outbound is local service → visitor.
+func (c *connCapture) reader(r io.Reader, inbound bool) io.Reader {
+	return &captureReader{R: r, Capture: c, Inbound: inbound}
+}
+
+func (c *connCapture) observe(p []byte, inbound bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if inbound {
+		c.record.BytesIn += uint64(len(p))
+		c.headIn = appendHead(c.headIn, p, c.maxBytes)
+	} else {
+		c.record.BytesOut += uint64(len(p))
+		c.headOut = appendHead(c.headOut, p, c.maxBytes)
+	}
+}
+
+func (c *connCapture) fail(err error) {
+	c.mu.Lock()
+	c.record.Error = err.Error()
+	c.mu.Unlock()
+	c.finish()
+}
+
+func (c *connCapture) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.record.State = "closed"
+	c.record.ClosedAt = now.UnixMilli()
+	c.record.DurationMs = now.Sub(c.opened).Milliseconds()
+}
+
+func (c *connCapture) snapshot() ConnRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec := c.record
+	if rec.State == "open" {
+		rec.DurationMs = time.Since(c.opened).Milliseconds()
+	}
+	rec.HeadIn = formatHead(c.headIn, rec.Format)
+	rec.HeadOut = formatHead(c.headOut, rec.Format)
+	return rec
+}
+
+type captureReader struct {
+	R       io.Reader
+	Capture *connCapture
+	Inbound bool
+}
+
+func (cr *captureReader) Read(p []byte) (n int, err error) {
+	n, err = cr.R.Read(p)
+	if n > 0 {
+		cr.Capture.observe(p[:n], cr.Inbound)
+	}
+	return
+}
+
+func appendHead(head, p []byte, max int) []byte {
+	if room := max - len(head); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		head = append(head, p...)
+	}
+	return head
+}
+
+func formatHead(head []byte, format string) string {
+	if len(head) == 0 {
+		return ""
+	}
+	if format == "text" {
+		out := make([]byte, len(head))
+		for i, b := range head {
+			if (b >= 0x20 && b < 0x7f) || b == '\n' || b == '\r' || b == '\t' {
+				out[i] = b
+			} else {
+				out[i] = '.'
+			}
+		}
+		return string(out)
+	}
+	return hex.Dump(head)
+}
+
+func connRecords(publicPort int) []ConnRecord {
+	ConnLogsMu.RLock()
+	defer ConnLogsMu.RUnlock()
+
+	list := []ConnRecord{}
+	for _, c := range ConnLogs {
+		rec := c.snapshot()
+		if publicPort != 0 && rec.PublicPort != publicPort {
+			continue
+		}
+		list = append(list, rec)
+	}
+	return list
+}
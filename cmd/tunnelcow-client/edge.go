@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"tunnelcow/internal/tunnel"
+)
+
+// SetPortAccess sets the allow/deny lists enforced by the server on a raw
+// TCP public port. A nil config removes them.
+func (m *ClientManager) SetPortAccess(publicPort int, access *tunnel.AccessConfig) error {
+	if access != nil {
+		if err := access.Validate(); err != nil {
+			return err
+		}
+	}
+	return m.updatePortConfig(publicPort, func(cfg *tunnel.PortConfig) {
+		cfg.Access = access
+	})
+}
+
+// SetPortConnLimit caps how fast each visitor IP may open connections to a
+// raw TCP public port. A nil config removes the cap.
+func (m *ClientManager) SetPortConnLimit(publicPort int, limit *tunnel.RateLimitConfig) error {
+	if limit != nil {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+	}
+	return m.updatePortConfig(publicPort, func(cfg *tunnel.PortConfig) {
+		cfg.ConnLimit = limit
+	})
+}
+
+func (m *ClientManager) updatePortConfig(publicPort int, update func(*tunnel.PortConfig)) error {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+
+	if _, exists := m.Tunnels[publicPort]; !exists {
+		return fmt.Errorf("public port %d is not active", publicPort)
+	}
+
+	update(m.portConfig(publicPort))
+	if err := m.sendPortConfig(publicPort); err != nil {
+		return err
+	}
+	m.saveTunnels()
+	log.Printf("Updated edge settings for :%d", publicPort)
+	return nil
+}
+
+// portConfig returns the port's config, creating it if needed. Callers hold
+// m.Mu.
+func (m *ClientManager) portConfig(publicPort int) *tunnel.PortConfig {
+	cfg, ok := m.PortConfigs[publicPort]
+	if !ok {
+		cfg = &tunnel.PortConfig{}
+		m.PortConfigs[publicPort] = cfg
+	}
+	return cfg
+}
+
+// sendPortConfig pushes the port's config to the server. It must follow
+// every bind, since the server drops the config with the listener. Callers
+// hold m.Mu.
+func (m *ClientManager) sendPortConfig(publicPort int) error {
+	cfg, ok := m.PortConfigs[publicPort]
+	if !ok {
+		return nil
+	}
+	msg := tunnel.ControlMessage{
+		Type: tunnel.MsgTypeReqPortConfig,
+		Payload: mustMarshal(tunnel.ReqPortConfigPayload{
+			PublicPort: publicPort,
+			PortConfig: *cfg,
+		}),
+	}
+	return json.NewEncoder(m.Control).Encode(msg)
+}
+
+func (m *ClientManager) handleEdgeStats(payload json.RawMessage) {
+	var stats tunnel.EdgeStatsPayload
+	if err := json.Unmarshal(payload, &stats); err != nil {
+		return
+	}
+	m.Mu.Lock()
+	m.EdgeStats = stats
+	m.Mu.Unlock()
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,47 +27,319 @@ type TunnelConfig struct {
 type ClientDomainEntry struct {
 	PublicPort  int    `json:"public_port"`
 	Mode        string `json:"mode"`
-	AuthUser    string `json:"auth_user,omitempty"`
-	AuthPass    string `json:"auth_pass,omitempty"`
 	RateLimit   int    `json:"rate_limit,omitempty"`
 	SmartShield bool   `json:"smart_shield,omitempty"`
+	Maintenance bool   `json:"maintenance,omitempty"`
+
+	Pipeline    []string                  `json:"pipeline,omitempty"`
+	Users       []tunnel.DomainUser       `json:"users,omitempty"`
+	Inspect     *tunnel.InspectConfig     `json:"inspect,omitempty"`
+	Routes      []tunnel.RouteRule        `json:"routes,omitempty"`
+	Upstream    *tunnel.UpstreamConfig    `json:"upstream,omitempty"`
+	Access      *tunnel.AccessConfig      `json:"access,omitempty"`
+	Limiter     *tunnel.RateLimitConfig   `json:"limiter,omitempty"`
+	Shield      *tunnel.ShieldConfig      `json:"shield,omitempty"`
+	OIDC        *tunnel.OIDCConfig        `json:"oidc,omitempty"`
+	TokenAuth   *tunnel.TokenAuthConfig   `json:"token_auth,omitempty"`
+	MTLS        *tunnel.MTLSConfig        `json:"mtls,omitempty"`
+	Headers     *tunnel.HeaderConfig      `json:"headers,omitempty"`
+	Compression *tunnel.CompressionConfig `json:"compression,omitempty"`
+	Cache       *tunnel.CacheConfig       `json:"cache,omitempty"`
+	Limits      *tunnel.LimitsConfig      `json:"limits,omitempty"`
+}
+
+func (e ClientDomainEntry) usesPort(publicPort int) bool {
+	if e.PublicPort == publicPort {
+		return true
+	}
+	for _, rule := range e.Routes {
+		if rule.PublicPort == publicPort {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted drops password hashes, client secrets and API key hashes so the
+// entry can be shown in the dashboard.
+func (e ClientDomainEntry) redacted() ClientDomainEntry {
+	if len(e.Users) > 0 {
+		users := make([]tunnel.DomainUser, len(e.Users))
+		for i, u := range e.Users {
+			users[i] = tunnel.DomainUser{Name: u.Name, Expires: u.Expires}
+		}
+		e.Users = users
+	}
+	if e.OIDC != nil {
+		oidc := *e.OIDC
+		oidc.ClientSecret = ""
+		e.OIDC = &oidc
+	}
+	if e.TokenAuth != nil {
+		ta := *e.TokenAuth
+		ta.APIKeys = make([]tunnel.APIKey, len(e.TokenAuth.APIKeys))
+		for i, k := range e.TokenAuth.APIKeys {
+			ta.APIKeys[i] = tunnel.APIKey{Name: k.Name}
+		}
+		e.TokenAuth = &ta
+	}
+	return e
+}
+
+type savedDomain struct {
+	Domain      string `json:"domain"`
+	Port        int    `json:"port"`
+	Mode        string `json:"mode"`
+	RateLimit   int    `json:"rate_limit,omitempty"`
+	SmartShield bool   `json:"smart_shield,omitempty"`
+	Maintenance bool   `json:"maintenance,omitempty"`
+
+	// Plaintext login from older versions, hashed into Users on restore.
+	AuthUser string `json:"auth_user,omitempty"`
+	AuthPass string `json:"auth_pass,omitempty"`
+
+	Pipeline    []string                  `json:"pipeline,omitempty"`
+	Users       []tunnel.DomainUser       `json:"users,omitempty"`
+	Inspect     *tunnel.InspectConfig     `json:"inspect,omitempty"`
+	Routes      []tunnel.RouteRule        `json:"routes,omitempty"`
+	Upstream    *tunnel.UpstreamConfig    `json:"upstream,omitempty"`
+	Access      *tunnel.AccessConfig      `json:"access,omitempty"`
+	Limiter     *tunnel.RateLimitConfig   `json:"limiter,omitempty"`
+	Shield      *tunnel.ShieldConfig      `json:"shield,omitempty"`
+	OIDC        *tunnel.OIDCConfig        `json:"oidc,omitempty"`
+	TokenAuth   *tunnel.TokenAuthConfig   `json:"token_auth,omitempty"`
+	MTLS        *tunnel.MTLSConfig        `json:"mtls,omitempty"`
+	Headers     *tunnel.HeaderConfig      `json:"headers,omitempty"`
+	Compression *tunnel.CompressionConfig `json:"compression,omitempty"`
+	Cache       *tunnel.CacheConfig       `json:"cache,omitempty"`
+	Limits      *tunnel.LimitsConfig      `json:"limits,omitempty"`
+}
+
+type savedTunnel struct {
+	Public  int                   `json:"public"`
+	Local   int                   `json:"local"`
+	Capture *ConnCaptureConfig    `json:"capture,omitempty"`
+	Balance *tunnel.BalanceConfig `json:"balance,omitempty"`
+	Config  *tunnel.PortConfig    `json:"config,omitempty"`
 }
 
 type ClientManager struct {
-	Control net.Conn
-	Session *yamux.Session
-	Tunnels map[int]int
-	Domains map[string]ClientDomainEntry
-	Mu      sync.RWMutex
-	Debug   bool
+	Control     net.Conn
+	Session     *yamux.Session
+	Tunnels     map[int]int
+	Captures    map[int]*ConnCaptureConfig
+	Balances    map[int]*tunnel.BalanceConfig
+	PortConfigs map[int]*tunnel.PortConfig
+	EdgeStats   tunnel.EdgeStatsPayload
+	Domains     map[string]ClientDomainEntry
+	Certs       map[string]tunnel.CertInfo
+	Mu          sync.RWMutex
+	Debug       bool
 }
 
 func NewClientManager(control net.Conn, session *yamux.Session, debug bool) *ClientManager {
 	return &ClientManager{
-		Control: control,
-		Session: session,
-		Tunnels: make(map[int]int),
-		Domains: make(map[string]ClientDomainEntry),
-		Debug:   debug,
+		Control:     control,
+		Session:     session,
+		Tunnels:     make(map[int]int),
+		Captures:    make(map[int]*ConnCaptureConfig),
+		Balances:    make(map[int]*tunnel.BalanceConfig),
+		PortConfigs: make(map[int]*tunnel.PortConfig),
+		Domains:     make(map[string]ClientDomainEntry),
+		Certs:       make(map[string]tunnel.CertInfo),
+		Debug:       debug,
 	}
 }
 
-func (m *ClientManager) AddDomain(domain string, publicPort int, mode string, authUser, authPass string, rateLimit int, smartShield bool) error {
+// tlsOnlyFeatures lists the settings of e that need the server to terminate
+// TLS, which passthrough domains don't. Only access lists work without it.
+func (e ClientDomainEntry) tlsOnlyFeatures() []string {
+	var used []string
+	if len(e.Users) > 0 {
+		used = append(used, "login")
+	}
+	if e.Limiter != nil || e.RateLimit > 0 {
+		used = append(used, "rate limiting")
+	}
+	if e.Shield != nil || e.SmartShield {
+		used = append(used, "Smart Shield")
+	}
+	if e.Inspect != nil && e.Inspect.Enabled {
+		used = append(used, "inspection")
+	}
+	if e.Maintenance {
+		used = append(used, "maintenance mode")
+	}
+	if len(e.Routes) > 0 {
+		used = append(used, "path routes")
+	}
+	if e.OIDC != nil {
+		used = append(used, "OIDC login")
+	}
+	if e.TokenAuth != nil {
+		used = append(used, "token auth")
+	}
+	if e.MTLS != nil {
+		used = append(used, "client certificates")
+	}
+	if e.Headers != nil {
+		used = append(used, "header rules")
+	}
+	if e.Compression != nil && e.Compression.Enabled {
+		used = append(used, "compression")
+	}
+	if e.Cache != nil && e.Cache.Enabled {
+		used = append(used, "caching")
+	}
+	if e.Limits != nil {
+		used = append(used, "request limits")
+	}
+	return used
+}
+
+func (m *ClientManager) AddDomain(domain string, entry ClientDomainEntry) error {
 	m.Mu.RLock()
 	defer m.Mu.RUnlock()
 
-	if _, exists := m.Tunnels[publicPort]; !exists {
-		return fmt.Errorf("public port %d is not active", publicPort)
+	if _, exists := m.Tunnels[entry.PublicPort]; !exists {
+		return fmt.Errorf("public port %d is not active", entry.PublicPort)
+	}
+	if entry.Access != nil {
+		if err := entry.Access.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Limiter != nil && entry.Limiter.Rate == 0 {
+		entry.Limiter = nil
+	}
+	if entry.Limiter != nil {
+		if err := entry.Limiter.Validate(); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, u := range entry.Users {
+		if u.Name == "" || u.Hash == "" {
+			return fmt.Errorf("every user needs a name and password")
+		}
+		if seen[u.Name] {
+			return fmt.Errorf("user %q is listed twice", u.Name)
+		}
+		seen[u.Name] = true
+	}
+	if entry.OIDC != nil && entry.OIDC.Issuer == "" {
+		entry.OIDC = nil
+	}
+	if entry.Mode == "passthrough" {
+		if used := entry.tlsOnlyFeatures(); len(used) > 0 {
+			return fmt.Errorf("passthrough mode can't be combined with %s, which need TLS termination", strings.Join(used, ", "))
+		}
+	}
+	if entry.OIDC != nil {
+		if err := entry.OIDC.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.TokenAuth != nil {
+		if entry.TokenAuth.JWKSFile != "" {
+			data, err := os.ReadFile(entry.TokenAuth.JWKSFile)
+			if err != nil {
+				return fmt.Errorf("reading JWKS file: %v", err)
+			}
+			cfg := *entry.TokenAuth
+			cfg.JWKS = data
+			entry.TokenAuth = &cfg
+		}
+		if err := entry.TokenAuth.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.MTLS != nil {
+		if entry.Mode == "http" {
+			return fmt.Errorf("client certificates need TLS and can't be used in http mode")
+		}
+		if entry.MTLS.CAFile != "" {
+			data, err := os.ReadFile(entry.MTLS.CAFile)
+			if err != nil {
+				return fmt.Errorf("reading CA file: %v", err)
+			}
+			cfg := *entry.MTLS
+			cfg.CA = string(data)
+			entry.MTLS = &cfg
+		}
+		if err := entry.MTLS.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Limits != nil {
+		if err := entry.Limits.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Cache != nil {
+		if err := entry.Cache.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Compression != nil {
+		if err := entry.Compression.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Headers != nil {
+		if err := entry.Headers.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Shield != nil {
+		if err := entry.Shield.Validate(); err != nil {
+			return err
+		}
+	}
+	if entry.Upstream != nil {
+		if err := entry.Upstream.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := tunnel.ValidatePipeline(entry.Pipeline); err != nil {
+		return err
+	}
+	for i, rule := range entry.Routes {
+		if rule.PathPrefix == "" && rule.PathRegex == "" {
+			return fmt.Errorf("route %d needs a path prefix or regex", i+1)
+		}
+		if rule.PathRegex != "" {
+			if _, err := regexp.Compile(rule.PathRegex); err != nil {
+				return fmt.Errorf("route %d: invalid regex: %v", i+1, err)
+			}
+		}
+		if _, exists := m.Tunnels[rule.PublicPort]; !exists {
+			return fmt.Errorf("route %d: public port %d is not active", i+1, rule.PublicPort)
+		}
 	}
 
 	req := tunnel.ReqDomainMapPayload{
 		Domain:      domain,
-		PublicPort:  publicPort,
-		Mode:        mode,
-		AuthUser:    authUser,
-		AuthPass:    authPass,
-		RateLimit:   rateLimit,
-		SmartShield: smartShield,
+		PublicPort:  entry.PublicPort,
+		Mode:        entry.Mode,
+		RateLimit:   entry.RateLimit,
+		SmartShield: entry.SmartShield,
+		Maintenance: entry.Maintenance,
+		Pipeline:    entry.Pipeline,
+		Users:       entry.Users,
+		Inspect:     entry.Inspect,
+		Routes:      entry.Routes,
+		Upstream:    entry.Upstream,
+		Access:      entry.Access,
+		Limiter:     entry.Limiter,
+		Shield:      entry.Shield,
+		OIDC:        entry.OIDC,
+		TokenAuth:   entry.TokenAuth,
+		MTLS:        entry.MTLS,
+		Headers:     entry.Headers,
+		Compression: entry.Compression,
+		Cache:       entry.Cache,
+		Limits:      entry.Limits,
 	}
 
 	msg := tunnel.ControlMessage{
@@ -78,16 +351,9 @@ func (m *ClientManager) AddDomain(domain string, publicPort int, mode string, au
 		return err
 	}
 
-	m.Domains[domain] = ClientDomainEntry{
-		PublicPort:  publicPort,
-		Mode:        mode,
-		AuthUser:    authUser,
-		AuthPass:    authPass,
-		RateLimit:   rateLimit,
-		SmartShield: smartShield,
-	}
+	m.Domains[domain] = entry
 	m.saveDomains()
-	log.Printf("Mapped domain %s -> :%d (Mode: %s, Auth: %v, Limit: %d, Shield: %v)", domain, publicPort, mode, authUser != "", rateLimit, smartShield)
+	log.Printf("Mapped domain %s -> :%d (Mode: %s, Auth: %v, Limit: %d, Shield: %v, Inspect: %v)", domain, entry.PublicPort, entry.Mode, len(entry.Users) > 0, entry.RateLimit, entry.SmartShield, entry.Inspect != nil && entry.Inspect.Enabled)
 	return nil
 }
 
@@ -111,26 +377,91 @@ func (m *ClientManager) RemoveDomain(domain string) error {
 	return nil
 }
 
-func (m *ClientManager) saveDomains() {
-	type savedDomain struct {
-		Domain      string `json:"domain"`
-		Port        int    `json:"port"`
-		Mode        string `json:"mode"`
-		AuthUser    string `json:"auth_user,omitempty"`
-		AuthPass    string `json:"auth_pass,omitempty"`
-		RateLimit   int    `json:"rate_limit,omitempty"`
-		SmartShield bool   `json:"smart_shield,omitempty"`
+func (m *ClientManager) SetDomainPage(domain, kind, html string) error {
+	if !tunnel.ValidPageKind(kind) {
+		return fmt.Errorf("unknown page kind %q", kind)
 	}
+
+	m.Mu.RLock()
+	_, exists := m.Domains[domain]
+	m.Mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("domain %s is not mapped", domain)
+	}
+
+	msg := tunnel.ControlMessage{
+		Type: tunnel.MsgTypeReqDomainPage,
+		Payload: mustMarshal(tunnel.ReqDomainPagePayload{
+			Domain: domain,
+			Kind:   kind,
+			HTML:   html,
+		}),
+	}
+	if err := json.NewEncoder(m.Control).Encode(msg); err != nil {
+		return err
+	}
+
+	if html == "" {
+		log.Printf("Reset %s page for %s", kind, domain)
+	} else {
+		log.Printf("Uploaded %s page for %s (%d bytes)", kind, domain, len(html))
+	}
+	return nil
+}
+
+// PurgeCache asks the server to drop cached responses of domain. See
+// tunnel.ReqCachePurgePayload for how path is matched.
+func (m *ClientManager) PurgeCache(domain, path string) error {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+
+	m.Mu.RLock()
+	_, exists := m.Domains[domain]
+	m.Mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("domain %s is not mapped", domain)
+	}
+
+	msg := tunnel.ControlMessage{
+		Type: tunnel.MsgTypeReqCachePurge,
+		Payload: mustMarshal(tunnel.ReqCachePurgePayload{
+			Domain: domain,
+			Path:   path,
+		}),
+	}
+	if err := json.NewEncoder(m.Control).Encode(msg); err != nil {
+		return err
+	}
+	log.Printf("Purged cache of %s%s", domain, path)
+	return nil
+}
+
+func (m *ClientManager) saveDomains() {
 	var list = []savedDomain{}
 	for d, e := range m.Domains {
 		list = append(list, savedDomain{
 			Domain:      d,
 			Port:        e.PublicPort,
 			Mode:        e.Mode,
-			AuthUser:    e.AuthUser,
-			AuthPass:    e.AuthPass,
 			RateLimit:   e.RateLimit,
 			SmartShield: e.SmartShield,
+			Maintenance: e.Maintenance,
+			Pipeline:    e.Pipeline,
+			Users:       e.Users,
+			Inspect:     e.Inspect,
+			Routes:      e.Routes,
+			Upstream:    e.Upstream,
+			Access:      e.Access,
+			Limiter:     e.Limiter,
+			Shield:      e.Shield,
+			OIDC:        e.OIDC,
+			TokenAuth:   e.TokenAuth,
+			MTLS:        e.MTLS,
+			Headers:     e.Headers,
+			Compression: e.Compression,
+			Cache:       e.Cache,
+			Limits:      e.Limits,
 		})
 	}
 	file, _ := json.MarshalIndent(list, "", "  ")
@@ -143,15 +474,6 @@ func (m *ClientManager) restoreDomains() {
 	if err != nil {
 		return
 	}
-	type savedDomain struct {
-		Domain      string `json:"domain"`
-		Port        int    `json:"port"`
-		Mode        string `json:"mode"`
-		AuthUser    string `json:"auth_user,omitempty"`
-		AuthPass    string `json:"auth_pass,omitempty"`
-		RateLimit   int    `json:"rate_limit,omitempty"`
-		SmartShield bool   `json:"smart_shield,omitempty"`
-	}
 	var list []savedDomain
 	if err := json.Unmarshal(data, &list); err != nil {
 		return
@@ -161,7 +483,37 @@ func (m *ClientManager) restoreDomains() {
 		if d.Mode == "" {
 			d.Mode = "auto"
 		}
-		if err := m.AddDomain(d.Domain, d.Port, d.Mode, d.AuthUser, d.AuthPass, d.RateLimit, d.SmartShield); err != nil {
+		entry := ClientDomainEntry{
+			PublicPort:  d.Port,
+			Mode:        d.Mode,
+			RateLimit:   d.RateLimit,
+			SmartShield: d.SmartShield,
+			Maintenance: d.Maintenance,
+			Pipeline:    d.Pipeline,
+			Users:       d.Users,
+			Inspect:     d.Inspect,
+			Routes:      d.Routes,
+			Upstream:    d.Upstream,
+			Access:      d.Access,
+			Limiter:     d.Limiter,
+			Shield:      d.Shield,
+			OIDC:        d.OIDC,
+			TokenAuth:   d.TokenAuth,
+			MTLS:        d.MTLS,
+			Headers:     d.Headers,
+			Compression: d.Compression,
+			Cache:       d.Cache,
+			Limits:      d.Limits,
+		}
+		if d.AuthUser != "" && len(entry.Users) == 0 {
+			u, err := tunnel.NewDomainUser(d.AuthUser, d.AuthPass, 0)
+			if err != nil {
+				log.Printf("Failed to hash login for %s: %v", d.Domain, err)
+				continue
+			}
+			entry.Users = []tunnel.DomainUser{u}
+		}
+		if err := m.AddDomain(d.Domain, entry); err != nil {
 			log.Printf("Failed to restore domain %s: %v", d.Domain, err)
 		}
 	}
@@ -201,6 +553,7 @@ func (m *ClientManager) AddTunnel(publicPort, localPort int) error {
 	req := tunnel.ReqBindPayload{
 		PublicPort: publicPort,
 		LocalPort:  localPort,
+		Balance:    m.Balances[publicPort],
 	}
 
 	msg := tunnel.ControlMessage{
@@ -211,6 +564,9 @@ func (m *ClientManager) AddTunnel(publicPort, localPort int) error {
 	if err := json.NewEncoder(m.Control).Encode(msg); err != nil {
 		return err
 	}
+	if err := m.sendPortConfig(publicPort); err != nil {
+		return err
+	}
 
 	m.Tunnels[publicPort] = localPort
 	m.saveTunnels()
@@ -230,7 +586,7 @@ func (m *ClientManager) EditTunnel(publicPort, localPort int, newPublicPort *int
 
 	linkedToDomain := false
 	for _, entry := range m.Domains {
-		if entry.PublicPort == publicPort {
+		if entry.usesPort(publicPort) {
 			linkedToDomain = true
 			break
 		}
@@ -294,10 +650,23 @@ func (m *ClientManager) EditTunnel(publicPort, localPort int, newPublicPort *int
 		}
 
 		delete(m.Tunnels, publicPort)
+		if capture, ok := m.Captures[publicPort]; ok {
+			delete(m.Captures, publicPort)
+			m.Captures[*newPublicPort] = capture
+		}
+		if balance, ok := m.Balances[publicPort]; ok {
+			delete(m.Balances, publicPort)
+			m.Balances[*newPublicPort] = balance
+		}
+		if cfg, ok := m.PortConfigs[publicPort]; ok {
+			delete(m.PortConfigs, publicPort)
+			m.PortConfigs[*newPublicPort] = cfg
+		}
 
 		bindReq := tunnel.ReqBindPayload{
 			PublicPort: *newPublicPort,
 			LocalPort:  localPort,
+			Balance:    m.Balances[*newPublicPort],
 		}
 		bindMsg := tunnel.ControlMessage{
 			Type:    tunnel.MsgTypeReqBind,
@@ -306,6 +675,9 @@ func (m *ClientManager) EditTunnel(publicPort, localPort int, newPublicPort *int
 		if err := json.NewEncoder(m.Control).Encode(bindMsg); err != nil {
 			return err
 		}
+		if err := m.sendPortConfig(*newPublicPort); err != nil {
+			return err
+		}
 
 		m.Tunnels[*newPublicPort] = localPort
 		m.saveTunnels()
@@ -323,6 +695,86 @@ func (m *ClientManager) EditTunnel(publicPort, localPort int, newPublicPort *int
 	return nil
 }
 
+// Balance changes waiting for their BIND_STATUS reply, by ID.
+var (
+	bindReplies sync.Map
+	bindReqID   atomic.Uint64
+)
+
+const bindReplyTimeout = 10 * time.Second
+
+// SetBalance joins or leaves load balancing for a tunnel. The server
+// changes the policy of a port this client already holds in place, and
+// refuses to turn balancing off while other clients share the port, so the
+// setting is only saved once the server accepted it.
+func (m *ClientManager) SetBalance(publicPort int, cfg *tunnel.BalanceConfig) error {
+	if cfg != nil && !tunnel.ValidBalancePolicy(cfg.Policy) {
+		return fmt.Errorf("unknown balance policy %q", cfg.Policy)
+	}
+
+	id := strconv.FormatUint(bindReqID.Add(1), 10)
+	reply := make(chan tunnel.BindStatusPayload, 1)
+	bindReplies.Store(id, reply)
+	defer bindReplies.Delete(id)
+
+	m.Mu.Lock()
+	localPort, exists := m.Tunnels[publicPort]
+	if !exists {
+		m.Mu.Unlock()
+		return fmt.Errorf("public port %d is not active", publicPort)
+	}
+	bindMsg := tunnel.ControlMessage{
+		Type: tunnel.MsgTypeReqBind,
+		Payload: mustMarshal(tunnel.ReqBindPayload{
+			PublicPort: publicPort,
+			LocalPort:  localPort,
+			ID:         id,
+			Balance:    cfg,
+		}),
+	}
+	err := json.NewEncoder(m.Control).Encode(bindMsg)
+	m.Mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case status := <-reply:
+		if status.Error != "" {
+			return fmt.Errorf("%s", status.Error)
+		}
+	case <-time.After(bindReplyTimeout):
+		return fmt.Errorf("server did not answer")
+	}
+
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	if _, exists := m.Tunnels[publicPort]; !exists {
+		return fmt.Errorf("public port %d is not active", publicPort)
+	}
+	if cfg != nil {
+		m.Balances[publicPort] = cfg
+	} else {
+		delete(m.Balances, publicPort)
+	}
+	m.saveTunnels()
+	log.Printf("Load balancing for :%d: %v", publicPort, cfg != nil)
+	return nil
+}
+
+func (m *ClientManager) handleBindStatus(payload json.RawMessage) {
+	var status tunnel.BindStatusPayload
+	if err := json.Unmarshal(payload, &status); err != nil {
+		return
+	}
+	if ch, ok := bindReplies.Load(status.ID); ok {
+		select {
+		case ch.(chan tunnel.BindStatusPayload) <- status:
+		default:
+		}
+	}
+}
+
 func (m *ClientManager) AddRange(publicStr, localStr string) error {
 	if strings.Contains(publicStr, "-") {
 		pParts := strings.Split(publicStr, "-")
@@ -378,13 +830,26 @@ func (m *ClientManager) removeTunnelInternal(publicPort int, save bool) {
 	}
 
 	var orphanedDomains []string
+	prunedDomains := make(map[string]ClientDomainEntry)
 	for d, e := range m.Domains {
 		if e.PublicPort == publicPort {
 			orphanedDomains = append(orphanedDomains, d)
+		} else if e.usesPort(publicPort) {
+			var routes []tunnel.RouteRule
+			for _, rule := range e.Routes {
+				if rule.PublicPort != publicPort {
+					routes = append(routes, rule)
+				}
+			}
+			e.Routes = routes
+			prunedDomains[d] = e
 		}
 	}
 
 	delete(m.Tunnels, publicPort)
+	delete(m.Captures, publicPort)
+	delete(m.Balances, publicPort)
+	delete(m.PortConfigs, publicPort)
 	if save {
 		m.saveTunnels()
 	}
@@ -398,6 +863,12 @@ func (m *ClientManager) removeTunnelInternal(publicPort int, save bool) {
 		}
 	}
 
+	for d, e := range prunedDomains {
+		if err := m.AddDomain(d, e); err != nil {
+			log.Printf("Failed to drop routes to port %d from %s: %v", publicPort, d, err)
+		}
+	}
+
 	State.Mu.RLock()
 	debug := State.Debug
 	State.Mu.RUnlock()
@@ -411,13 +882,9 @@ func (m *ClientManager) RemoveTunnel(publicPort int) {
 }
 
 func (m *ClientManager) saveTunnels() {
-	type savedTunnel struct {
-		Public int `json:"public"`
-		Local  int `json:"local"`
-	}
 	var list = []savedTunnel{}
 	for p, l := range m.Tunnels {
-		list = append(list, savedTunnel{Public: p, Local: l})
+		list = append(list, savedTunnel{Public: p, Local: l, Capture: m.Captures[p], Balance: m.Balances[p], Config: m.PortConfigs[p]})
 	}
 
 	file, _ := json.MarshalIndent(list, "", "  ")
@@ -431,10 +898,6 @@ func (m *ClientManager) RestoreTunnels() {
 		return
 	}
 
-	type savedTunnel struct {
-		Public int `json:"public"`
-		Local  int `json:"local"`
-	}
 	var list []savedTunnel
 	if err := json.Unmarshal(data, &list); err != nil {
 		return
@@ -442,8 +905,20 @@ func (m *ClientManager) RestoreTunnels() {
 
 	log.Printf("Restoring %d tunnels...", len(list))
 	for _, t := range list {
+		m.Mu.Lock()
+		if t.Balance != nil {
+			m.Balances[t.Public] = t.Balance
+		}
+		if t.Config != nil {
+			m.PortConfigs[t.Public] = t.Config
+		}
+		m.Mu.Unlock()
 		if err := m.AddTunnel(t.Public, t.Local); err != nil {
 			log.Printf("Failed to restore :%d->:%d : %v", t.Local, t.Public, err)
+			continue
+		}
+		if t.Capture != nil {
+			m.SetCapture(t.Public, *t.Capture)
 		}
 	}
 	m.restoreDomains()
@@ -508,6 +983,14 @@ func (m *ClientManager) readControlLoop() {
 			}
 		case tunnel.MsgTypeInspectData:
 			m.handleInspectData(msg.Payload)
+		case tunnel.MsgTypeCertStatus:
+			m.handleCertStatus(msg.Payload)
+		case tunnel.MsgTypeEdgeStats:
+			m.handleEdgeStats(msg.Payload)
+		case tunnel.MsgTypeAuditLog:
+			m.handleAuditLog(msg.Payload)
+		case tunnel.MsgTypeBindStatus:
+			m.handleBindStatus(msg.Payload)
 		}
 	}
 }
@@ -529,9 +1012,13 @@ func (m *ClientManager) handleStream(stream net.Conn) {
 		return
 	}
 
-	var payload struct {
-		PublicPort int `json:"public_port"`
+	if header.Type == tunnel.MsgTypeInspectStream {
+		m.readInspectStream(bufferedStream)
+		stream.Close()
+		return
 	}
+
+	var payload tunnel.NewConnPayload
 	if err := json.Unmarshal(header.Payload, &payload); err != nil {
 		stream.Close()
 		return
@@ -539,6 +1026,7 @@ func (m *ClientManager) handleStream(stream net.Conn) {
 
 	m.Mu.RLock()
 	localPort, ok := m.Tunnels[payload.PublicPort]
+	captureCfg := m.Captures[payload.PublicPort]
 	m.Mu.RUnlock()
 
 	if !ok {
@@ -547,28 +1035,55 @@ func (m *ClientManager) handleStream(stream net.Conn) {
 		return
 	}
 
+	var capture *connCapture
+	if captureCfg != nil && captureCfg.Enabled {
+		capture = startConnCapture(*captureCfg, payload, localPort)
+	}
+
 	localConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
 	if err != nil {
 		log.Printf("Failed to dial local service on port %d: %v", localPort, err)
+		if capture != nil {
+			capture.fail(err)
+		}
 		stream.Close()
 		return
 	}
 
+	var upstream io.Reader = localConn
+	var downstream io.Reader = bufferedStream
+	if capture != nil {
+		upstream = capture.reader(localConn, false)
+		downstream = capture.reader(bufferedStream, true)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
 	go func() {
+		defer wg.Done()
 		defer stream.Close()
 		defer localConn.Close()
 
-		reader := &tunnel.MonitoredReader{R: localConn, Counter: &tunnel.GlobalStats.BytesUp}
+		reader := &tunnel.MonitoredReader{R: upstream, Counter: &tunnel.GlobalStats.BytesUp}
 		io.Copy(stream, reader)
 	}()
 
 	go func() {
+		defer wg.Done()
 		defer stream.Close()
 		defer localConn.Close()
 
-		reader := &tunnel.MonitoredReader{R: bufferedStream, Counter: &tunnel.GlobalStats.BytesDown}
+		reader := &tunnel.MonitoredReader{R: downstream, Counter: &tunnel.GlobalStats.BytesDown}
 		io.Copy(localConn, reader)
 	}()
+
+	if capture != nil {
+		go func() {
+			wg.Wait()
+			capture.finish()
+		}()
+	}
 }
 
 func mustMarshal(v interface{}) json.RawMessage {
@@ -581,6 +1096,19 @@ var (
 	InspectLogsMu sync.RWMutex
 )
 
+func (m *ClientManager) readInspectStream(r io.Reader) {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg tunnel.ControlMessage
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Type == tunnel.MsgTypeInspectData {
+			m.handleInspectData(msg.Payload)
+		}
+	}
+}
+
 func (c *ClientManager) handleInspectData(payload json.RawMessage) {
 	var data tunnel.InspectPayload
 	if err := json.Unmarshal(payload, &data); err != nil {
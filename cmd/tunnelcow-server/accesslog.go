@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logDir             = "data/logs"
+	defaultLogMaxSize  = 10 << 20
+	defaultLogMaxFiles = 5
+	logFlushInterval   = time.Second
+	logBufferSize      = 64 << 10
+
+	logCombined = "combined"
+	logJSON     = "json"
+
+	// ruleOffline marks TCP connections refused because no client serves
+	// the port.
+	ruleOffline = "offline"
+)
+
+// AccessLogConfig is the "access_log" section of data/server_config.json.
+// Each domain and public port gets its own file under data/logs, rotated to
+// name.log.1, name.log.2... once it reaches MaxSize bytes (default 10 MiB),
+// keeping MaxFiles old files (default 5). Format is "combined" (default) or
+// "json". Records are buffered and reach the file within logFlushInterval.
+type AccessLogConfig struct {
+	Disabled bool   `json:"disabled,omitempty"`
+	Format   string `json:"format,omitempty"`
+	MaxSize  int64  `json:"max_size,omitempty"`
+	MaxFiles int    `json:"max_files,omitempty"`
+}
+
+func (c AccessLogConfig) Validate() error {
+	if c.Format != "" && c.Format != logCombined && c.Format != logJSON {
+		return fmt.Errorf("unknown access log format %q", c.Format)
+	}
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("access log size and file count can't be negative")
+	}
+	return nil
+}
+
+var accessLogCfg AccessLogConfig
+
+// accessEntry is one access log record. Event is "http" for a request, and
+// "open" or "close" for a TCP connection on a public port or passthrough
+// domain. Bytes counts what was sent to the visitor and BytesIn, for TCP,
+// what was received.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ClientIP  string    `json:"client_ip"`
+	Host      string    `json:"host,omitempty"`
+	Port      int       `json:"port,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Proto     string    `json:"proto,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	BytesIn   int64     `json:"bytes_in,omitempty"`
+	Duration  int64     `json:"duration_ms"`
+	User      string    `json:"user,omitempty"`
+	BlockedBy string    `json:"blocked_by,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logUser makes a user name safe for the unquoted user field of the
+// Combined Log Format: spaces, quotes, backslashes and control characters
+// are written as \xHH, so the line still splits into the usual fields.
+func logUser(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '"' || c == '\\' || c == 0x7f {
+			fmt.Fprintf(&b, "\\x%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// combined formats e in Combined Log Format followed by the host, the
+// duration in milliseconds and the blocking rule. TCP records put
+// "OPEN target TCP" or "CLOSE target TCP" where the request line goes.
+func (e *accessEntry) combined() string {
+	request := e.Method + " " + e.Path + " " + e.Proto
+	if e.Event != "http" {
+		target := e.Host
+		if target == "" {
+			target = ":" + strconv.Itoa(e.Port)
+		}
+		request = strings.ToUpper(e.Event) + " " + target + " TCP"
+	}
+	status := "-"
+	if e.Status != 0 {
+		status = strconv.Itoa(e.Status)
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %s %s %s %s %s %d %s\n",
+		e.ClientIP, logUser(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(request), status, bytes,
+		strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)),
+		orDash(e.Host), e.Duration, orDash(e.BlockedBy))
+}
+
+// rotatingFile appends to one log file and rotates it by size. Writes go
+// through a buffer that a timer flushes, so busy domains don't pay a write
+// call per request.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	buf      *bufio.Writer
+	size     int64
+	flushing bool
+}
+
+var accessLogs = struct {
+	mu    sync.Mutex
+	files map[string]*rotatingFile
+}{files: make(map[string]*rotatingFile)}
+
+func accessLogFile(name string) *rotatingFile {
+	accessLogs.mu.Lock()
+	defer accessLogs.mu.Unlock()
+	f, ok := accessLogs.files[name]
+	if !ok {
+		f = &rotatingFile{path: filepath.Join(logDir, name+".log")}
+		accessLogs.files[name] = f
+	}
+	return f
+}
+
+// close flushes and closes the file, so the next write opens it again.
+func (f *rotatingFile) close() {
+	if err := f.buf.Flush(); err != nil {
+		log.Printf("[LOG] Failed to write %s: %v", f.path, err)
+	}
+	f.file.Close()
+	f.file, f.buf = nil, nil
+}
+
+func (f *rotatingFile) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushing = false
+	if f.file != nil && f.buf.Buffered() > 0 {
+		if err := f.buf.Flush(); err != nil {
+			log.Printf("[LOG] Failed to write %s: %v", f.path, err)
+			f.file.Close()
+			f.file, f.buf = nil, nil
+		}
+	}
+}
+
+func (f *rotatingFile) rotate() {
+	f.close()
+	maxFiles := accessLogCfg.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultLogMaxFiles
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	os.Rename(f.path, f.path+".1")
+}
+
+func (f *rotatingFile) write(line []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	maxSize := accessLogCfg.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultLogMaxSize
+	}
+	if f.file != nil && f.size > 0 && f.size+int64(len(line)) > maxSize {
+		f.rotate()
+	}
+	if f.file == nil {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return
+		}
+		file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Printf("[LOG] Failed to open %s: %v", f.path, err)
+			return
+		}
+		f.file = file
+		f.buf = bufio.NewWriterSize(file, logBufferSize)
+		f.size = 0
+		if st, err := file.Stat(); err == nil {
+			f.size = st.Size()
+		}
+	}
+	n, _ := f.buf.Write(line)
+	f.size += int64(n)
+	if !f.flushing {
+		f.flushing = true
+		time.AfterFunc(logFlushInterval, f.flush)
+	}
+}
+
+// writeAccessLog appends e to the log named name ("example.com" or
+// "port-8080").
+func writeAccessLog(name string, e *accessEntry) {
+	if accessLogCfg.Disabled || !validPageDomain(name) {
+		return
+	}
+	var line []byte
+	if accessLogCfg.Format == logJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(e.combined())
+	}
+	accessLogFile(name).write(line)
+}
+
+func portLogName(port int) string {
+	return "port-" + strconv.Itoa(port)
+}
+
+// accessRecord collects what the edge learns about a request on its way
+// through the pipeline.
+type accessRecord struct {
+	user      string
+	blockedBy string
+}
+
+type accessRecordKey struct{}
+
+func accessRecordOf(r *http.Request) *accessRecord {
+	rec, _ := r.Context().Value(accessRecordKey{}).(*accessRecord)
+	return rec
+}
+
+// setAccessUser notes who the request was authenticated as.
+func setAccessUser(r *http.Request, user string) {
+	if rec := accessRecordOf(r); rec != nil {
+		rec.user = user
+	}
+}
+
+// setBlockedBy notes the rule answering the request, or clears it with "".
+func setBlockedBy(r *http.Request, rule string) {
+	if rec := accessRecordOf(r); rec != nil {
+		rec.blockedBy = rule
+	}
+}
+
+// logWriter records the status and size of a response.
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *logWriter) WriteHeader(code int) {
+	if w.status == 0 || w.status < 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack.
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAccessLog serves r through next and logs it to the domain's file.
+func withAccessLog(w http.ResponseWriter, r *http.Request, host string, next http.Handler) {
+	if accessLogCfg.Disabled {
+		next.ServeHTTP(w, r)
+		return
+	}
+	rec := &accessRecord{}
+	lw := &logWriter{ResponseWriter: w}
+	e := &accessEntry{
+		Time:      time.Now(),
+		Event:     "http",
+		ClientIP:  sessionKey(r.RemoteAddr),
+		Host:      host,
+		Method:    r.Method,
+		Path:      r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	next.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec)))
+
+	e.Status = lw.status
+	e.Bytes = lw.bytes
+	e.Duration = time.Since(e.Time).Milliseconds()
+	e.User = rec.user
+	e.BlockedBy = rec.blockedBy
+	writeAccessLog(host, e)
+}
+
+// loggedConn counts the bytes of a TCP connection and writes its close
+// record to the log name.
+type loggedConn struct {
+	net.Conn
+	name   string
+	entry  accessEntry
+	in     atomic.Int64
+	out    atomic.Int64
+	closed sync.Once
+}
+
+func (c *loggedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *loggedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+func (c *loggedConn) Close() error {
+	c.closed.Do(func() {
+		e := c.entry
+		e.Event = "close"
+		e.Time = time.Now()
+		e.Bytes = c.out.Load()
+		e.BytesIn = c.in.Load()
+		e.Duration = e.Time.Sub(c.entry.Time).Milliseconds()
+		writeAccessLog(c.name, &e)
+	})
+	return c.Conn.Close()
+}
+
+// logConnOpen writes the open record of a TCP connection to the log name.
+// A connection refused by rule gets only this record; otherwise the
+// returned conn writes the close record when it is closed.
+func logConnOpen(conn net.Conn, name, host string, port int, rule string) net.Conn {
+	if accessLogCfg.Disabled {
+		return conn
+	}
+	entry := accessEntry{
+		Time:      time.Now(),
+		Event:     "open",
+		ClientIP:  sessionKey(conn.RemoteAddr().String()),
+		Host:      host,
+		Port:      port,
+		BlockedBy: rule,
+	}
+	writeAccessLog(name, &entry)
+	if rule != "" {
+		return conn
+	}
+	return &loggedConn{Conn: conn, name: name, entry: entry}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCombinedEscapesUser(t *testing.T) {
+	e := &accessEntry{
+		Time:     time.Date(2026, 10, 19, 10, 4, 12, 0, time.UTC),
+		Event:    "http",
+		ClientIP: "203.0.113.7",
+		Host:     "app.example.com",
+		Method:   "GET",
+		Path:     "/",
+		Proto:    "HTTP/1.1",
+		Status:   200,
+		User:     `CN=Alice "A" Smith`,
+	}
+	line := e.combined()
+	if want := `203.0.113.7 - CN=Alice\x20\x22A\x22\x20Smith [19/Oct/2026:10:04:12 +0000] "GET / HTTP/1.1" 200 - "-" "-" app.example.com 0 -` + "\n"; line != want {
+		t.Errorf("combined() = %q\nwant %q", line, want)
+	}
+	if fields := strings.Fields(strings.SplitN(line, "[", 2)[0]); len(fields) != 3 {
+		t.Errorf("user split into %d fields before the timestamp", len(fields)-2)
+	}
+}
+
+func TestAccessLogBuffersWrites(t *testing.T) {
+	f := &rotatingFile{path: filepath.Join(t.TempDir(), "app.test.log")}
+	t.Cleanup(func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.file != nil {
+			f.close()
+		}
+	})
+
+	f.write([]byte("one\n"))
+	f.write([]byte("two\n"))
+	if b, _ := os.ReadFile(f.path); len(b) != 0 {
+		t.Fatalf("records written before the flush: %q", b)
+	}
+
+	deadline := time.Now().Add(5 * logFlushInterval)
+	for {
+		b, _ := os.ReadFile(f.path)
+		if string(b) == "one\ntwo\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log holds %q after the flush interval", b)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
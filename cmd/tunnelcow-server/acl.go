@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"sync"
+	"tunnelcow/internal/tunnel"
+)
+
+// maxAccessPrefixCache bounds the parsed entries kept around. Entries of
+// lists that were since edited or removed are dropped when it fills up.
+const maxAccessPrefixCache = 4096
+
+var (
+	accessPrefixCache   = make(map[string]netip.Prefix)
+	accessPrefixCacheMu sync.Mutex
+)
+
+func accessPrefix(entry string) (netip.Prefix, bool) {
+	accessPrefixCacheMu.Lock()
+	defer accessPrefixCacheMu.Unlock()
+
+	if p, ok := accessPrefixCache[entry]; ok {
+		return p, p.IsValid()
+	}
+	p, err := tunnel.ParseAccessEntry(entry)
+	if err != nil {
+		log.Printf("Invalid access entry %q: %v", entry, err)
+	}
+	if len(accessPrefixCache) >= maxAccessPrefixCache {
+		clear(accessPrefixCache)
+	}
+	accessPrefixCache[entry] = p
+	return p, p.IsValid()
+}
+
+func accessMatch(list []string, addr netip.Addr) bool {
+	for _, entry := range list {
+		if p, ok := accessPrefix(entry); ok && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessAllowed applies cfg to a visitor address ("ip" or "ip:port"). A nil
+// config allows everyone; an unparsable address is only let through when no
+// allowlist is set.
+func accessAllowed(cfg *tunnel.AccessConfig, remoteAddr string) bool {
+	if cfg == nil || (len(cfg.Allow) == 0 && len(cfg.Deny) == 0) {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(sessionKey(remoteAddr))
+	if err != nil {
+		return len(cfg.Allow) == 0
+	}
+	addr = addr.Unmap()
+
+	if accessMatch(cfg.Deny, addr) {
+		return false
+	}
+	if len(cfg.Allow) > 0 {
+		return accessMatch(cfg.Allow, addr)
+	}
+	return true
+}
+
+func denyAccess(w http.ResponseWriter, domain, remoteAddr string) {
+	domainCounters(domain).denied.Add(1)
+	if GlobalDebug {
+		log.Printf("[ACL] Rejected %s for %s", remoteAddr, domain)
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
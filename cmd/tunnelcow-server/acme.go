@@ -0,0 +1,780 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// ACMEConfig is the "acme" section of data/server_config.json. Everything is
+// optional; the zero value uses Let's Encrypt production with the "certs"
+// cache directory. Each ACME directory gets its own folder in the cache.
+//
+// EABHMACKey is the base64url key handed out by CAs that require External
+// Account Binding (ZeroSSL, Google). CACertFile adds a PEM root for talking
+// to a private ACME server such as Pebble.
+type ACMEConfig struct {
+	DirectoryURL string `json:"directory_url,omitempty"`
+	Staging      bool   `json:"staging,omitempty"`
+	Email        string `json:"email,omitempty"`
+	EABKeyID     string `json:"eab_key_id,omitempty"`
+	EABHMACKey   string `json:"eab_hmac_key,omitempty"`
+	CACertFile   string `json:"ca_cert_file,omitempty"`
+	CacheDir     string `json:"cache_dir,omitempty"`
+}
+
+func (c ACMEConfig) directory() string {
+	if c.DirectoryURL != "" {
+		return c.DirectoryURL
+	}
+	if c.Staging {
+		return letsEncryptStagingURL
+	}
+	return autocert.DefaultACMEDirectory
+}
+
+// acmeCacheDir is the folder under cacheDir for certificates and the account
+// of one ACME directory, so switching between staging, production or a
+// private CA never serves certificates of the one used before.
+func acmeCacheDir(cacheDir, directory string) string {
+	sum := sha256.Sum256([]byte(directory))
+	name := hex.EncodeToString(sum[:4])
+	if u, err := url.Parse(directory); err == nil && u.Hostname() != "" {
+		name = u.Hostname() + "-" + name
+	}
+	return filepath.Join(cacheDir, name)
+}
+
+// migrateACMECache moves a cache from before the per-directory folders into
+// dir, the first time dir is used. The old files carry no record of their
+// directory, so they are taken to belong to the current one.
+func migrateACMECache(cacheDir, dir string) {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Printf("[CERT] Failed to migrate ACME cache: %v", err)
+			return
+		}
+		if err := os.Rename(filepath.Join(cacheDir, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			log.Printf("[CERT] Failed to migrate %s: %v", e.Name(), err)
+		}
+	}
+}
+
+func newCertManager(cfg ACMEConfig) (*autocert.Manager, error) {
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "certs"
+	}
+	cacheDir, legacyDir := acmeCacheDir(cacheDir, cfg.directory()), cacheDir
+	migrateACMECache(legacyDir, cacheDir)
+
+	client := &acme.Client{
+		DirectoryURL: cfg.directory(),
+		UserAgent:    "tunnelcow/" + Version,
+	}
+
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ACME CA: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACertFile)
+		}
+		client.HTTPClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	m := &autocert.Manager{
+		Cache:  autocert.DirCache(cacheDir),
+		Prompt: autocert.AcceptTOS,
+		Client: client,
+		Email:  cfg.Email,
+		HostPolicy: func(ctx context.Context, host string) error {
+
+			if entry, ok := serverDomains.Get(host); ok && entry.wantsACME() {
+				return nil
+			}
+			return fmt.Errorf("domain %s not configured", host)
+		},
+	}
+
+	if cfg.EABKeyID != "" || cfg.EABHMACKey != "" {
+		if cfg.EABKeyID == "" || cfg.EABHMACKey == "" {
+			return nil, fmt.Errorf("eab_key_id and eab_hmac_key must be set together")
+		}
+		key, err := decodeEABKey(cfg.EABHMACKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid eab_hmac_key: %v", err)
+		}
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: cfg.EABKeyID,
+			Key: key,
+		}
+	}
+
+	log.Printf("ACME directory: %s (cache: %s)", client.DirectoryURL, cacheDir)
+	return m, nil
+}
+
+func decodeEABKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err == nil {
+		return key, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// ACMEService issues, serves, renews and revokes the ACME certificates of
+// mapped domains. Certificates are served from memory, loaded from the cache
+// and ordered explicitly with the ACME client, so nothing keeps renewing a
+// domain once it is unmapped. A revoked domain that stays mapped gets a new
+// certificate on its next handshake. autocert is only used for its cache and
+// for the manager that refuses every other name.
+type ACMEService struct {
+	base  *autocert.Manager
+	cache autocert.Cache
+
+	mu      sync.Mutex
+	certs   map[string]*tls.Certificate
+	pending map[string]*acmeOrder
+	retry   map[string]time.Time
+
+	// storeMu keeps a finished order from writing to the cache after the
+	// domain was forgotten or cleared.
+	storeMu sync.Mutex
+
+	chalMu     sync.Mutex
+	alpnCerts  map[string]*tls.Certificate
+	httpTokens map[string]string
+
+	keyMu      sync.Mutex
+	registered bool
+
+	errMu  sync.Mutex
+	errors map[string]string
+}
+
+// acmeOrder is an issuance in progress, shared by every caller waiting for
+// the domain's certificate.
+type acmeOrder struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// acmeRenewBefore is how long before expiry a served certificate is renewed,
+// the same window autocert uses. A failed order is retried after
+// acmeOrderRetry, or acmeRenewRetry while the current certificate is still
+// valid, so handshakes don't run into the CA's rate limits.
+const (
+	acmeRenewBefore = 30 * 24 * time.Hour
+	acmeOrderRetry  = time.Minute
+	acmeRenewRetry  = 30 * time.Minute
+)
+
+var serverACME *ACMEService
+
+func newACMEService(cfg ACMEConfig) (*ACMEService, error) {
+	m, err := newCertManager(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &ACMEService{
+		base:       m,
+		cache:      m.Cache,
+		certs:      make(map[string]*tls.Certificate),
+		pending:    make(map[string]*acmeOrder),
+		retry:      make(map[string]time.Time),
+		alpnCerts:  make(map[string]*tls.Certificate),
+		httpTokens: make(map[string]string),
+		errors:     make(map[string]string),
+	}, nil
+}
+
+// Manager is the manager for names that aren't mapped domains; its host
+// policy refuses them.
+func (s *ACMEService) Manager() *autocert.Manager {
+	return s.base
+}
+
+// forget drops domain's certificate from memory and abandons any order in
+// progress for it. The next request for the domain starts from the cache.
+func (s *ACMEService) forget(domain string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+	s.mu.Lock()
+	delete(s.certs, domain)
+	delete(s.pending, domain)
+	delete(s.retry, domain)
+	s.mu.Unlock()
+}
+
+const acmeAccountKey = "acme_account+key"
+
+// loadAccountKey reads the ACME account key from the cache, where autocert
+// keeps it, or creates it. s.keyMu must be held.
+func (s *ACMEService) loadAccountKey() error {
+	client := s.base.Client
+	if client.Key != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data, err := s.cache.Get(ctx, acmeAccountKey)
+	if err == autocert.ErrCacheMiss {
+		data, err = s.cache.Get(ctx, "acme_account.key")
+	}
+	if err == autocert.ErrCacheMiss {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := s.cache.Put(ctx, acmeAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return err
+		}
+		client.Key = key
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("invalid account key in cache")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		client.Key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		client.Key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		var key any
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if signer, ok := key.(crypto.Signer); ok {
+			client.Key = signer
+		} else if err == nil {
+			err = fmt.Errorf("unsupported account key type")
+		}
+	}
+	return err
+}
+
+// client returns the ACME client with the account key loaded and the account
+// registered. It runs outside s.mu, so handshakes for domains that already
+// have a certificate never wait on the CA.
+func (s *ACMEService) client(ctx context.Context) (*acme.Client, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	client := s.base.Client
+	if s.registered {
+		return client, nil
+	}
+	if err := s.loadAccountKey(); err != nil {
+		return nil, fmt.Errorf("load account key: %v", err)
+	}
+	var contact []string
+	if s.base.Email != "" {
+		contact = []string{"mailto:" + s.base.Email}
+	}
+	account := &acme.Account{Contact: contact, ExternalAccountBinding: s.base.ExternalAccountBinding}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+	s.registered = true
+	return client, nil
+}
+
+func (s *ACMEService) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domain := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if entry, ok := serverDomains.Get(domain); !ok || !entry.wantsACME() {
+		return s.base.GetCertificate(hello)
+	}
+
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			s.chalMu.Lock()
+			cert := s.alpnCerts[domain]
+			s.chalMu.Unlock()
+			if cert == nil {
+				return nil, fmt.Errorf("no tls-alpn-01 challenge pending for %s", domain)
+			}
+			return cert, nil
+		}
+	}
+
+	ctx := hello.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.certificate(ctx, domain)
+}
+
+// certificate returns the certificate for domain from memory or the cache,
+// ordering one when there is none or it expired, and renewing it in the
+// background when it expires soon.
+func (s *ACMEService) certificate(ctx context.Context, domain string) (*tls.Certificate, error) {
+	s.mu.Lock()
+	cert := s.certs[domain]
+	s.mu.Unlock()
+	if cert == nil {
+		if key, chain, err := s.cached(ctx, domain); err == nil && key != nil {
+			cert = &tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+			for _, c := range chain {
+				cert.Certificate = append(cert.Certificate, c.Raw)
+			}
+			s.mu.Lock()
+			s.certs[domain] = cert
+			s.mu.Unlock()
+		}
+	}
+
+	if cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		if time.Until(cert.Leaf.NotAfter) < acmeRenewBefore {
+			s.mu.Lock()
+			due := time.Now().After(s.retry[domain])
+			s.mu.Unlock()
+			if due {
+				s.order(domain)
+			}
+		}
+		return cert, nil
+	}
+
+	s.mu.Lock()
+	retry := s.retry[domain]
+	s.mu.Unlock()
+	if time.Now().Before(retry) {
+		s.errMu.Lock()
+		msg := s.errors[domain]
+		s.errMu.Unlock()
+		if msg == "" {
+			msg = "certificate order failed"
+		}
+		return nil, errors.New(msg)
+	}
+	call := s.order(domain)
+	select {
+	case <-call.done:
+		return call.cert, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// order starts issuing domain's certificate unless an order is already in
+// progress, and returns it.
+func (s *ACMEService) order(domain string) *acmeOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if call, ok := s.pending[domain]; ok {
+		return call
+	}
+	call := &acmeOrder{done: make(chan struct{})}
+	s.pending[domain] = call
+
+	go func() {
+		defer close(call.done)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		call.cert, call.err = s.issue(ctx, domain)
+		if call.err != nil {
+			log.Printf("[CERT] Order for %s failed: %v", domain, call.err)
+		}
+		s.errMu.Lock()
+		if call.err != nil {
+			s.errors[domain] = call.err.Error()
+		} else {
+			delete(s.errors, domain)
+		}
+		s.errMu.Unlock()
+
+		// forget takes storeMu too, so the order stays current until the
+		// certificate is stored; it leaves pending together with the new
+		// certificate arriving, so no handshake sees neither.
+		s.storeMu.Lock()
+		defer s.storeMu.Unlock()
+		s.mu.Lock()
+		current := s.pending[domain] == call
+		s.mu.Unlock()
+		if !current {
+			return
+		}
+		if call.err == nil {
+			if err := s.put(ctx, domain, call.cert); err != nil {
+				log.Printf("[CERT] Failed to cache certificate for %s: %v", domain, err)
+			}
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.pending, domain)
+		if call.err != nil {
+			delay := acmeOrderRetry
+			if c := s.certs[domain]; c != nil && time.Now().Before(c.Leaf.NotAfter) {
+				delay = acmeRenewRetry
+			}
+			s.retry[domain] = time.Now().Add(delay)
+			return
+		}
+		delete(s.retry, domain)
+		s.certs[domain] = call.cert
+	}()
+	return call
+}
+
+// issue orders a certificate for domain, answering tls-alpn-01 and falling
+// back to http-01 when that fails, like autocert.
+func (s *ACMEService) issue(ctx context.Context, domain string) (*tls.Certificate, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, typ := range []string{"tls-alpn-01", "http-01"} {
+		o, err := s.authorize(ctx, client, domain, typ)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return s.finalize(ctx, client, domain, o)
+	}
+	return nil, lastErr
+}
+
+// authorize places an order for domain and completes its authorizations
+// with challenges of type typ.
+func (s *ACMEService) authorize(ctx context.Context, client *acme.Client, domain, typ string) (*acme.Order, error) {
+	o, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	if o.Status == acme.StatusReady {
+		return o, nil
+	}
+	for _, zurl := range o.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, zurl)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status != acme.StatusPending {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == typ {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("CA offers no %s challenge for %s", typ, domain)
+		}
+		cleanup, err := s.fulfill(client, chal, domain)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+		if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+			return nil, err
+		}
+	}
+	return client.WaitOrder(ctx, o.URI)
+}
+
+// fulfill publishes the response to chal until cleanup is called.
+func (s *ACMEService) fulfill(client *acme.Client, chal *acme.Challenge, domain string) (func(), error) {
+	s.chalMu.Lock()
+	defer s.chalMu.Unlock()
+	switch chal.Type {
+	case "tls-alpn-01":
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
+		if err != nil {
+			return nil, err
+		}
+		s.alpnCerts[domain] = &cert
+		return func() {
+			s.chalMu.Lock()
+			delete(s.alpnCerts, domain)
+			s.chalMu.Unlock()
+		}, nil
+	case "http-01":
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		path := client.HTTP01ChallengePath(chal.Token)
+		s.httpTokens[path] = resp
+		return func() {
+			s.chalMu.Lock()
+			delete(s.httpTokens, path)
+			s.chalMu.Unlock()
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported challenge type %s", chal.Type)
+}
+
+// finalize submits a CSR for a new key and returns the issued certificate.
+func (s *ACMEService) finalize(ctx context.Context, client *acme.Client, domain string, o *acme.Order) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(der) == 0 {
+		return nil, fmt.Errorf("CA returned no certificate")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// put writes cert to the cache in autocert's format, the key followed by
+// the chain.
+func (s *ACMEService) put(ctx context.Context, domain string, cert *tls.Certificate) error {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, b := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	return s.cache.Put(ctx, domain, data)
+}
+
+// HTTPHandler answers HTTP-01 challenges for orders in progress and hands
+// everything else to the autocert handler.
+func (s *ACMEService) HTTPHandler(fallback http.Handler) http.Handler {
+	base := s.base.HTTPHandler(fallback)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.chalMu.Lock()
+		resp, ok := s.httpTokens[r.URL.Path]
+		s.chalMu.Unlock()
+		if ok {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(resp))
+			return
+		}
+		base.ServeHTTP(w, r)
+	})
+}
+
+// Issue obtains (or loads from cache) the certificate browsers would get for
+// domain and reports its state.
+func (s *ACMEService) Issue(domain string) tunnel.CertInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var cert *tls.Certificate
+	err := fmt.Errorf("domain %s not configured", domain)
+	if entry, ok := serverDomains.Get(domain); ok && entry.wantsACME() {
+		cert, err = s.certificate(ctx, strings.ToLower(domain))
+	}
+
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	if err != nil {
+		s.errors[domain] = err.Error()
+		return tunnel.CertInfo{Domain: domain, Source: "acme", Error: err.Error()}
+	}
+	delete(s.errors, domain)
+
+	info := tunnel.CertInfo{Domain: domain, Source: "acme"}
+	fillCertInfo(&info, cert.Leaf)
+	return info
+}
+
+func fillCertInfo(info *tunnel.CertInfo, leaf *x509.Certificate) {
+	if leaf == nil {
+		return
+	}
+	info.Issuer = leaf.Issuer.CommonName
+	info.DNSNames = leaf.DNSNames
+	info.NotBefore = leaf.NotBefore.Unix()
+	info.NotAfter = leaf.NotAfter.Unix()
+}
+
+// cached reads the ECDSA entry for domain from the autocert cache, falling
+// back to the RSA one.
+func (s *ACMEService) cached(ctx context.Context, domain string) (crypto.Signer, []*x509.Certificate, error) {
+	data, err := s.cache.Get(ctx, domain)
+	if err == autocert.ErrCacheMiss {
+		data, err = s.cache.Get(ctx, domain+"+rsa")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key crypto.Signer
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, _ = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, _ = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "CERTIFICATE":
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				chain = append(chain, cert)
+			}
+		}
+	}
+	if len(chain) == 0 {
+		return nil, nil, fmt.Errorf("no certificate in cache entry")
+	}
+	return key, chain, nil
+}
+
+// List reports the ACME certificate state of every mapped domain that
+// terminates TLS on the server.
+func (s *ACMEService) List() []tunnel.CertInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	list := []tunnel.CertInfo{}
+	for _, domain := range serverDomains.Names() {
+		if entry, ok := serverDomains.Get(domain); !ok || !entry.wantsACME() {
+			continue
+		}
+		info := tunnel.CertInfo{Domain: domain, Source: "acme"}
+		if _, chain, err := s.cached(ctx, domain); err == nil {
+			fillCertInfo(&info, chain[0])
+		}
+		s.errMu.Lock()
+		info.Error = s.errors[domain]
+		s.errMu.Unlock()
+		if info.NotAfter == 0 && info.Error == "" {
+			info.Error = "not issued yet"
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
+
+func (s *ACMEService) clear(ctx context.Context, domain string) error {
+	s.forget(domain)
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+	for _, key := range []string{domain, domain + "+rsa"} {
+		if err := s.cache.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Renew discards the cached certificate for domain and issues a new one.
+func (s *ACMEService) Renew(domain string) tunnel.CertInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.clear(ctx, domain); err != nil {
+		return tunnel.CertInfo{Domain: domain, Source: "acme", Error: err.Error()}
+	}
+	log.Printf("[CERT] Renewing certificate for %s", domain)
+	return s.Issue(domain)
+}
+
+// Revoke asks the CA to revoke the cached certificate for domain, signing
+// with the certificate's own key, and removes it from the cache.
+func (s *ACMEService) Revoke(domain string) tunnel.CertInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	fail := func(err error) tunnel.CertInfo {
+		return tunnel.CertInfo{Domain: domain, Source: "acme", Error: err.Error()}
+	}
+
+	key, chain, err := s.cached(ctx, domain)
+	if err != nil {
+		return fail(fmt.Errorf("no cached certificate: %v", err))
+	}
+	if key == nil {
+		return fail(fmt.Errorf("cached certificate has no usable key"))
+	}
+
+	if err := s.base.Client.RevokeCert(ctx, key, chain[0].Raw, acme.CRLReasonUnspecified); err != nil {
+		return fail(fmt.Errorf("revoke failed: %v", err))
+	}
+	if err := s.clear(ctx, domain); err != nil {
+		return fail(err)
+	}
+
+	log.Printf("[CERT] Revoked certificate for %s", domain)
+	return tunnel.CertInfo{Domain: domain, Source: "acme", Removed: true}
+}
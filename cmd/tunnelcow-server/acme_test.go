@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// testCA is a minimal RFC 8555 server. It validates tls-alpn-01 challenges
+// by asking validate for the challenge certificate instead of dialing out.
+type testCA struct {
+	t        *testing.T
+	srv      *httptest.Server
+	key      *ecdsa.PrivateKey
+	cert     *x509.Certificate
+	eabKID   string
+	eabKey   []byte
+	validate func(domain string) (*tls.Certificate, error)
+
+	mu       sync.Mutex
+	nonce    int
+	accounts []testAccount
+	orders   []*testOrder
+	revoked  []*big.Int
+}
+
+type testAccount struct {
+	jwk     json.RawMessage
+	contact []string
+}
+
+type testOrder struct {
+	domain string
+	token  string
+	status string
+	cert   []byte
+}
+
+type jwsRequest struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Alg string          `json:"alg"`
+	KID string          `json:"kid"`
+	JWK json.RawMessage `json:"jwk"`
+	URL string          `json:"url"`
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "TunnelCow Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ca := &testCA{t: t, key: key, cert: cert}
+	ca.srv = httptest.NewTLSServer(http.HandlerFunc(ca.serveHTTP))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+// rootFile writes the CA server's TLS certificate to a file for
+// ACMEConfig.CACertFile.
+func (ca *testCA) rootFile() string {
+	path := filepath.Join(ca.t.TempDir(), "root.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.srv.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+func (ca *testCA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+func (ca *testCA) reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *testCA) problem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": detail})
+}
+
+func decodeSegment(s string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (ca *testCA) orderJSON(id int, o *testOrder) map[string]any {
+	v := map[string]any{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{ca.url(fmt.Sprintf("/authz/%d", id))},
+		"finalize":       ca.url(fmt.Sprintf("/finalize/%d", id)),
+	}
+	if o.cert != nil {
+		v["certificate"] = ca.url(fmt.Sprintf("/cert/%d", id))
+	}
+	return v
+}
+
+func (ca *testCA) authzJSON(id int, o *testOrder) map[string]any {
+	status := "pending"
+	if o.status != "pending" {
+		status = "valid"
+	}
+	return map[string]any{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": o.domain},
+		"challenges": []map[string]string{{
+			"type":   "tls-alpn-01",
+			"url":    ca.url(fmt.Sprintf("/chal/%d", id)),
+			"token":  o.token,
+			"status": status,
+		}},
+	}
+}
+
+func (ca *testCA) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nonce))
+
+	if r.URL.Path == "/dir" {
+		ca.reply(w, 200, map[string]any{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+			"revokeCert": ca.url("/revoke"),
+			"keyChange":  ca.url("/key-change"),
+			"meta":       map[string]any{"externalAccountRequired": ca.eabKID != ""},
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(200)
+		return
+	}
+
+	var req jwsRequest
+	var hdr jwsHeader
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || decodeSegment(req.Protected, &hdr) != nil {
+		ca.problem(w, 400, "bad JWS")
+		return
+	}
+	if hdr.URL != ca.url(r.URL.Path) {
+		ca.problem(w, 400, "url mismatch")
+		return
+	}
+
+	var id int
+	switch {
+	case r.URL.Path == "/account":
+		var p struct {
+			Contact []string   `json:"contact"`
+			EAB     jwsRequest `json:"externalAccountBinding"`
+		}
+		if err := decodeSegment(req.Payload, &p); err != nil {
+			ca.problem(w, 400, err.Error())
+			return
+		}
+		if ca.eabKID != "" {
+			var eab jwsHeader
+			decodeSegment(p.EAB.Protected, &eab)
+			mac := hmac.New(sha256.New, ca.eabKey)
+			mac.Write([]byte(p.EAB.Protected + "." + p.EAB.Payload))
+			sig, _ := base64.RawURLEncoding.DecodeString(p.EAB.Signature)
+			if eab.KID != ca.eabKID || !hmac.Equal(sig, mac.Sum(nil)) {
+				ca.problem(w, 401, "bad external account binding")
+				return
+			}
+		}
+		ca.accounts = append(ca.accounts, testAccount{jwk: hdr.JWK, contact: p.Contact})
+		w.Header().Set("Location", ca.url(fmt.Sprintf("/account/%d", len(ca.accounts)-1)))
+		ca.reply(w, 201, map[string]any{"status": "valid", "contact": p.Contact})
+
+	case r.URL.Path == "/order":
+		var p struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		if err := decodeSegment(req.Payload, &p); err != nil || len(p.Identifiers) != 1 {
+			ca.problem(w, 400, "bad order")
+			return
+		}
+		o := &testOrder{domain: p.Identifiers[0].Value, token: fmt.Sprintf("token-%d", len(ca.orders)), status: "pending"}
+		ca.orders = append(ca.orders, o)
+		id = len(ca.orders) - 1
+		w.Header().Set("Location", ca.url(fmt.Sprintf("/order/%d", id)))
+		ca.reply(w, 201, ca.orderJSON(id, o))
+
+	case scanPath(r.URL.Path, "/order/%d", &id) && ca.known(id):
+		ca.reply(w, 200, ca.orderJSON(id, ca.orders[id]))
+
+	case scanPath(r.URL.Path, "/authz/%d", &id) && ca.known(id):
+		ca.reply(w, 200, ca.authzJSON(id, ca.orders[id]))
+
+	case scanPath(r.URL.Path, "/chal/%d", &id) && ca.known(id):
+		o := ca.orders[id]
+		if err := ca.checkChallenge(o, hdr.KID); err != nil {
+			ca.problem(w, 403, err.Error())
+			return
+		}
+		o.status = "ready"
+		ca.reply(w, 200, ca.authzJSON(id, o)["challenges"].([]map[string]string)[0])
+
+	case scanPath(r.URL.Path, "/finalize/%d", &id) && ca.known(id):
+		var p struct {
+			CSR string `json:"csr"`
+		}
+		decodeSegment(req.Payload, &p)
+		der, _ := base64.RawURLEncoding.DecodeString(p.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || ca.orders[id].status != "ready" {
+			ca.problem(w, 403, "order not ready")
+			return
+		}
+		ca.orders[id].cert = ca.issue(csr)
+		ca.orders[id].status = "valid"
+		w.Header().Set("Location", ca.url(fmt.Sprintf("/order/%d", id)))
+		ca.reply(w, 200, ca.orderJSON(id, ca.orders[id]))
+
+	case scanPath(r.URL.Path, "/cert/%d", &id) && ca.known(id):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.orders[id].cert)
+
+	case r.URL.Path == "/revoke":
+		var p struct {
+			Certificate string `json:"certificate"`
+		}
+		decodeSegment(req.Payload, &p)
+		der, _ := base64.RawURLEncoding.DecodeString(p.Certificate)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			ca.problem(w, 400, "bad certificate")
+			return
+		}
+		ca.revoked = append(ca.revoked, cert.SerialNumber)
+		w.WriteHeader(200)
+
+	default:
+		ca.problem(w, 404, "not found")
+	}
+}
+
+// state reports the registered accounts and the number of orders placed.
+func (ca *testCA) state() ([]testAccount, int) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return append([]testAccount(nil), ca.accounts...), len(ca.orders)
+}
+
+func scanPath(path, format string, id *int) bool {
+	n, err := fmt.Sscanf(path, format, id)
+	return err == nil && n == 1
+}
+
+func (ca *testCA) known(id int) bool {
+	return id >= 0 && id < len(ca.orders)
+}
+
+var acmeValidationOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// checkChallenge fetches the tls-alpn-01 certificate for the order's domain
+// and checks it carries the key authorization of the account kid names.
+func (ca *testCA) checkChallenge(o *testOrder, kid string) error {
+	var account int
+	if !scanPath(strings.TrimPrefix(kid, ca.srv.URL), "/account/%d", &account) || account >= len(ca.accounts) {
+		return fmt.Errorf("unknown account %q", kid)
+	}
+	var jwk struct{ X, Y string }
+	json.Unmarshal(ca.accounts[account].jwk, &jwk)
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	thumb, err := acme.JWKThumbprint(pub)
+	if err != nil {
+		return err
+	}
+	want := sha256.Sum256([]byte(o.token + "." + thumb))
+
+	cert, err := ca.validate(o.domain)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	for _, ext := range leaf.Extensions {
+		var got []byte
+		if ext.Id.Equal(acmeValidationOID) {
+			if _, err := asn1.Unmarshal(ext.Value, &got); err == nil && bytes.Equal(got, want[:]) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("challenge certificate lacks the key authorization")
+}
+
+func (ca *testCA) issue(csr *x509.CertificateRequest) []byte {
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Errorf("issue: %v", err)
+		return nil
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+}
+
+// useTestDomains swaps serverDomains for one holding entries.
+func useTestDomains(t *testing.T, entries map[string]DomainEntry) {
+	old := serverDomains
+	serverDomains = &DomainManager{File: filepath.Join(t.TempDir(), "domains.json"), Domains: entries}
+	t.Cleanup(func() { serverDomains = old })
+}
+
+// newTestACME returns a service issuing from ca, with ca validating
+// challenges through it.
+func newTestACME(t *testing.T, ca *testCA, cfg ACMEConfig) *ACMEService {
+	cfg.DirectoryURL = ca.url("/dir")
+	cfg.CACertFile = ca.rootFile()
+	cfg.CacheDir = t.TempDir()
+	svc, err := newACMEService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.validate = func(domain string) (*tls.Certificate, error) {
+		return svc.GetCertificate(&tls.ClientHelloInfo{ServerName: domain, SupportedProtos: []string{acme.ALPNProto}})
+	}
+	return svc
+}
+
+func TestACMEConfigDirectory(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  ACMEConfig
+		want string
+	}{
+		{ACMEConfig{}, acme.LetsEncryptURL},
+		{ACMEConfig{Staging: true}, letsEncryptStagingURL},
+		{ACMEConfig{DirectoryURL: "https://ca.example/dir", Staging: true}, "https://ca.example/dir"},
+	} {
+		if got := tc.cfg.directory(); got != tc.want {
+			t.Errorf("%+v: directory %q, want %q", tc.cfg, got, tc.want)
+		}
+	}
+}
+
+func TestACMECachePerDirectory(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "app.test"), []byte("old cert"), 0600)
+	os.WriteFile(filepath.Join(root, "acme_account+key"), []byte("old key"), 0600)
+
+	staging, err := newCertManager(ACMEConfig{Staging: true, CacheDir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	production, err := newCertManager(ACMEConfig{CacheDir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagingDir, productionDir := string(staging.Cache.(autocert.DirCache)), string(production.Cache.(autocert.DirCache))
+	if stagingDir == productionDir || filepath.Dir(stagingDir) != root || filepath.Dir(productionDir) != root {
+		t.Fatalf("staging cache %s, production cache %s", stagingDir, productionDir)
+	}
+
+	// The cache from before the folders went to the first directory used,
+	// and production starts without it.
+	if b, _ := os.ReadFile(filepath.Join(stagingDir, "app.test")); string(b) != "old cert" {
+		t.Errorf("legacy certificate not moved to %s", stagingDir)
+	}
+	if _, err := production.Cache.Get(context.Background(), "app.test"); err != autocert.ErrCacheMiss {
+		t.Errorf("production cache has the staging certificate: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "app.test")); !os.IsNotExist(err) {
+		t.Error("legacy certificate left in the cache root")
+	}
+}
+
+func TestDecodeEABKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef\xff")
+	for _, s := range []string{
+		base64.RawURLEncoding.EncodeToString(key),
+		base64.URLEncoding.EncodeToString(key),
+		base64.StdEncoding.EncodeToString(key),
+		" " + base64.RawURLEncoding.EncodeToString(key) + "\n",
+	} {
+		got, err := decodeEABKey(s)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("decodeEABKey(%q) = %x, %v", s, got, err)
+		}
+	}
+	if _, err := decodeEABKey("not base64!"); err == nil {
+		t.Error("decodeEABKey accepted invalid input")
+	}
+}
+
+func TestNewCertManagerRejectsBadConfig(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "root.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0644)
+
+	for name, cfg := range map[string]ACMEConfig{
+		"eab key id only":  {EABKeyID: "kid"},
+		"eab hmac only":    {EABHMACKey: "a2V5"},
+		"eab invalid hmac": {EABKeyID: "kid", EABHMACKey: "not base64!"},
+		"missing ca file":  {CACertFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"ca file not pem":  {CACertFile: notPEM},
+	} {
+		if _, err := newCertManager(cfg); err == nil {
+			t.Errorf("%s: newCertManager succeeded", name)
+		}
+	}
+}
+
+func TestACMEIssueFromTestCA(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{
+		"app.test":   {PublicPort: 8080, Mode: "auto"},
+		"plain.test": {PublicPort: 8081, Mode: "http"},
+	})
+	ca := newTestCA(t)
+	ca.eabKID = "kid-1"
+	ca.eabKey = []byte("test-hmac-key")
+	svc := newTestACME(t, ca, ACMEConfig{
+		Email:      "ops@app.test",
+		EABKeyID:   "kid-1",
+		EABHMACKey: base64.RawURLEncoding.EncodeToString(ca.eabKey),
+	})
+
+	info := svc.Issue("app.test")
+	if info.Error != "" {
+		t.Fatalf("Issue: %s", info.Error)
+	}
+	if info.Issuer != "TunnelCow Test CA" || len(info.DNSNames) != 1 || info.DNSNames[0] != "app.test" {
+		t.Errorf("Issue = %+v", info)
+	}
+	if accounts, _ := ca.state(); len(accounts) != 1 || len(accounts[0].contact) != 1 || accounts[0].contact[0] != "mailto:ops@app.test" {
+		t.Errorf("accounts = %+v", accounts)
+	}
+
+	if _, err := os.Stat(filepath.Join(string(svc.cache.(autocert.DirCache)), "app.test")); err != nil {
+		t.Errorf("certificate not cached: %v", err)
+	}
+	list := svc.List()
+	if len(list) != 1 || list[0].Domain != "app.test" || list[0].Error != "" || list[0].NotAfter == 0 {
+		t.Errorf("List = %+v", list)
+	}
+
+	for _, domain := range []string{"plain.test", "unmapped.test"} {
+		if info := svc.Issue(domain); info.Error == "" {
+			t.Errorf("Issue(%s) succeeded", domain)
+		}
+	}
+	if _, orders := ca.state(); orders != 1 {
+		t.Errorf("%d orders placed, want 1", orders)
+	}
+}
+
+func TestACMEIssueRequiresEAB(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{"app.test": {PublicPort: 8080, Mode: "auto"}})
+	ca := newTestCA(t)
+	ca.eabKID = "kid-1"
+	ca.eabKey = []byte("test-hmac-key")
+	svc := newTestACME(t, ca, ACMEConfig{
+		EABKeyID:   "kid-1",
+		EABHMACKey: base64.RawURLEncoding.EncodeToString([]byte("wrong-key")),
+	})
+
+	if info := svc.Issue("app.test"); info.Error == "" {
+		t.Fatal("Issue succeeded with the wrong EAB key")
+	}
+	if accounts, _ := ca.state(); len(accounts) != 0 {
+		t.Errorf("account registered with the wrong EAB key")
+	}
+}
+
+func serialOf(t *testing.T, svc *ACMEService, domain string) *big.Int {
+	t.Helper()
+	cert, err := svc.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:       domain,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("GetCertificate(%s): %v", domain, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber
+}
+
+func TestACMERenewAndRevokeOneDomain(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{
+		"app.test":   {PublicPort: 8080, Mode: "auto"},
+		"other.test": {PublicPort: 8081, Mode: "auto"},
+	})
+	ca := newTestCA(t)
+	svc := newTestACME(t, ca, ACMEConfig{})
+
+	for _, domain := range []string{"app.test", "other.test"} {
+		if info := svc.Issue(domain); info.Error != "" {
+			t.Fatalf("Issue(%s): %s", domain, info.Error)
+		}
+	}
+	oldSerial := serialOf(t, svc, "app.test")
+	other := serialOf(t, svc, "other.test")
+
+	// With its cache entry gone, other.test can only keep its serial if its
+	// certificate stays in memory.
+	cacheDir := string(svc.cache.(autocert.DirCache))
+	if err := os.Remove(filepath.Join(cacheDir, "other.test")); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := svc.Renew("app.test"); info.Error != "" {
+		t.Fatalf("Renew: %s", info.Error)
+	}
+	if serialOf(t, svc, "app.test").Cmp(oldSerial) == 0 {
+		t.Error("Renew kept serving the old certificate")
+	}
+	if serialOf(t, svc, "other.test").Cmp(other) != 0 {
+		t.Error("Renew of app.test dropped other.test's certificate from memory")
+	}
+
+	serial := serialOf(t, svc, "app.test")
+	if info := svc.Revoke("app.test"); info.Error != "" || !info.Removed {
+		t.Fatalf("Revoke = %+v", info)
+	}
+	ca.mu.Lock()
+	revoked := len(ca.revoked) == 1 && ca.revoked[0].Cmp(serial) == 0
+	ca.mu.Unlock()
+	if !revoked {
+		t.Error("CA did not see the revocation")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "app.test")); !os.IsNotExist(err) {
+		t.Errorf("revoked certificate still cached: %v", err)
+	}
+	if serialOf(t, svc, "other.test").Cmp(other) != 0 {
+		t.Error("Revoke of app.test dropped other.test's certificate from memory")
+	}
+
+	// The domain is still mapped, so its next handshake orders a new one.
+	if serialOf(t, svc, "app.test").Cmp(serial) == 0 {
+		t.Error("revoked certificate served after the revocation")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "app.test")); err != nil {
+		t.Errorf("new certificate not cached: %v", err)
+	}
+}
+
+func TestACMEWaitsAfterFailedOrder(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{"app.test": {PublicPort: 8080, Mode: "auto"}})
+	ca := newTestCA(t)
+	svc := newTestACME(t, ca, ACMEConfig{})
+	ca.validate = func(domain string) (*tls.Certificate, error) {
+		return nil, fmt.Errorf("connection refused")
+	}
+
+	first := svc.Issue("app.test")
+	if first.Error == "" {
+		t.Fatal("Issue succeeded without a valid challenge")
+	}
+	_, orders := ca.state()
+	if again := svc.Issue("app.test"); again.Error != first.Error {
+		t.Errorf("retry error %q, want the last one %q", again.Error, first.Error)
+	}
+	if _, err := svc.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.test"}); err == nil {
+		t.Error("handshake got a certificate")
+	}
+	if _, n := ca.state(); n != orders {
+		t.Errorf("%d orders placed after the failure, want %d", n, orders)
+	}
+}
+
+func TestACMERenewsExpiringCertificate(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{"app.test": {PublicPort: 8080, Mode: "auto"}})
+	ca := newTestCA(t)
+	svc := newTestACME(t, ca, ACMEConfig{})
+
+	// A cached certificate with a week left.
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		DNSNames:     []string{"app.test"},
+		NotBefore:    time.Now().Add(-80 * 24 * time.Hour),
+		NotAfter:     time.Now().Add(7 * 24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := svc.cache.Put(context.Background(), "app.test", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if serialOf(t, svc, "app.test").Int64() != 42 {
+		t.Fatal("cached certificate not served while it is still valid")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for serialOf(t, svc, "app.test").Int64() == 42 {
+		if time.Now().After(deadline) {
+			t.Fatal("expiring certificate was not renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, orders := ca.state(); orders != 1 {
+		t.Errorf("%d orders placed, want 1", orders)
+	}
+
+	// Once revoked and unmapped, nothing orders or caches it again.
+	if info := svc.Revoke("app.test"); info.Error != "" {
+		t.Fatalf("Revoke = %+v", info)
+	}
+	useTestDomains(t, map[string]DomainEntry{})
+	svc.forget("app.test")
+	if _, err := svc.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.test"}); err == nil {
+		t.Error("certificate served for an unmapped domain")
+	}
+	if _, err := svc.cache.Get(context.Background(), "app.test"); err != autocert.ErrCacheMiss {
+		t.Errorf("revoked certificate back in the cache: %v", err)
+	}
+	if _, orders := ca.state(); orders != 1 {
+		t.Errorf("%d orders placed after revoking, want 1", orders)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"tunnelcow/internal/tunnel"
+)
+
+var serverAudit = &tunnel.AuditLog{Path: "data/audit.log"}
+
+func recordAudit(e tunnel.AuditEntry) {
+	if err := serverAudit.Record(e); err != nil {
+		log.Printf("[AUDIT] Failed to record %s: %v", e.Action, err)
+	}
+}
+
+// auditActor names the client at addr in the audit log. All clients share
+// one token, so its IP address is the identity that, unlike a session ID,
+// survives reconnects.
+func auditActor(addr string) string {
+	return sessionKey(addr)
+}
+
+// audit records an action taken by this session's client. err, if set,
+// says why it was refused.
+func (c *ClientSession) audit(action, target, detail string, err error) {
+	addr := c.Conn.RemoteAddr().String()
+	e := tunnel.AuditEntry{
+		Action: action,
+		Target: target,
+		Actor:  auditActor(addr),
+		Addr:   addr,
+		Detail: detail,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	recordAudit(e)
+}
+
+func (c *ClientSession) handleReqAuditLog(payload json.RawMessage) {
+	var req tunnel.ReqAuditLogPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Invalid REQ_AUDIT_LOG: %v", err)
+		return
+	}
+	reply := tunnel.AuditLogPayload{ID: req.ID}
+	entries, err := serverAudit.Select(req.AuditQuery, c.auditVisible())
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	reply.Entries = entries
+	c.send(tunnel.MsgTypeAuditLog, reply)
+}
+
+// auditVisible selects the entries a client may read: those it made from
+// its address and those about the ports it serves and the domains mapped to
+// them.
+func (c *ClientSession) auditVisible() func(tunnel.AuditEntry) bool {
+	actor := auditActor(c.Conn.RemoteAddr().String())
+	ports := make(map[string]bool)
+	c.Mu.Lock()
+	for port := range c.Listeners {
+		ports[strconv.Itoa(port)] = true
+	}
+	c.Mu.Unlock()
+
+	return func(e tunnel.AuditEntry) bool {
+		if e.Actor == actor || ports[e.Target] {
+			return true
+		}
+		port, ok := serverDomains.GetPort(e.Target)
+		return ok && ports[strconv.Itoa(port)]
+	}
+}
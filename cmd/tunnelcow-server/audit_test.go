@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"tunnelcow/internal/tunnel"
+)
+
+func TestAuditQueryShowsOnlyTheClientsEntries(t *testing.T) {
+	old := serverAudit
+	serverAudit = &tunnel.AuditLog{Path: filepath.Join(t.TempDir(), "audit.log")}
+	t.Cleanup(func() { serverAudit = old })
+	useTestDomains(t, map[string]DomainEntry{
+		"mine.test":   {PublicPort: 8080},
+		"theirs.test": {PublicPort: 9090},
+	})
+
+	client := newTestClient
+	alice := client("192.0.2.1:5000", 8080)
+	bob := client("198.51.100.2:6000", 9090)
+
+	alice.audit("bind", "8080", "", nil)
+	alice.audit("map", "mine.test", "", nil)
+	bob.audit("bind", "9090", "", nil)
+	bob.audit("map", "theirs.test", "", nil)
+	// Another client joining alice's balance pool.
+	client("203.0.113.3:7000").audit("bind", "8080", "balance: round_robin", nil)
+
+	entries, err := serverAudit.Query(tunnel.AuditQuery{})
+	if err != nil || len(entries) != 5 {
+		t.Fatalf("Query: %d entries, %v", len(entries), err)
+	}
+	if entries[4].Actor != "192.0.2.1" || entries[4].Addr != "192.0.2.1:5000" {
+		t.Errorf("recorded actor %q from %q, want the client's address", entries[4].Actor, entries[4].Addr)
+	}
+
+	// Reconnected from another port, alice still sees her own entries.
+	alice = client("192.0.2.1:5001", 8080)
+	visible, err := serverAudit.Select(tunnel.AuditQuery{}, alice.auditVisible())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range visible {
+		got = append(got, e.Action+" "+e.Target+" by "+e.Actor)
+	}
+	want := []string{"bind 8080 by 203.0.113.3", "map mine.test by 192.0.2.1", "bind 8080 by 192.0.2.1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("alice sees %q, want %q", got, want)
+	}
+
+	limited, _ := serverAudit.Select(tunnel.AuditQuery{Limit: 1}, bob.auditVisible())
+	if len(limited) != 1 || limited[0].Target != "theirs.test" {
+		t.Errorf("bob's newest entry: %+v", limited)
+	}
+}
@@ -3,8 +3,18 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"html"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 const loginHTML = `
@@ -237,32 +247,229 @@ const loginHTML = `
 </html>
 `
 
-func generateCookie(domain, user, pass, secret string) *http.Cookie {
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(domain + user + pass))
-	token := hex.EncodeToString(h.Sum(nil))
+const (
+	authCookieTTL = 7 * 24 * time.Hour
+	logoutPath    = "/tunnelcow/logout"
+
+	// dummyHash is compared against when the user doesn't exist.
+	dummyHash = "$2a$10$B2971y9.ovqk3f9YxGbABeXktszzBj5ckylyscfRZ1enQA.bJOGC."
+)
+
+// basicAuthCache remembers recently checked Basic credentials so API clients
+// don't pay for a bcrypt comparison on every request.
+var basicAuthCache = struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}{entries: make(map[string]time.Time)}
 
+func authCookieName(domain string) string {
 	nameHash := sha256.Sum256([]byte(domain))
+	return "tc_auth_" + hex.EncodeToString(nameHash[:])[:8]
+}
+
+// authCookieSig binds a session to the user's current hash, so changing or
+// removing a login invalidates every cookie issued for it.
+func authCookieSig(domain string, user tunnel.DomainUser, payload, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(domain + "|" + payload + "|" + user.Hash))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func findUser(entry DomainEntry, name string) (tunnel.DomainUser, bool) {
+	for _, u := range entry.Users {
+		if u.Name == name && !u.Expired() {
+			return u, true
+		}
+	}
+	return tunnel.DomainUser{}, false
+}
+
+// checkPassword compares against the user's bcrypt hash. Unknown users still
+// cost one comparison so response times don't reveal valid names.
+func checkPassword(entry DomainEntry, name, password string) (tunnel.DomainUser, bool) {
+	u, ok := findUser(entry, name)
+	if !ok {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return u, false
+	}
+	return u, bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) == nil
+}
+
+func generateCookie(r *http.Request, domain string, user tunnel.DomainUser, secret string) *http.Cookie {
+	expires := time.Now().Add(authCookieTTL)
+	if user.Expires != 0 && user.Expires < expires.Unix() {
+		expires = time.Unix(user.Expires, 0)
+	}
+	payload := user.Name + "|" + strconv.FormatInt(expires.Unix(), 10)
+
 	return &http.Cookie{
-		Name:     "tc_auth_" + hex.EncodeToString(nameHash[:])[:8],
-		Value:    token,
+		Name:     authCookieName(domain),
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + authCookieSig(domain, user, payload, secret),
 		Path:     "/",
 		HttpOnly: true,
-		MaxAge:   86400 * 7,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  expires,
 	}
 }
 
-func validateCookie(r *http.Request, domain, user, pass, secret string) bool {
-	nameHash := sha256.Sum256([]byte(domain))
-	cookieName := "tc_auth_" + hex.EncodeToString(nameHash[:])[:8]
-	cookie, err := r.Cookie(cookieName)
+func validateCookie(r *http.Request, domain string, entry DomainEntry, secret string) bool {
+	cookie, err := r.Cookie(authCookieName(domain))
+	if err != nil {
+		return false
+	}
+	encoded, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
 	if err != nil {
 		return false
 	}
+	payload := string(raw)
+	// The expiry follows the last "|", so names may contain one.
+	i := strings.LastIndexByte(payload, '|')
+	if i < 0 {
+		return false
+	}
+	name, expiresStr := payload[:i], payload[i+1:]
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
 
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(domain + user + pass))
-	expectedToken := hex.EncodeToString(h.Sum(nil))
+	user, ok := findUser(entry, name)
+	if !ok || !hmac.Equal([]byte(sig), []byte(authCookieSig(domain, user, payload, secret))) {
+		return false
+	}
+	setAccessUser(r, name)
+	return true
+}
 
-	return hmac.Equal([]byte(cookie.Value), []byte(expectedToken))
+func validateBasicAuth(r *http.Request, entry DomainEntry) bool {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	u, ok := findUser(entry, name)
+	if !ok {
+		checkPassword(entry, name, password)
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(u.Hash + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+
+	basicAuthCache.mu.Lock()
+	until, cached := basicAuthCache.entries[key]
+	basicAuthCache.mu.Unlock()
+	if cached && time.Now().Before(until) {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) != nil {
+		return false
+	}
+	basicAuthCache.mu.Lock()
+	if len(basicAuthCache.entries) >= 1024 {
+		basicAuthCache.entries = make(map[string]time.Time)
+	}
+	basicAuthCache.entries[key] = time.Now().Add(5 * time.Minute)
+	basicAuthCache.mu.Unlock()
+	return true
+}
+
+// requireAuth lets the request through if it carries a valid session or
+// Basic credentials. Otherwise it starts a login - the form, or the OIDC
+// redirect for browsers, a Basic challenge for other clients - and returns
+// false. It also serves the logout and OIDC callback endpoints.
+func requireAuth(w http.ResponseWriter, r *http.Request, domain string, entry DomainEntry, secret string) bool {
+	if r.URL.Path == logoutPath {
+		handleLogout(w, r, domain)
+		return false
+	}
+
+	if entry.OIDC != nil {
+		stripIdentityHeaders(r)
+		if r.URL.Path == oidcCallbackPath {
+			handleOIDCCallback(w, r, domain, entry.OIDC, secret)
+			return false
+		}
+		if id, ok := oidcSession(r, domain, entry.OIDC, secret); ok {
+			setIdentityHeaders(r, id)
+			setAccessUser(r, r.Header.Get("X-Forwarded-User"))
+			return true
+		}
+	}
+
+	if len(entry.Users) > 0 {
+		if validateCookie(r, domain, entry, secret) {
+			return true
+		}
+		if _, _, hasBasic := r.BasicAuth(); hasBasic {
+			if validateBasicAuth(r, entry) {
+				name, _, _ := r.BasicAuth()
+				setAccessUser(r, name)
+				// The credentials are for the edge, not the service behind it.
+				r.Header.Del("Authorization")
+				return true
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", domain))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+	}
+
+	browser := strings.Contains(r.Header.Get("Accept"), "text/html")
+	if entry.OIDC != nil {
+		if browser {
+			startOIDCLogin(w, r, domain, entry.OIDC, secret)
+			return false
+		}
+	} else if browser || r.Method == "POST" {
+		serveLogin(w, r, domain, entry, secret)
+		return false
+	}
+
+	if len(entry.Users) > 0 {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", domain))
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func serveLogin(w http.ResponseWriter, r *http.Request, domain string, entry DomainEntry, secret string) {
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		if user, ok := checkPassword(entry, r.FormValue("username"), r.FormValue("password")); ok {
+			http.SetCookie(w, generateCookie(r, domain, user, secret))
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, loginHTML, html.EscapeString(domain), `<div class="error-msg">Invalid username or password</div>`)
+		return
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, loginHTML, html.EscapeString(domain), "")
+}
+
+// handleLogout drops the domain's session cookies.
+func handleLogout(w http.ResponseWriter, r *http.Request, domain string) {
+	for _, name := range []string{authCookieName(domain), oidcCookieName(domain)} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			MaxAge:   -1,
+		})
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
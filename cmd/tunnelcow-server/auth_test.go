@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"tunnelcow/internal/tunnel"
+)
+
+func TestLoginCookieNameWithPipe(t *testing.T) {
+	user, err := tunnel.NewDomainUser("ops|admin", "secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := DomainEntry{Users: []tunnel.DomainUser{user}}
+
+	r := httptest.NewRequest("GET", "http://app.test/", nil)
+	r.AddCookie(generateCookie(r, "app.test", user, "server-secret"))
+	if !validateCookie(r, "app.test", entry, "server-secret") {
+		t.Error("cookie for a name containing | did not validate")
+	}
+
+	if _, err := tunnel.NewDomainUser("ops\nadmin", "secret", 0); err == nil {
+		t.Error("NewDomainUser accepted a name with a line break")
+	}
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const (
+	defaultCacheSize   = 64 << 20
+	defaultCacheObject = 8 << 20
+	cacheDir           = "data/cache"
+)
+
+// Statuses a response may have to be stored.
+var cacheableStatus = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// cacheObject is one stored response. Objects are never changed once stored;
+// a revalidated response replaces its object with a refreshed copy that
+// takes over the body.
+type cacheObject struct {
+	key  string
+	uri  string
+	path string
+	vary []string
+
+	status int
+	header http.Header
+	body   []byte
+	file   string
+	size   int64
+
+	stored     time.Time
+	age        time.Duration
+	ttl        time.Duration
+	revalidate bool
+	shared     bool
+
+	elem *list.Element
+}
+
+func (o *cacheObject) currentAge() time.Duration {
+	return o.age + time.Since(o.stored)
+}
+
+func (o *cacheObject) fresh() bool {
+	return !o.revalidate && o.currentAge() < o.ttl
+}
+
+// freshFor reports whether o is fresh and meets the request's max-age (no
+// older than it) and min-fresh (fresh for at least that much longer).
+func (o *cacheObject) freshFor(cc cacheControl) bool {
+	if !o.fresh() {
+		return false
+	}
+	age := o.currentAge()
+	if maxAge, ok := cc.seconds("max-age"); ok && age >= maxAge {
+		return false
+	}
+	if minFresh, ok := cc.seconds("min-fresh"); ok && o.ttl-age < minFresh {
+		return false
+	}
+	return true
+}
+
+func (o *cacheObject) open() (io.ReadCloser, error) {
+	if o.file == "" {
+		return io.NopCloser(bytes.NewReader(o.body)), nil
+	}
+	return os.Open(o.file)
+}
+
+type domainCache struct {
+	vary    map[string][]string
+	objects map[string]*cacheObject
+	lru     *list.List
+	size    int64
+}
+
+type edgeCache struct {
+	mu      sync.Mutex
+	domains map[string]*domainCache
+}
+
+var serverCache = &edgeCache{domains: make(map[string]*domainCache)}
+
+// initEdgeCache clears bodies left on disk by a previous run; the index that
+// described them lived in memory.
+func initEdgeCache() {
+	os.RemoveAll(cacheDir)
+}
+
+func cacheLimits(cfg *tunnel.CacheConfig) (size, object int64) {
+	size, object = cfg.MaxSize, cfg.MaxObject
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	if object == 0 {
+		object = min(defaultCacheObject, size)
+	}
+	return size, object
+}
+
+// variantKey names the variant of uri that r selects given the response's
+// Vary header fields.
+func variantKey(uri string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(uri)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (c *edgeCache) get(domain string, r *http.Request) *cacheObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dc, ok := c.domains[domain]
+	if !ok {
+		return nil
+	}
+	uri := r.URL.RequestURI()
+	o, ok := dc.objects[variantKey(uri, dc.vary[uri], r)]
+	if !ok {
+		return nil
+	}
+	dc.lru.MoveToFront(o.elem)
+	return o
+}
+
+// put stores o, replacing any object with the same key, and evicts the
+// least recently used objects while the domain is over its limit.
+func (c *edgeCache) put(domain string, cfg *tunnel.CacheConfig, o *cacheObject) {
+	maxSize, maxObject := cacheLimits(cfg)
+	if o.size > maxObject {
+		c.release(o)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dc, ok := c.domains[domain]
+	if !ok {
+		dc = &domainCache{
+			vary:    make(map[string][]string),
+			objects: make(map[string]*cacheObject),
+			lru:     list.New(),
+		}
+		c.domains[domain] = dc
+	}
+	if old, ok := dc.objects[o.key]; ok {
+		// A refreshed object takes over the body file of the one it
+		// replaces, which readers of old may still open.
+		dc.unlink(old)
+		if old.file != o.file {
+			c.release(old)
+		}
+	}
+	dc.vary[o.uri] = o.vary
+	o.elem = dc.lru.PushFront(o)
+	dc.objects[o.key] = o
+	dc.size += o.size
+
+	for dc.size > maxSize {
+		dc.remove(c, dc.lru.Back().Value.(*cacheObject))
+	}
+	domainCounters(domain).cacheBytes.Store(dc.size)
+}
+
+// drop removes o if it is still stored.
+func (c *edgeCache) drop(domain string, o *cacheObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dc, ok := c.domains[domain]; ok && dc.objects[o.key] == o {
+		dc.remove(c, o)
+		domainCounters(domain).cacheBytes.Store(dc.size)
+	}
+}
+
+// remove drops o from the domain and deletes its body file. Callers hold
+// c.mu.
+func (dc *domainCache) remove(c *edgeCache, o *cacheObject) {
+	dc.unlink(o)
+	c.release(o)
+}
+
+// unlink takes o out of the domain's index. Callers hold c.mu.
+func (dc *domainCache) unlink(o *cacheObject) {
+	dc.lru.Remove(o.elem)
+	delete(dc.objects, o.key)
+	dc.size -= o.size
+}
+
+// release deletes the body file of an object that is no longer indexed.
+// Readers that already opened it keep their handle.
+func (c *edgeCache) release(o *cacheObject) {
+	if o.file != "" {
+		os.Remove(o.file)
+	}
+}
+
+// Purge drops the domain's objects matching path (see
+// tunnel.ReqCachePurgePayload) and returns how many went.
+func (c *edgeCache) Purge(domain, path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dc, ok := c.domains[domain]
+	if !ok {
+		return 0
+	}
+	n := 0
+	prefix, isPrefix := strings.CutSuffix(path, "*")
+	for _, o := range dc.objects {
+		if path == "" || o.path == path || (isPrefix && strings.HasPrefix(o.path, prefix)) {
+			dc.remove(c, o)
+			n++
+		}
+	}
+	if len(dc.objects) == 0 {
+		delete(c.domains, domain)
+	}
+	domainCounters(domain).cacheBytes.Store(dc.size)
+	return n
+}
+
+// cacheControl holds the directives of Cache-Control headers, lowercased.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheability decides whether a response may be stored and for how long it
+// stays fresh. Responses without validators are only kept while fresh.
+func cacheability(status int, h http.Header, cfg *tunnel.CacheConfig) (ttl time.Duration, revalidate, ok bool) {
+	if !slices.Contains(cacheableStatus, status) || len(h.Values("Set-Cookie")) > 0 {
+		return 0, false, false
+	}
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") {
+		return 0, false, false
+	}
+	for _, v := range h.Values("Vary") {
+		if strings.Contains(v, "*") {
+			return 0, false, false
+		}
+	}
+
+	explicit := true
+	if d, found := cc.seconds("s-maxage"); found {
+		ttl = d
+	} else if d, found := cc.seconds("max-age"); found {
+		ttl = d
+	} else if exp := h.Get("Expires"); exp != "" {
+		date := time.Now()
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		if t, err := http.ParseTime(exp); err == nil {
+			ttl = t.Sub(date)
+		}
+	} else if cfg.DefaultTTL > 0 {
+		ttl = time.Duration(cfg.DefaultTTL) * time.Second
+	} else {
+		explicit = false
+	}
+	revalidate = cc.has("no-cache")
+	if !explicit && !revalidate {
+		return 0, false, false
+	}
+	if (revalidate || ttl <= 0) && h.Get("ETag") == "" && h.Get("Last-Modified") == "" {
+		return 0, false, false
+	}
+	return ttl, revalidate, true
+}
+
+// sharedResponse reports whether the upstream marked a response as fit for
+// every visitor, signed in or not.
+func sharedResponse(h http.Header) bool {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	return cc.has("public") || cc.has("s-maxage")
+}
+
+// credentialed reports whether r carries a cookie or an identity the edge
+// established, so a response to it may be meant for this visitor alone.
+func credentialed(r *http.Request, entry DomainEntry) bool {
+	if r.Header.Get("Cookie") != "" {
+		return true
+	}
+	for _, names := range [][]string{identityHeaders, clientCertHeaders} {
+		for _, name := range names {
+			if r.Header.Get(name) != "" {
+				return true
+			}
+		}
+	}
+	if entry.TokenAuth != nil {
+		for _, name := range entry.TokenAuth.ForwardClaims {
+			if r.Header.Get(name) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && !slices.Contains(fields, name) {
+				fields = append(fields, name)
+			}
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// storedHeader is the part of a response header worth keeping.
+func storedHeader(h http.Header) http.Header {
+	out := h.Clone()
+	out.Del("Age")
+	out.Del("X-Cache")
+	return out
+}
+
+func newCacheObject(r *http.Request, status int, h http.Header, cfg *tunnel.CacheConfig) (*cacheObject, bool) {
+	ttl, revalidate, ok := cacheability(status, h, cfg)
+	if !ok {
+		return nil, false
+	}
+	o := &cacheObject{
+		uri:        r.URL.RequestURI(),
+		path:       r.URL.Path,
+		vary:       varyFields(h),
+		status:     status,
+		header:     storedHeader(h),
+		stored:     time.Now(),
+		ttl:        ttl,
+		revalidate: revalidate,
+		shared:     sharedResponse(h),
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		o.age = time.Duration(age) * time.Second
+	}
+	o.key = variantKey(o.uri, o.vary, r)
+	return o, true
+}
+
+// refreshed applies the headers of a 304 to o and returns the new object,
+// or false when the response may no longer be stored.
+func (o *cacheObject) refreshed(r *http.Request, notModified http.Header, cfg *tunnel.CacheConfig) (*cacheObject, bool) {
+	h := o.header.Clone()
+	for name, values := range notModified {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Type", "Transfer-Encoding", "X-Cache":
+			continue
+		}
+		h[name] = values
+	}
+	fresh, ok := newCacheObject(r, o.status, h, cfg)
+	if !ok {
+		return nil, false
+	}
+	fresh.body, fresh.file, fresh.size = o.body, o.file, o.size
+	return fresh, true
+}
+
+// etagMatch reports whether an If-None-Match list names etag, using the weak
+// comparison.
+func etagMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func notModifiedSince(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, h.Get("ETag"))
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// serveFromCache writes o as the response to r. It returns false, before
+// writing anything, if the stored body can't be read.
+func serveFromCache(w http.ResponseWriter, r *http.Request, o *cacheObject, status string) bool {
+	body, err := o.open()
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+
+	h := w.Header()
+	for name, values := range o.header {
+		h[name] = slices.Clone(values)
+	}
+	h.Set("Age", strconv.Itoa(int(o.currentAge().Seconds())))
+	h.Set("X-Cache", status)
+
+	if o.status == http.StatusOK && notModifiedSince(r, o.header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.WriteHeader(o.status)
+	if r.Method != http.MethodHead {
+		io.Copy(w, body)
+	}
+	return true
+}
+
+// cacheRecorder passes an upstream response through while keeping a copy
+// for the cache. Headers are collected privately until the status is known,
+// so a 304 answering the edge's own revalidation never reaches the visitor.
+type cacheRecorder struct {
+	http.ResponseWriter
+	cfg          *tunnel.CacheConfig
+	header       http.Header
+	revalidating bool
+	credentialed bool
+	limit        int64
+
+	wroteHeader bool
+	notModified bool
+	status      int
+	sent        http.Header
+	store       bool
+	buf         bytes.Buffer
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	if rec.wroteHeader && !rec.notModified {
+		return rec.ResponseWriter.Header()
+	}
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		h := rec.ResponseWriter.Header()
+		for name, values := range rec.header {
+			h[name] = values
+		}
+		rec.ResponseWriter.WriteHeader(code)
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = code
+	if rec.revalidating && code == http.StatusNotModified {
+		rec.notModified = true
+		return
+	}
+
+	rec.sent = rec.header.Clone()
+	h := rec.ResponseWriter.Header()
+	for name, values := range rec.header {
+		h[name] = values
+	}
+	if _, _, ok := cacheability(code, rec.header, rec.cfg); !ok || (rec.credentialed && !sharedResponse(rec.header)) {
+		rec.store = false
+	}
+	if n, err := strconv.ParseInt(rec.header.Get("Content-Length"), 10, 64); err == nil && n > rec.limit {
+		rec.store = false
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.notModified {
+		return len(b), nil
+	}
+	if rec.store {
+		if int64(rec.buf.Len()+len(b)) > rec.limit {
+			rec.store = false
+			rec.buf = bytes.Buffer{}
+		} else {
+			rec.buf.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *cacheRecorder) Flush() {
+	if !rec.notModified {
+		http.NewResponseController(rec.ResponseWriter).Flush()
+	}
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// keep stores the recorded response if it is cacheable and arrived whole.
+func (rec *cacheRecorder) keep(host string, r *http.Request) {
+	cfg := rec.cfg
+	if !rec.store || !rec.wroteHeader {
+		return
+	}
+	if n, err := strconv.Atoi(rec.sent.Get("Content-Length")); err == nil && n != rec.buf.Len() {
+		return
+	}
+	o, ok := newCacheObject(r, rec.status, rec.sent, cfg)
+	if !ok {
+		return
+	}
+	o.size = int64(rec.buf.Len())
+	if cfg.Storage == tunnel.CacheDisk {
+		dir := filepath.Join(cacheDir, host)
+		o.file = filepath.Join(dir, randomToken())
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Printf("[CACHE] %v", err)
+			return
+		}
+		if err := os.WriteFile(o.file, rec.buf.Bytes(), 0600); err != nil {
+			log.Printf("[CACHE] %v", err)
+			return
+		}
+	} else {
+		o.body = bytes.Clone(rec.buf.Bytes())
+	}
+	serverCache.put(host, cfg, o)
+}
+
+func clientConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// serveCached answers r from the domain's cache when it holds a fresh copy
+// and otherwise passes it to upstream, revalidating stale copies and
+// keeping cacheable responses. Unsafe methods invalidate the path. Requests
+// with cookies or an edge identity only share responses the upstream marked
+// public or gave an s-maxage; anything else, including responses that would
+// only be kept for the domain's default TTL, is left out of the cache.
+func serveCached(w http.ResponseWriter, r *http.Request, host string, entry DomainEntry, upstream http.Handler) {
+	cfg := entry.Cache
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions, http.MethodTrace:
+		upstream.ServeHTTP(w, r)
+		return
+	default:
+		serverCache.Purge(host, r.URL.Path)
+		upstream.ServeHTTP(w, r)
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if reqCC.has("no-store") || r.Header.Get("Range") != "" || r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		w.Header().Set("X-Cache", "BYPASS")
+		upstream.ServeHTTP(w, r)
+		return
+	}
+
+	counters := domainCounters(host)
+	forceRevalidate := reqCC.has("no-cache") || r.Header.Get("Pragma") == "no-cache"
+
+	private := credentialed(r, entry)
+	o := serverCache.get(host, r)
+	if o != nil && private && !o.shared {
+		o = nil
+	}
+	if o != nil && o.freshFor(reqCC) && !forceRevalidate && serveFromCache(w, r, o, "HIT") {
+		counters.cacheHits.Add(1)
+		return
+	}
+
+	_, limit := cacheLimits(cfg)
+	rec := &cacheRecorder{
+		ResponseWriter: w,
+		cfg:            cfg,
+		header:         make(http.Header),
+		credentialed:   private,
+		limit:          limit,
+		store:          r.Method == http.MethodGet,
+	}
+	rec.header.Set("X-Cache", "MISS")
+	out := r
+	if o != nil && r.Method == http.MethodGet && !clientConditional(r) {
+		etag, lm := o.header.Get("ETag"), o.header.Get("Last-Modified")
+		if etag != "" || lm != "" {
+			out = r.Clone(r.Context())
+			if etag != "" {
+				out.Header.Set("If-None-Match", etag)
+			}
+			if lm != "" {
+				out.Header.Set("If-Modified-Since", lm)
+			}
+			rec.revalidating = true
+		}
+	}
+
+	upstream.ServeHTTP(rec, out)
+
+	if rec.notModified {
+		counters.cacheHits.Add(1)
+		fresh, ok := o.refreshed(r, rec.header, cfg)
+		if ok && private && !fresh.shared {
+			ok = false
+		}
+		if ok {
+			serverCache.put(host, cfg, fresh)
+		} else {
+			fresh = o
+		}
+		if !serveFromCache(w, r, fresh, "REVALIDATED") {
+			serveErrorPage(w, host, tunnel.Page502)
+		}
+		if !ok {
+			serverCache.drop(host, o)
+		}
+		return
+	}
+	counters.cacheMisses.Add(1)
+	rec.keep(host, r)
+}
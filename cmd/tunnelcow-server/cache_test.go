@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"tunnelcow/internal/tunnel"
+)
+
+func TestCacheKeepsCredentialedResponsesPrivate(t *testing.T) {
+	const host = "cache.test"
+	entry := DomainEntry{
+		Cache:     &tunnel.CacheConfig{Enabled: true, DefaultTTL: 60},
+		TokenAuth: &tunnel.TokenAuthConfig{ForwardClaims: map[string]string{"sub": "X-User-Id"}},
+	}
+	t.Cleanup(func() { serverCache.Purge(host, "") })
+
+	var calls int
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public")
+		}
+		who := "anonymous"
+		for _, name := range []string{"Cookie", "X-Forwarded-User", "X-Client-Cert-Subject", "X-User-Id"} {
+			if v := r.Header.Get(name); v != "" {
+				who = v
+			}
+		}
+		w.Write([]byte(who))
+	})
+	get := func(path, header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://"+host+path, nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		serveCached(w, r, host, entry, upstream)
+		return w
+	}
+
+	if w := get("/", "", ""); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first anonymous request: X-Cache %q", w.Header().Get("X-Cache"))
+	}
+	if w := get("/", "", ""); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "anonymous" {
+		t.Fatalf("default_ttl response not kept for anonymous visitors: %q %q", w.Header().Get("X-Cache"), w.Body)
+	}
+
+	for _, h := range []string{"Cookie", "X-Forwarded-User", "X-Client-Cert-Subject", "X-User-Id"} {
+		calls = 0
+		if w := get("/", h, "alice"); w.Body.String() != "alice" || calls != 1 {
+			t.Errorf("%s: got %q after %d upstream calls, want alice's own page", h, w.Body, calls)
+		}
+		if w := get("/", "", ""); w.Body.String() != "anonymous" {
+			t.Errorf("%s: alice's page stored and served to an anonymous visitor", h)
+		}
+	}
+
+	get("/public", "Cookie", "alice")
+	calls = 0
+	if w := get("/public", "X-Forwarded-User", "bob"); w.Header().Get("X-Cache") != "HIT" || calls != 0 {
+		t.Errorf("public response not shared: X-Cache %q, %d upstream calls", w.Header().Get("X-Cache"), calls)
+	}
+}
+
+func TestCacheRefreshKeepsStoredObject(t *testing.T) {
+	const host = "refresh.test"
+	cfg := &tunnel.CacheConfig{Enabled: true}
+	t.Cleanup(func() { serverCache.Purge(host, "") })
+
+	file := filepath.Join(t.TempDir(), "body")
+	if err := os.WriteFile(file, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://refresh.test/a", nil)
+	old := &cacheObject{key: "/a", uri: "/a", path: "/a", file: file, size: 5}
+	serverCache.put(host, cfg, old)
+	if serverCache.get(host, r) != old {
+		t.Fatal("stored object not found")
+	}
+
+	// A revalidated copy takes over the body file while a reader of the old
+	// object is about to open it.
+	fresh := &cacheObject{key: "/a", uri: "/a", path: "/a", file: file, size: 5}
+	serverCache.put(host, cfg, fresh)
+	if old.file != file {
+		t.Errorf("replaced object changed: file %q", old.file)
+	}
+	body, err := old.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if b, _ := io.ReadAll(body); string(b) != "hello" {
+		t.Errorf("old object body %q", b)
+	}
+
+	serverCache.Purge(host, "")
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("body file left after purge: %v", err)
+	}
+}
+
+func TestCacheHonoursRequestMaxAge(t *testing.T) {
+	const host = "maxage.test"
+	entry := DomainEntry{Cache: &tunnel.CacheConfig{Enabled: true}}
+	t.Cleanup(func() { serverCache.Purge(host, "") })
+
+	var calls int
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", "30")
+		w.Write([]byte("page"))
+	})
+	get := func(cc string) string {
+		r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		if cc != "" {
+			r.Header.Set("Cache-Control", cc)
+		}
+		w := httptest.NewRecorder()
+		serveCached(w, r, host, entry, upstream)
+		return w.Header().Get("X-Cache")
+	}
+
+	get("")
+	for _, tc := range []struct {
+		cc, want string
+	}{
+		{"", "HIT"},
+		{"max-age=120", "HIT"},
+		{"max-age=10", "MISS"},
+		{"max-age=0", "MISS"},
+		{"min-fresh=10", "HIT"},
+		{"min-fresh=40", "MISS"},
+	} {
+		calls = 0
+		if got := get(tc.cc); got != tc.want || (got == "MISS") != (calls == 1) {
+			t.Errorf("Cache-Control %q: X-Cache %s after %d upstream calls, want %s", tc.cc, got, calls, tc.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// CertStore holds certificates uploaded by clients or imported with the
+// "cert" CLI. They take precedence over ACME for matching hosts.
+type CertStore struct {
+	Dir string
+	Mu  sync.RWMutex
+
+	certs map[string]*tls.Certificate
+}
+
+var serverCerts *CertStore
+
+func initCertStore() {
+	serverCerts = &CertStore{
+		Dir:   "data/custom_certs",
+		certs: make(map[string]*tls.Certificate),
+	}
+	serverCerts.load()
+}
+
+func certFileName(domain string) string {
+	return strings.Replace(domain, "*", "_wildcard", 1)
+}
+
+func validCertDomain(domain string) bool {
+	if domain == "" || strings.ContainsAny(domain, `/\`) || strings.Contains(domain, "..") {
+		return false
+	}
+	if strings.Contains(domain, "*") && !strings.HasPrefix(domain, "*.") {
+		return false
+	}
+	return strings.Count(domain, "*") <= 1
+}
+
+func (cs *CertStore) load() {
+	entries, err := os.ReadDir(cs.Dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".crt") {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".crt")
+		domain := strings.Replace(base, "_wildcard", "*", 1)
+
+		cert, err := tls.LoadX509KeyPair(filepath.Join(cs.Dir, name), filepath.Join(cs.Dir, base+".key"))
+		if err != nil {
+			log.Printf("Failed to load certificate for %s: %v", domain, err)
+			continue
+		}
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		cs.certs[domain] = &cert
+		logCertExpiry(domain, cert.Leaf)
+	}
+}
+
+func parseKeyPair(domain string, certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	if strings.HasPrefix(domain, "*.") {
+		if err := leaf.VerifyHostname("tunnelcow-check" + domain[1:]); err != nil {
+			return nil, fmt.Errorf("certificate does not cover %s", domain)
+		}
+	} else if err := leaf.VerifyHostname(domain); err != nil {
+		return nil, fmt.Errorf("certificate does not cover %s", domain)
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &cert, nil
+}
+
+func (cs *CertStore) Add(domain string, certPEM, keyPEM []byte) (tunnel.CertInfo, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !validCertDomain(domain) {
+		return tunnel.CertInfo{}, fmt.Errorf("invalid domain %q", domain)
+	}
+	cert, err := parseKeyPair(domain, certPEM, keyPEM)
+	if err != nil {
+		return tunnel.CertInfo{}, err
+	}
+
+	cs.Mu.Lock()
+	defer cs.Mu.Unlock()
+
+	if err := os.MkdirAll(cs.Dir, 0700); err != nil {
+		return tunnel.CertInfo{}, err
+	}
+	base := filepath.Join(cs.Dir, certFileName(domain))
+	if err := os.WriteFile(base+".key", keyPEM, 0600); err != nil {
+		return tunnel.CertInfo{}, err
+	}
+	if err := os.WriteFile(base+".crt", certPEM, 0644); err != nil {
+		return tunnel.CertInfo{}, err
+	}
+
+	cs.certs[domain] = cert
+	logCertExpiry(domain, cert.Leaf)
+	return customCertInfo(domain, cert), nil
+}
+
+func (cs *CertStore) Remove(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !validCertDomain(domain) {
+		return false
+	}
+	cs.Mu.Lock()
+	defer cs.Mu.Unlock()
+
+	if _, ok := cs.certs[domain]; !ok {
+		return false
+	}
+	delete(cs.certs, domain)
+	base := filepath.Join(cs.Dir, certFileName(domain))
+	os.Remove(base + ".crt")
+	os.Remove(base + ".key")
+	return true
+}
+
+// Lookup returns the uploaded certificate for serverName, trying an exact
+// match before a wildcard one level up.
+func (cs *CertStore) Lookup(serverName string) *tls.Certificate {
+	if serverName == "" {
+		return nil
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	cs.Mu.RLock()
+	defer cs.Mu.RUnlock()
+
+	if cert, ok := cs.certs[serverName]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		if cert, ok := cs.certs["*"+serverName[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+func (cs *CertStore) List() []tunnel.CertInfo {
+	cs.Mu.RLock()
+	defer cs.Mu.RUnlock()
+
+	list := []tunnel.CertInfo{}
+	for domain, cert := range cs.certs {
+		list = append(list, customCertInfo(domain, cert))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
+
+func customCertInfo(domain string, cert *tls.Certificate) tunnel.CertInfo {
+	info := tunnel.CertInfo{Domain: domain, Source: "custom"}
+	if leaf := cert.Leaf; leaf != nil {
+		info.Issuer = leaf.Issuer.CommonName
+		info.DNSNames = leaf.DNSNames
+		info.NotBefore = leaf.NotBefore.Unix()
+		info.NotAfter = leaf.NotAfter.Unix()
+	}
+	return info
+}
+
+func logCertExpiry(domain string, leaf *x509.Certificate) {
+	if leaf == nil {
+		return
+	}
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		log.Printf("[CERT] Certificate for %s EXPIRED on %s", domain, leaf.NotAfter.Format("2006-01-02"))
+	case left < certExpiryWarning:
+		log.Printf("[CERT] Certificate for %s expires in %d days (%s)", domain, int(left.Hours()/24), leaf.NotAfter.Format("2006-01-02"))
+	default:
+		if GlobalDebug {
+			log.Printf("[CERT] Loaded certificate for %s (expires %s)", domain, leaf.NotAfter.Format("2006-01-02"))
+		}
+	}
+}
+
+func (cs *CertStore) ExpiryLoop() {
+	for {
+		time.Sleep(24 * time.Hour)
+		cs.Mu.RLock()
+		for domain, cert := range cs.certs {
+			logCertExpiry(domain, cert.Leaf)
+		}
+		cs.Mu.RUnlock()
+	}
+}
+
+// runCertCommand implements "tunnelcow-server cert ...".
+func runCertCommand(args []string) int {
+	initCertStore()
+
+	usage := func() int {
+		fmt.Println("Usage:")
+		fmt.Println("  tunnelcow-server cert list")
+		fmt.Println("  tunnelcow-server cert import <domain> <cert.pem> <key.pem>")
+		fmt.Println("  tunnelcow-server cert remove <domain>")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	switch args[0] {
+	case "list":
+		list := serverCerts.List()
+		if len(list) == 0 {
+			fmt.Println("No custom certificates installed.")
+			return 0
+		}
+		for _, c := range list {
+			fmt.Printf("%-32s expires %s  issuer %q\n", c.Domain, time.Unix(c.NotAfter, 0).Format("2006-01-02"), c.Issuer)
+		}
+	case "import":
+		if len(args) != 4 {
+			return usage()
+		}
+		certPEM, err := os.ReadFile(args[2])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		keyPEM, err := os.ReadFile(args[3])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		info, err := serverCerts.Add(args[1], certPEM, keyPEM)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Imported certificate for %s (expires %s). Restart the server to apply.\n", info.Domain, time.Unix(info.NotAfter, 0).Format("2006-01-02"))
+	case "remove":
+		if len(args) != 2 {
+			return usage()
+		}
+		if !serverCerts.Remove(args[1]) {
+			fmt.Printf("No custom certificate for %s\n", args[1])
+			return 1
+		}
+		fmt.Printf("Removed certificate for %s. Restart the server to apply.\n", args[1])
+	default:
+		return usage()
+	}
+	return 0
+}
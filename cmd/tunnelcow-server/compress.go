@@ -0,0 +1,214 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"tunnelcow/internal/tunnel"
+)
+
+const defaultCompressMinSize = 1024
+
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"application/manifest+json",
+	"image/svg+xml",
+}
+
+// compressorPools holds idle gzip and zlib writers per encoding and level.
+var compressorPools sync.Map
+
+type resetWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+func getCompressor(encoding string, level int, w io.Writer) resetWriteCloser {
+	key := encoding + "/" + strconv.Itoa(level)
+	pool, _ := compressorPools.LoadOrStore(key, &sync.Pool{})
+	if c, ok := pool.(*sync.Pool).Get().(resetWriteCloser); ok {
+		c.Reset(w)
+		return c
+	}
+	if encoding == "gzip" {
+		c, _ := gzip.NewWriterLevel(w, level)
+		return c
+	}
+	c, _ := zlib.NewWriterLevel(w, level)
+	return c
+}
+
+func putCompressor(encoding string, level int, c resetWriteCloser) {
+	if pool, ok := compressorPools.Load(encoding + "/" + strconv.Itoa(level)); ok {
+		pool.(*sync.Pool).Put(c)
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip when both are equally welcome. It returns "" when neither
+// is acceptable.
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	weight := func(enc string) float64 {
+		if w, ok := q[enc]; ok {
+			return w
+		}
+		return q["*"]
+	}
+	gz, df := weight("gzip"), weight("deflate")
+	switch {
+	case gz > 0 && gz >= df:
+		return "gzip"
+	case df > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+func compressibleType(cfg *tunnel.CompressionConfig, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := cfg.Types
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if family, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter decides when the upstream's headers arrive whether the
+// response gets compressed, then encodes the body on the fly. Flushes go
+// through the encoder so streamed responses still arrive promptly.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      *tunnel.CompressionConfig
+	encoding string
+	head     bool
+
+	decided bool
+	enc     resetWriteCloser
+}
+
+func (w *compressWriter) level() int {
+	if w.cfg.Level > 0 {
+		return w.cfg.Level
+	}
+	return flate.DefaultCompression
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided || (code >= 100 && code < 200) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.decided = true
+
+	h := w.Header()
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || !compressibleType(w.cfg, h.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !strings.Contains(strings.ToLower(strings.Join(h.Values("Vary"), ",")), "accept-encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	minSize := w.cfg.MinSize
+	if minSize == 0 {
+		minSize = defaultCompressMinSize
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < minSize {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.encoding == "" || w.head || strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.enc = getCompressor(w.encoding, w.level(), w.ResponseWriter)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes Hijack to http.ResponseController for WebSocket upgrades.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close finishes the encoded stream. It must run once the proxy is done.
+func (w *compressWriter) close() {
+	if w.enc != nil {
+		w.enc.Close()
+		putCompressor(w.encoding, w.level(), w.enc)
+		w.enc = nil
+	}
+}
+
+// withCompression wraps w when the domain compresses responses. The returned
+// func must be called after the response is written.
+func withCompression(w http.ResponseWriter, r *http.Request, cfg *tunnel.CompressionConfig) (http.ResponseWriter, func()) {
+	if cfg == nil || !cfg.Enabled {
+		return w, func() {}
+	}
+	cw := &compressWriter{
+		ResponseWriter: w,
+		cfg:            cfg,
+		encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+		head:           r.Method == http.MethodHead,
+	}
+	return cw, cw.close
+}
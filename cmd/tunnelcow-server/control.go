@@ -2,17 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"tunnelcow/internal/tunnel"
 
 	"github.com/hashicorp/yamux"
 )
 
+var nextSessionID atomic.Uint64
+
+var errNotOwned = errors.New("domain is not mapped to this client")
+
 type ClientSession struct {
+	ID          uint64
 	Conn        net.Conn
 	Session     *yamux.Session
 	Control     net.Conn
@@ -20,22 +30,34 @@ type ClientSession struct {
 	Listeners   map[int]net.Listener
 	Mu          sync.Mutex
 	Debug       bool
+
+	writeMu      sync.Mutex
+	inspectQueue chan tunnel.InspectPayload
+	active       atomic.Int64
 }
 
 func NewClientSession(conn net.Conn, session *yamux.Session, control net.Conn, controlPort int, debug bool) *ClientSession {
 	return &ClientSession{
+		ID:          nextSessionID.Add(1),
 		Conn:        conn,
 		Session:     session,
 		Control:     control,
 		ControlPort: controlPort,
 		Listeners:   make(map[int]net.Listener),
 		Debug:       debug,
+
+		inspectQueue: make(chan tunnel.InspectPayload, 256),
 	}
 }
 
 func (c *ClientSession) HandleControlLoop() {
 	defer c.Cleanup()
 
+	go c.inspectLoop()
+	go c.statsLoop()
+
+	go c.sendCertList()
+
 	decoder := json.NewDecoder(c.Control)
 
 	for {
@@ -58,12 +80,27 @@ func (c *ClientSession) HandleControlLoop() {
 		case tunnel.MsgTypeReqUnbind:
 			c.handleReqUnbind(msg.Payload)
 		case tunnel.MsgTypePing:
-
+			c.writeMu.Lock()
 			_ = json.NewEncoder(c.Control).Encode(msg)
+			c.writeMu.Unlock()
 		case tunnel.MsgTypeReqDomainMap:
 			c.handleReqDomainMap(msg.Payload)
 		case tunnel.MsgTypeReqDomainUnmap:
 			c.handleReqDomainUnmap(msg.Payload)
+		case tunnel.MsgTypeReqDomainPage:
+			c.handleReqDomainPage(msg.Payload)
+		case tunnel.MsgTypeReqCertUpload:
+			c.handleReqCertUpload(msg.Payload)
+		case tunnel.MsgTypeReqCertDelete:
+			c.handleReqCertDelete(msg.Payload)
+		case tunnel.MsgTypeReqCertAction:
+			c.handleReqCertAction(msg.Payload)
+		case tunnel.MsgTypeReqPortConfig:
+			c.handleReqPortConfig(msg.Payload)
+		case tunnel.MsgTypeReqCachePurge:
+			c.handleReqCachePurge(msg.Payload)
+		case tunnel.MsgTypeReqAuditLog:
+			c.handleReqAuditLog(msg.Payload)
 		}
 	}
 }
@@ -75,9 +112,25 @@ func (c *ClientSession) handleReqBind(payload json.RawMessage) {
 		return
 	}
 
+	err := c.bind(req)
+	if req.ID != "" {
+		status := tunnel.BindStatusPayload{ID: req.ID, PublicPort: req.PublicPort}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		c.send(tunnel.MsgTypeBindStatus, status)
+	}
+}
+
+// bind binds req.PublicPort, or updates its balance setting if the session
+// already holds it.
+func (c *ClientSession) bind(req tunnel.ReqBindPayload) error {
+	target := strconv.Itoa(req.PublicPort)
 	if req.PublicPort < 1 || req.PublicPort > 65535 {
 		log.Printf("Invalid port %d", req.PublicPort)
-		return
+		err := fmt.Errorf("invalid port")
+		c.audit("bind", target, "", err)
+		return err
 	}
 
 	c.Mu.Lock()
@@ -85,30 +138,57 @@ func (c *ClientSession) handleReqBind(payload json.RawMessage) {
 
 	if req.PublicPort == c.ControlPort {
 		log.Printf("Security Alert: Client tried to bind Control Port %d. Action Blocked.", req.PublicPort)
-		return
+		err := fmt.Errorf("control port")
+		c.audit("bind", target, "", err)
+		return err
 	}
 
+	if req.Balance != nil && !tunnel.ValidBalancePolicy(req.Balance.Policy) {
+		log.Printf("Unknown balance policy %q for port %d", req.Balance.Policy, req.PublicPort)
+		err := fmt.Errorf("unknown balance policy %q", req.Balance.Policy)
+		c.audit("bind", target, "", err)
+		return err
+	}
+
+	// Binding a port the session already holds updates its balance setting
+	// in place, without a moment where the port has no backend.
 	if _, exists := c.Listeners[req.PublicPort]; exists {
-		if c.Debug {
-			log.Printf("Port %d already bound", req.PublicPort)
+		err := GlobalSessions.Rebalance(req.PublicPort, c, req.Balance)
+		policy := GlobalSessions.Policy(req.PublicPort)
+		if policy == "" {
+			policy = "off"
 		}
-		return
+		c.audit("balance", target, "balance: "+policy, err)
+		if err != nil {
+			log.Printf("Failed to rebalance port %d: %v", req.PublicPort, err)
+		} else if c.Debug {
+			log.Printf("Port %d balance: %s", req.PublicPort, policy)
+		}
+		return err
 	}
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", req.PublicPort))
+	ln, err := GlobalSessions.Join(req.PublicPort, c, req.Balance)
 	if err != nil {
 		log.Printf("Failed to bind port %d: %v", req.PublicPort, err)
-
-		return
+		c.audit("bind", target, "", err)
+		return err
 	}
 
 	c.Listeners[req.PublicPort] = ln
-	GlobalSessions.Register(req.PublicPort, c)
+	policy := GlobalSessions.Policy(req.PublicPort)
+	var detail string
+	if policy != "" {
+		detail = "balance: " + policy
+	}
+	c.audit("bind", target, detail, nil)
 	if c.Debug {
-		log.Printf("Bound public port %d", req.PublicPort)
+		if policy != "" {
+			log.Printf("Bound public port %d (session %d, balance: %s)", req.PublicPort, c.ID, policy)
+		} else {
+			log.Printf("Bound public port %d", req.PublicPort)
+		}
 	}
-
-	go c.acceptPublicConnections(ln, req.PublicPort)
+	return nil
 }
 
 func (c *ClientSession) handleReqUnbind(payload json.RawMessage) {
@@ -121,32 +201,153 @@ func (c *ClientSession) handleReqUnbind(payload json.RawMessage) {
 	c.Mu.Lock()
 	defer c.Mu.Unlock()
 
-	ln, exists := c.Listeners[req.PublicPort]
-	if !exists {
+	if _, exists := c.Listeners[req.PublicPort]; !exists {
 		if c.Debug {
 			log.Printf("Unbind requested for non-existent port %d", req.PublicPort)
 		}
 		return
 	}
 
-	ln.Close()
 	delete(c.Listeners, req.PublicPort)
-	GlobalSessions.Unregister(req.PublicPort)
+	GlobalSessions.Leave(req.PublicPort, c)
+	c.audit("unbind", strconv.Itoa(req.PublicPort), "", nil)
 	if c.Debug {
 		log.Printf("Unbound public port %d", req.PublicPort)
 	}
 }
 
+func (c *ClientSession) handleReqPortConfig(payload json.RawMessage) {
+	var req tunnel.ReqPortConfigPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Invalid REQ_PORT_CONFIG: %v", err)
+		return
+	}
+
+	c.Mu.Lock()
+	_, bound := c.Listeners[req.PublicPort]
+	c.Mu.Unlock()
+	if !bound {
+		if c.Debug {
+			log.Printf("Port config for unbound port %d ignored", req.PublicPort)
+		}
+		return
+	}
+
+	GlobalSessions.SetConfig(req.PublicPort, req.PortConfig)
+	if c.Debug {
+		log.Printf("Updated config for port %d", req.PublicPort)
+	}
+}
+
 func (c *ClientSession) handleReqDomainMap(payload json.RawMessage) {
 	var req tunnel.ReqDomainMapPayload
 	if err := json.Unmarshal(payload, &req); err != nil {
 		log.Printf("Invalid REQ_DOMAIN_MAP: %v", err)
 		return
 	}
-	serverDomains.Add(req.Domain, req.PublicPort, req.Mode, req.AuthUser, req.AuthPass, req.RateLimit, req.SmartShield)
+	entry := DomainEntry{
+		PublicPort:  req.PublicPort,
+		Mode:        req.Mode,
+		AuthUser:    req.AuthUser,
+		AuthPass:    req.AuthPass,
+		RateLimit:   req.RateLimit,
+		SmartShield: req.SmartShield,
+		Maintenance: req.Maintenance,
+		Pipeline:    req.Pipeline,
+		Users:       req.Users,
+		Inspect:     req.Inspect,
+		Routes:      req.Routes,
+		Upstream:    req.Upstream,
+		Access:      req.Access,
+		Limiter:     req.Limiter,
+		Shield:      req.Shield,
+		OIDC:        req.OIDC,
+		TokenAuth:   req.TokenAuth,
+		MTLS:        req.MTLS,
+		Headers:     req.Headers,
+		Compression: req.Compression,
+		Cache:       req.Cache,
+		Limits:      req.Limits,
+	}
+	entry.migrateAuth()
+	if entry.Mode == "passthrough" {
+		entry = passthroughEntry(entry)
+	}
+	serverDomains.Add(req.Domain, entry)
+	// Settings such as routes or the upstream host may change what a URL
+	// returns, so copies made under the old mapping go.
+	serverCache.Purge(req.Domain, "")
+	c.audit("map", req.Domain, fmt.Sprintf("port %d, mode %s", req.PublicPort, req.Mode), nil)
 	if c.Debug {
-		log.Printf("Mapped domain %s -> :%d (Mode: %s)", req.Domain, req.PublicPort, req.Mode)
+		log.Printf("Mapped domain %s -> :%d (Mode: %s, Routes: %d)", req.Domain, req.PublicPort, req.Mode, len(req.Routes))
+	}
+
+	if !entry.wantsACME() {
+		serverACME.forget(req.Domain)
+	} else if serverCerts.Lookup(req.Domain) == nil {
+		go c.issueCert(req.Domain)
+	}
+}
+
+// issueCert requests the domain's certificate right away instead of waiting
+// for the first handshake, and tells the client how it went.
+func (c *ClientSession) issueCert(domain string) {
+	info := serverACME.Issue(domain)
+	if info.Error != "" {
+		log.Printf("[CERT] Issuance for %s failed: %s", domain, info.Error)
+	} else if c.Debug {
+		log.Printf("[CERT] Certificate for %s ready (expires %s)", domain, time.Unix(info.NotAfter, 0).Format("2006-01-02"))
 	}
+	c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: []tunnel.CertInfo{info}})
+}
+
+// sendCertList sends the certificates for this client's domains.
+func (c *ClientSession) sendCertList() {
+	certs := []tunnel.CertInfo{}
+	for _, info := range serverCerts.List() {
+		if c.ownsCertDomain(info.Domain) {
+			certs = append(certs, info)
+		}
+	}
+	for _, info := range serverACME.List() {
+		if serverCerts.Lookup(info.Domain) == nil && c.ownsCertDomain(info.Domain) {
+			certs = append(certs, info)
+		}
+	}
+	c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: certs, Full: true})
+}
+
+// ownsCertDomain reports whether a certificate for domain would only serve
+// domains of this client. A wildcard needs at least one mapped domain under
+// it, and all of them mapped to this client.
+func (c *ClientSession) ownsCertDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	suffix, wildcard := strings.CutPrefix(domain, "*")
+	if !wildcard {
+		return c.ownsDomain(domain)
+	}
+	covered := false
+	for _, name := range serverDomains.Names() {
+		if i := strings.IndexByte(name, '.'); i > 0 && name[i:] == suffix {
+			if !c.ownsDomain(name) {
+				return false
+			}
+			covered = true
+		}
+	}
+	return covered
+}
+
+// ownsDomain reports whether domain points at a port bound by this session.
+func (c *ClientSession) ownsDomain(domain string) bool {
+	port, ok := serverDomains.GetPort(domain)
+	if !ok {
+		return false
+	}
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	_, bound := c.Listeners[port]
+	return bound
 }
 
 func (c *ClientSession) handleReqDomainUnmap(payload json.RawMessage) {
@@ -155,40 +356,192 @@ func (c *ClientSession) handleReqDomainUnmap(payload json.RawMessage) {
 		log.Printf("Invalid REQ_DOMAIN_UNMAP: %v", err)
 		return
 	}
+	// With load balancing the domain stays up while another client still
+	// serves its port.
+	if port, ok := serverDomains.GetPort(req.Domain); ok && GlobalSessions.ServedByOthers(port, c) {
+		c.audit("unmap", req.Domain, "kept: port has other backends", nil)
+		if c.Debug {
+			log.Printf("Kept domain %s: port %d has other backends", req.Domain, port)
+		}
+		return
+	}
 	serverDomains.Remove(req.Domain)
+	serverPages.RemoveDomain(req.Domain)
+	serverCache.Purge(req.Domain, "")
+	serverACME.forget(req.Domain)
+	c.audit("unmap", req.Domain, "", nil)
 	if c.Debug {
 		log.Printf("Unmapped domain %s", req.Domain)
 	}
 }
 
-func (c *ClientSession) acceptPublicConnections(ln net.Listener, publicPort int) {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			return
-		}
+func (c *ClientSession) handleReqDomainPage(payload json.RawMessage) {
+	var req tunnel.ReqDomainPagePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Invalid REQ_DOMAIN_PAGE: %v", err)
+		return
+	}
+	if !c.ownsDomain(req.Domain) {
+		log.Printf("Page upload for %s ignored: %v", req.Domain, errNotOwned)
+		return
+	}
+	if err := serverPages.Set(req.Domain, req.Kind, []byte(req.HTML)); err != nil {
+		log.Printf("Failed to store %s page for %s: %v", req.Kind, req.Domain, err)
+		return
+	}
+	if c.Debug {
+		log.Printf("Updated %s page for %s (%d bytes)", req.Kind, req.Domain, len(req.HTML))
+	}
+}
 
-		go c.proxyConnection(conn, publicPort)
+func (c *ClientSession) handleReqCachePurge(payload json.RawMessage) {
+	var req tunnel.ReqCachePurgePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Invalid REQ_CACHE_PURGE: %v", err)
+		return
+	}
+	if !c.ownsDomain(req.Domain) {
+		log.Printf("Cache purge for foreign domain %s ignored", req.Domain)
+		return
+	}
+	n := serverCache.Purge(req.Domain, req.Path)
+	if c.Debug {
+		log.Printf("Purged %d cached responses of %s%s", n, req.Domain, req.Path)
 	}
 }
 
-func (c *ClientSession) proxyConnection(userConn net.Conn, publicPort int) {
+func (c *ClientSession) handleReqCertUpload(payload json.RawMessage) {
+	var req tunnel.ReqCertUploadPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Invalid REQ_CERT_UPLOAD: %v", err)
+		return
+	}
 
-	stream, err := c.Session.Open()
+	var info tunnel.CertInfo
+	err := errNotOwned
+	if c.ownsCertDomain(req.Domain) {
+		info, err = serverCerts.Add(req.Domain, []byte(req.CertPEM), []byte(req.KeyPEM))
+	}
 	if err != nil {
-		log.Printf("Failed to open stream to client: %v", err)
-		userConn.Close()
+		log.Printf("Rejected certificate for %s: %v", req.Domain, err)
+		info = tunnel.CertInfo{Domain: req.Domain, Source: "custom", Error: err.Error()}
+	} else {
+		log.Printf("Installed certificate for %s", req.Domain)
+	}
+	c.audit("cert.upload", req.Domain, "", err)
+	c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: []tunnel.CertInfo{info}})
+}
+
+func (c *ClientSession) handleReqCertDelete(payload json.RawMessage) {
+	var req tunnel.ReqCertDeletePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Invalid REQ_CERT_DELETE: %v", err)
+		return
+	}
+
+	if !c.ownsCertDomain(req.Domain) {
+		c.audit("cert.delete", req.Domain, "", errNotOwned)
+		c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: []tunnel.CertInfo{{Domain: req.Domain, Source: "custom", Error: errNotOwned.Error()}}})
+		return
+	}
+	if serverCerts.Remove(req.Domain) {
+		log.Printf("Removed certificate for %s", req.Domain)
+	}
+	c.audit("cert.delete", req.Domain, "", nil)
+	info := tunnel.CertInfo{Domain: req.Domain, Source: "custom", Removed: true}
+	c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: []tunnel.CertInfo{info}})
+}
+
+func (c *ClientSession) handleReqCertAction(payload json.RawMessage) {
+	var req tunnel.ReqCertActionPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Invalid REQ_CERT_ACTION: %v", err)
+		return
+	}
+
+	if req.Action == tunnel.CertActionList {
+		go c.sendCertList()
+		return
+	}
+
+	var info tunnel.CertInfo
+	switch {
+	case !c.ownsDomain(req.Domain):
+		info = tunnel.CertInfo{Domain: req.Domain, Source: "acme", Error: errNotOwned.Error()}
+	case req.Action == tunnel.CertActionRenew:
+		go func() {
+			c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: []tunnel.CertInfo{serverACME.Renew(req.Domain)}})
+		}()
 		return
+	case req.Action == tunnel.CertActionRevoke:
+		go func() {
+			c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: []tunnel.CertInfo{serverACME.Revoke(req.Domain)}})
+		}()
+		return
+	default:
+		info = tunnel.CertInfo{Domain: req.Domain, Source: "acme", Error: fmt.Sprintf("unknown action %q", req.Action)}
+	}
+	c.send(tunnel.MsgTypeCertStatus, tunnel.CertStatusPayload{Certs: []tunnel.CertInfo{info}})
+}
+
+// send writes a server-initiated message on the control stream.
+func (c *ClientSession) send(msgType string, payload interface{}) error {
+	msg := tunnel.ControlMessage{
+		Type:    msgType,
+		Payload: mustMarshal(payload),
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err := json.NewEncoder(c.Control).Encode(msg)
+	if err != nil && c.Debug {
+		log.Printf("Failed to send %s: %v", msgType, err)
+	}
+	return err
+}
+
+// openStream opens a NEW_CONN stream to the client for publicPort. The
+// session's active count covers the stream until it is closed.
+func (c *ClientSession) openStream(publicPort int, remoteAddr string) (net.Conn, error) {
+	stream, err := c.Session.Open()
+	if err != nil {
+		return nil, err
 	}
 
 	header := tunnel.ControlMessage{
-		Type:    tunnel.MsgTypeNewConn,
-		Payload: json.RawMessage(fmt.Sprintf(`{"public_port": %d}`, publicPort)),
+		Type: tunnel.MsgTypeNewConn,
+		Payload: mustMarshal(tunnel.NewConnPayload{
+			PublicPort: publicPort,
+			RemoteAddr: remoteAddr,
+		}),
 	}
 
 	if err := json.NewEncoder(stream).Encode(header); err != nil {
-		log.Printf("Failed to send header: %v", err)
 		stream.Close()
+		return nil, fmt.Errorf("send header: %w", err)
+	}
+
+	c.active.Add(1)
+	return &countedConn{Conn: stream, session: c}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	session *ClientSession
+	once    sync.Once
+}
+
+func (cc *countedConn) Close() error {
+	cc.once.Do(func() { cc.session.active.Add(-1) })
+	return cc.Conn.Close()
+}
+
+func (c *ClientSession) proxyConnection(userConn net.Conn, publicPort int) {
+
+	stream, err := c.openStream(publicPort, userConn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("Failed to open stream to client: %v", err)
 		userConn.Close()
 		return
 	}
@@ -210,13 +563,19 @@ func (c *ClientSession) Cleanup() {
 	c.Mu.Lock()
 	defer c.Mu.Unlock()
 
-	for port, ln := range c.Listeners {
-		ln.Close()
-		GlobalSessions.Unregister(port)
+	for port := range c.Listeners {
+		GlobalSessions.Leave(port, c)
+		c.audit("unbind", strconv.Itoa(port), "client disconnected", nil)
 		if c.Debug {
 			log.Printf("Closed listener on port %d", port)
 		}
 	}
 	c.Conn.Close()
 	c.Session.Close()
+	c.audit("disconnect", "", "", nil)
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+// testConn stands in for a client's connection and control stream,
+// keeping what the server sends.
+type testConn struct {
+	net.Conn
+	addr net.Addr
+	out  bytes.Buffer
+}
+
+func (c *testConn) RemoteAddr() net.Addr        { return c.addr }
+func (c *testConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+// newTestClient returns a session from addr bound to ports.
+func newTestClient(addr string, ports ...int) *ClientSession {
+	tcp, _ := net.ResolveTCPAddr("tcp", addr)
+	conn := &testConn{addr: tcp}
+	c := &ClientSession{Conn: conn, Control: conn, Listeners: make(map[int]net.Listener)}
+	for _, p := range ports {
+		c.Listeners[p] = nil
+	}
+	return c
+}
+
+// replies decodes the messages the server sent c.
+func replies(t *testing.T, c *ClientSession) []tunnel.ControlMessage {
+	t.Helper()
+	var msgs []tunnel.ControlMessage
+	dec := json.NewDecoder(&c.Control.(*testConn).out)
+	for dec.More() {
+		var msg tunnel.ControlMessage
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestCertChangesNeedOwnership(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{
+		"a.mine.test":   {PublicPort: 8080},
+		"b.mine.test":   {PublicPort: 8080},
+		"a.shared.test": {PublicPort: 8080},
+		"b.shared.test": {PublicPort: 9090},
+	})
+	old := serverCerts
+	serverCerts = &CertStore{Dir: t.TempDir(), certs: make(map[string]*tls.Certificate)}
+	t.Cleanup(func() { serverCerts = old })
+	oldAudit := serverAudit
+	serverAudit = &tunnel.AuditLog{Path: filepath.Join(t.TempDir(), "audit.log")}
+	t.Cleanup(func() { serverAudit = oldAudit })
+
+	c := newTestClient("192.0.2.1:5000", 8080)
+	for domain, want := range map[string]bool{
+		"a.mine.test":     true,
+		"A.Mine.Test.":    true,
+		"*.mine.test":     true,
+		"b.shared.test":   false,
+		"*.shared.test":   false,
+		"*.nothing.test":  false,
+		"unmapped.test":   false,
+		"*.a.mine.test":   false,
+		"other.mine.test": false,
+	} {
+		if got := c.ownsCertDomain(domain); got != want {
+			t.Errorf("ownsCertDomain(%q) = %v, want %v", domain, got, want)
+		}
+	}
+
+	// A certificate served ahead of ACME for another client's domain.
+	serverCerts.certs["b.shared.test"] = &tls.Certificate{}
+	c.handleReqCertDelete(mustMarshal(tunnel.ReqCertDeletePayload{Domain: "b.shared.test"}))
+	c.handleReqCertUpload(mustMarshal(tunnel.ReqCertUploadPayload{Domain: "*.shared.test", CertPEM: "x", KeyPEM: "y"}))
+	if _, ok := serverCerts.certs["b.shared.test"]; !ok || len(serverCerts.certs) != 1 {
+		t.Errorf("foreign certificates changed: %v", serverCerts.certs)
+	}
+	for _, msg := range replies(t, c) {
+		var status tunnel.CertStatusPayload
+		json.Unmarshal(msg.Payload, &status)
+		if msg.Type != tunnel.MsgTypeCertStatus || len(status.Certs) != 1 || status.Certs[0].Error != errNotOwned.Error() {
+			t.Errorf("reply %s %s, want a %q error", msg.Type, msg.Payload, errNotOwned)
+		}
+	}
+
+	entries, _ := serverAudit.Query(tunnel.AuditQuery{})
+	if len(entries) != 2 || entries[0].Action != "cert.upload" || entries[1].Action != "cert.delete" || entries[0].Error == "" {
+		t.Errorf("audit log: %+v", entries)
+	}
+}
+
+func TestCertListOnlyOwnDomains(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{
+		"a.mine.test":  {PublicPort: 8080, Mode: "auto"},
+		"b.mine.test":  {PublicPort: 8080, Mode: "auto"},
+		"a.other.test": {PublicPort: 9090, Mode: "auto"},
+	})
+	old := serverCerts
+	serverCerts = &CertStore{Dir: t.TempDir(), certs: make(map[string]*tls.Certificate)}
+	t.Cleanup(func() { serverCerts = old })
+	oldACME := serverACME
+	svc, err := newACMEService(ACMEConfig{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverACME = svc
+	t.Cleanup(func() { serverACME = oldACME })
+
+	serverCerts.certs["b.mine.test"] = &tls.Certificate{}
+	serverCerts.certs["*.other.test"] = &tls.Certificate{}
+
+	c := newTestClient("192.0.2.1:5000", 8080)
+	c.sendCertList()
+	msgs := replies(t, c)
+	if len(msgs) != 1 {
+		t.Fatalf("%d replies, want 1", len(msgs))
+	}
+	var status tunnel.CertStatusPayload
+	json.Unmarshal(msgs[0].Payload, &status)
+	var got []string
+	for _, info := range status.Certs {
+		got = append(got, info.Source+":"+info.Domain)
+	}
+	if len(got) != 2 || got[0] != "custom:b.mine.test" || got[1] != "acme:a.mine.test" {
+		t.Errorf("cert list = %v, want only this client's domains", got)
+	}
+}
+
+func TestCertUploadMixedCase(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{"app.example.test": {PublicPort: 8080}})
+	old := serverCerts
+	serverCerts = &CertStore{Dir: t.TempDir(), certs: make(map[string]*tls.Certificate)}
+	t.Cleanup(func() { serverCerts = old })
+	oldAudit := serverAudit
+	serverAudit = &tunnel.AuditLog{Path: filepath.Join(t.TempDir(), "audit.log")}
+	t.Cleanup(func() { serverAudit = oldAudit })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"app.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	c := newTestClient("192.0.2.1:5000", 8080)
+	c.handleReqCertUpload(mustMarshal(tunnel.ReqCertUploadPayload{Domain: "App.Example.Test.", CertPEM: string(certPEM), KeyPEM: string(keyPEM)}))
+	msgs := replies(t, c)
+	var status tunnel.CertStatusPayload
+	if len(msgs) == 1 {
+		json.Unmarshal(msgs[0].Payload, &status)
+	}
+	if len(status.Certs) != 1 || status.Certs[0].Error != "" || status.Certs[0].Domain != "app.example.test" {
+		t.Fatalf("upload reply: %+v", msgs)
+	}
+	if serverCerts.Lookup("app.example.test") == nil {
+		t.Error("uploaded certificate is not served")
+	}
+	if _, err := os.Stat(filepath.Join(serverCerts.Dir, "app.example.test.crt")); err != nil {
+		t.Errorf("certificate not saved under the normalized name: %v", err)
+	}
+
+	if !serverCerts.Remove("APP.example.test") || serverCerts.Lookup("app.example.test") != nil {
+		t.Error("Remove with a mixed-case name kept the certificate")
+	}
+}
+
+func TestBalanceOffRefusedOnSharedPort(t *testing.T) {
+	oldAudit := serverAudit
+	serverAudit = &tunnel.AuditLog{Path: filepath.Join(t.TempDir(), "audit.log")}
+	t.Cleanup(func() { serverAudit = oldAudit })
+
+	a := newTestClient("192.0.2.1:5000", 8080)
+	b := newTestClient("192.0.2.2:5000", 8080)
+	pool := &SessionPool{Port: 8080, Policy: tunnel.BalanceRoundRobin, Members: []*ClientSession{a, b}}
+	GlobalSessions.Mu.Lock()
+	GlobalSessions.Pools[8080] = pool
+	GlobalSessions.Mu.Unlock()
+	t.Cleanup(func() {
+		GlobalSessions.Mu.Lock()
+		delete(GlobalSessions.Pools, 8080)
+		GlobalSessions.Mu.Unlock()
+	})
+
+	a.handleReqBind(mustMarshal(tunnel.ReqBindPayload{PublicPort: 8080, ID: "7"}))
+	msgs := replies(t, a)
+	var status tunnel.BindStatusPayload
+	if len(msgs) == 1 && msgs[0].Type == tunnel.MsgTypeBindStatus {
+		json.Unmarshal(msgs[0].Payload, &status)
+	}
+	if status.ID != "7" || status.Error != errSharedPool.Error() {
+		t.Errorf("reply %+v, want a %q error", msgs, errSharedPool)
+	}
+	if _, ok := a.Listeners[8080]; !ok || len(pool.Members) != 2 || pool.Policy != tunnel.BalanceRoundRobin {
+		t.Errorf("refused change still altered the port: members %d, policy %q", len(pool.Members), pool.Policy)
+	}
+
+	b.handleReqBind(mustMarshal(tunnel.ReqBindPayload{PublicPort: 8080, ID: "8", Balance: &tunnel.BalanceConfig{}}))
+	msgs = replies(t, b)
+	status = tunnel.BindStatusPayload{}
+	if len(msgs) != 1 || json.Unmarshal(msgs[0].Payload, &status) != nil || status.ID != "8" || status.Error != "" {
+		t.Errorf("keeping balancing on: reply %+v", msgs)
+	}
+}
+
+func TestPassthroughMapDropsEdgeSettings(t *testing.T) {
+	useTestDomains(t, map[string]DomainEntry{})
+	oldAudit := serverAudit
+	serverAudit = &tunnel.AuditLog{Path: filepath.Join(t.TempDir(), "audit.log")}
+	t.Cleanup(func() { serverAudit = oldAudit })
+	oldACME := serverACME
+	svc, err := newACMEService(ACMEConfig{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverACME = svc
+	t.Cleanup(func() { serverACME = oldACME })
+
+	access := &tunnel.AccessConfig{Allow: []string{"192.0.2.0/24"}}
+	c := newTestClient("192.0.2.1:5000", 8443)
+	c.handleReqDomainMap(mustMarshal(tunnel.ReqDomainMapPayload{
+		Domain:      "tls.test",
+		PublicPort:  8443,
+		Mode:        "passthrough",
+		RateLimit:   10,
+		SmartShield: true,
+		Maintenance: true,
+		AuthUser:    "admin",
+		AuthPass:    "secret",
+		Inspect:     &tunnel.InspectConfig{Enabled: true},
+		Limiter:     &tunnel.RateLimitConfig{Rate: 5},
+		Shield:      &tunnel.ShieldConfig{Difficulty: 4},
+		Access:      access,
+	}))
+
+	entry, ok := serverDomains.Get("tls.test")
+	if !ok {
+		t.Fatal("passthrough domain not mapped")
+	}
+	if entry.PublicPort != 8443 || entry.Mode != "passthrough" || entry.Access == nil || len(entry.Access.Allow) != 1 ||
+		len(entry.Users) != 0 || entry.AuthUser != "" || entry.RateLimit != 0 || entry.SmartShield ||
+		entry.Maintenance || entry.Inspect != nil || entry.Limiter != nil || entry.Shield != nil {
+		t.Errorf("passthrough entry kept settings the SNI router can't enforce: %+v", entry)
+	}
+}
@@ -2,17 +2,38 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"os"
 	"sync"
+	"tunnelcow/internal/tunnel"
 )
 
 type DomainEntry struct {
 	PublicPort  int    `json:"public_port"`
 	Mode        string `json:"mode"`
-	AuthUser    string `json:"auth_user,omitempty"`
-	AuthPass    string `json:"auth_pass,omitempty"`
 	RateLimit   int    `json:"rate_limit,omitempty"`
 	SmartShield bool   `json:"smart_shield,omitempty"`
+	Maintenance bool   `json:"maintenance,omitempty"`
+
+	// Plaintext login from older versions, only read to migrate it.
+	AuthUser string `json:"auth_user,omitempty"`
+	AuthPass string `json:"auth_pass,omitempty"`
+
+	Pipeline    []string                  `json:"pipeline,omitempty"`
+	Users       []tunnel.DomainUser       `json:"users,omitempty"`
+	Inspect     *tunnel.InspectConfig     `json:"inspect,omitempty"`
+	Routes      []tunnel.RouteRule        `json:"routes,omitempty"`
+	Upstream    *tunnel.UpstreamConfig    `json:"upstream,omitempty"`
+	Access      *tunnel.AccessConfig      `json:"access,omitempty"`
+	Limiter     *tunnel.RateLimitConfig   `json:"limiter,omitempty"`
+	Shield      *tunnel.ShieldConfig      `json:"shield,omitempty"`
+	OIDC        *tunnel.OIDCConfig        `json:"oidc,omitempty"`
+	TokenAuth   *tunnel.TokenAuthConfig   `json:"token_auth,omitempty"`
+	MTLS        *tunnel.MTLSConfig        `json:"mtls,omitempty"`
+	Headers     *tunnel.HeaderConfig      `json:"headers,omitempty"`
+	Compression *tunnel.CompressionConfig `json:"compression,omitempty"`
+	Cache       *tunnel.CacheConfig       `json:"cache,omitempty"`
+	Limits      *tunnel.LimitsConfig      `json:"limits,omitempty"`
 }
 
 type DomainManager struct {
@@ -36,8 +57,22 @@ func initDomainManager() {
 
 func (dm *DomainManager) load() {
 	data, err := os.ReadFile(dm.File)
-	if err == nil {
-		json.Unmarshal(data, &dm.Domains)
+	if err != nil {
+		return
+	}
+	json.Unmarshal(data, &dm.Domains)
+
+	migrated := false
+	for domain, entry := range dm.Domains {
+		if entry.AuthUser != "" {
+			entry.migrateAuth()
+			dm.Domains[domain] = entry
+			migrated = true
+		}
+	}
+	if migrated {
+		log.Printf("Hashed plaintext domain credentials in %s", dm.File)
+		dm.save()
 	}
 }
 
@@ -47,20 +82,13 @@ func (dm *DomainManager) save() {
 	os.WriteFile(dm.File, data, 0644)
 }
 
-func (dm *DomainManager) Add(domain string, port int, mode string, authUser, authPass string, rateLimit int, smartShield bool) {
+func (dm *DomainManager) Add(domain string, entry DomainEntry) {
 	dm.Mu.Lock()
 	defer dm.Mu.Unlock()
-	if mode == "" {
-		mode = "auto"
-	}
-	dm.Domains[domain] = DomainEntry{
-		PublicPort:  port,
-		Mode:        mode,
-		AuthUser:    authUser,
-		AuthPass:    authPass,
-		RateLimit:   rateLimit,
-		SmartShield: smartShield,
+	if entry.Mode == "" {
+		entry.Mode = "auto"
 	}
+	dm.Domains[domain] = entry
 	dm.save()
 }
 
@@ -85,6 +113,40 @@ func (dm *DomainManager) Exists(domain string) bool {
 	return ok
 }
 
+func (dm *DomainManager) Names() []string {
+	dm.Mu.RLock()
+	defer dm.Mu.RUnlock()
+	names := make([]string, 0, len(dm.Domains))
+	for d := range dm.Domains {
+		names = append(names, d)
+	}
+	return names
+}
+
+// migrateAuth replaces a plaintext AuthUser/AuthPass login with a hashed
+// user, unless hashed users are already present.
+func (e *DomainEntry) migrateAuth() {
+	if e.AuthUser != "" && len(e.Users) == 0 {
+		if u, err := tunnel.NewDomainUser(e.AuthUser, e.AuthPass, 0); err == nil {
+			e.Users = []tunnel.DomainUser{u}
+		}
+	}
+	e.AuthUser = ""
+	e.AuthPass = ""
+}
+
+// requiresLogin reports whether visitors must sign in before reaching the
+// upstream.
+func (e DomainEntry) requiresLogin() bool {
+	return len(e.Users) > 0 || e.OIDC != nil
+}
+
+// wantsACME reports whether the server terminates TLS for this domain and
+// therefore needs a certificate.
+func (e DomainEntry) wantsACME() bool {
+	return e.Mode != "http" && e.Mode != "passthrough"
+}
+
 func (dm *DomainManager) GetPort(domain string) (int, bool) {
 	dm.Mu.RLock()
 	defer dm.Mu.RUnlock()
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const edgeStatsInterval = 10 * time.Second
+
+type edgeCounters struct {
+	denied  atomic.Uint64
+	limited atomic.Uint64
+
+	shieldIssued atomic.Uint64
+	shieldSolved atomic.Uint64
+	shieldFailed atomic.Uint64
+
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	cacheBytes  atomic.Int64
+}
+
+func (c *edgeCounters) snapshot() tunnel.EdgeCounters {
+	return tunnel.EdgeCounters{
+		Denied:  c.denied.Load(),
+		Limited: c.limited.Load(),
+
+		ShieldIssued: c.shieldIssued.Load(),
+		ShieldSolved: c.shieldSolved.Load(),
+		ShieldFailed: c.shieldFailed.Load(),
+
+		CacheHits:   c.cacheHits.Load(),
+		CacheMisses: c.cacheMisses.Load(),
+		CacheBytes:  c.cacheBytes.Load(),
+	}
+}
+
+var edgeStats = struct {
+	mu      sync.Mutex
+	domains map[string]*edgeCounters
+	ports   map[int]*edgeCounters
+}{
+	domains: make(map[string]*edgeCounters),
+	ports:   make(map[int]*edgeCounters),
+}
+
+func domainCounters(domain string) *edgeCounters {
+	edgeStats.mu.Lock()
+	defer edgeStats.mu.Unlock()
+	c, ok := edgeStats.domains[domain]
+	if !ok {
+		c = &edgeCounters{}
+		edgeStats.domains[domain] = c
+	}
+	return c
+}
+
+func portCounters(port int) *edgeCounters {
+	edgeStats.mu.Lock()
+	defer edgeStats.mu.Unlock()
+	c, ok := edgeStats.ports[port]
+	if !ok {
+		c = &edgeCounters{}
+		edgeStats.ports[port] = c
+	}
+	return c
+}
+
+// statsLoop periodically sends the counters of the session's ports and of
+// the domains pointing at them.
+func (c *ClientSession) statsLoop() {
+	ticker := time.NewTicker(edgeStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		c.Mu.Lock()
+		ports := make(map[int]bool, len(c.Listeners))
+		for port := range c.Listeners {
+			ports[port] = true
+		}
+		c.Mu.Unlock()
+
+		payload := tunnel.EdgeStatsPayload{
+			Domains: make(map[string]tunnel.EdgeCounters),
+			Ports:   make(map[int]tunnel.EdgeCounters),
+		}
+
+		edgeStats.mu.Lock()
+		for port, counters := range edgeStats.ports {
+			if ports[port] {
+				payload.Ports[port] = counters.snapshot()
+			}
+		}
+		for domain, counters := range edgeStats.domains {
+			if port, ok := serverDomains.GetPort(domain); ok && ports[port] {
+				payload.Domains[domain] = counters.snapshot()
+			}
+		}
+		edgeStats.mu.Unlock()
+
+		if len(payload.Domains) == 0 && len(payload.Ports) == 0 {
+			continue
+		}
+		c.send(tunnel.MsgTypeEdgeStats, payload)
+	}
+}
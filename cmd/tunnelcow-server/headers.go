@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"tunnelcow/internal/tunnel"
+)
+
+// stripCRLF drops line breaks from request-supplied values copied into
+// headers.
+var stripCRLF = strings.NewReplacer("\r", "", "\n", "")
+
+// headerVars expands the placeholders of tunnel.HeaderVars for one request.
+func headerVars(r *http.Request, host, requestID string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{client_ip}", sessionKey(r.RemoteAddr),
+		"{domain}", host,
+		"{request_id}", requestID,
+		"{scheme}", requestScheme(r),
+		"{method}", r.Method,
+		"{path}", stripCRLF.Replace(r.URL.Path),
+	)
+}
+
+func applyHeaderRules(h http.Header, rules []tunnel.HeaderRule, vars *strings.Replacer) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case tunnel.HeaderSet:
+			h.Set(rule.Name, vars.Replace(rule.Value))
+		case tunnel.HeaderAdd:
+			h.Add(rule.Name, vars.Replace(rule.Value))
+		case tunnel.HeaderRemove:
+			h.Del(rule.Name)
+		}
+	}
+}
+
+// usesRequestID reports whether any rule needs {request_id}.
+func usesRequestID(cfg *tunnel.HeaderConfig) bool {
+	for _, rules := range [][]tunnel.HeaderRule{cfg.Request, cfg.Response} {
+		for _, rule := range rules {
+			if strings.Contains(rule.Value, "{request_id}") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// headerWriter applies the response rules just before the headers go out,
+// so they cover upstream responses and the edge's own pages alike.
+type headerWriter struct {
+	http.ResponseWriter
+	rules   []tunnel.HeaderRule
+	vars    *strings.Replacer
+	applied bool
+}
+
+func (w *headerWriter) apply(code int) {
+	// Interim responses other than 101 are followed by the real one.
+	if w.applied || (code >= 100 && code < 200 && code != http.StatusSwitchingProtocols) {
+		return
+	}
+	w.applied = true
+	applyHeaderRules(w.Header(), w.rules, w.vars)
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	w.apply(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	w.apply(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack, which the
+// proxy needs for streaming and WebSocket upgrades.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type headerVarsKey struct{}
+
+// withResponseHeaders wraps the whole pipeline, wherever the headers stage
+// runs, so response rules also cover the pages earlier stages answer with.
+// The placeholders are expanded once per request and shared with the
+// request rules, so both see the same {request_id}.
+func withResponseHeaders(e *edgeRequest, next http.Handler) http.Handler {
+	cfg := e.Entry.Headers
+	if cfg == nil {
+		return next
+	}
+	withID := usesRequestID(cfg)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestID string
+		if withID {
+			requestID = randomToken()
+		}
+		vars := headerVars(r, e.Host, requestID)
+		r = r.WithContext(context.WithValue(r.Context(), headerVarsKey{}, vars))
+		if len(cfg.Response) > 0 {
+			w = &headerWriter{ResponseWriter: w, rules: cfg.Response, vars: vars}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headersStage applies the request rules. It runs after auth by default, so
+// rules can't hand the access, limit or auth checks values of their own.
+func headersStage(e *edgeRequest, next http.Handler) http.Handler {
+	cfg := e.Entry.Headers
+	if cfg == nil || len(cfg.Request) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars, _ := r.Context().Value(headerVarsKey{}).(*strings.Replacer)
+		applyHeaderRules(r.Header, cfg.Request, vars)
+		next.ServeHTTP(w, r)
+	})
+}
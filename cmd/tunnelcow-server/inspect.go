@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+
+	"github.com/google/uuid"
+)
+
+type CaptureTransport struct {
+	Base       http.RoundTripper
+	Session    *ClientSession
+	PublicPort int
+	Config     *tunnel.InspectConfig
+}
+
+func (t *CaptureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !inspectSampled(t.Config) {
+		return t.Base.RoundTrip(req)
+	}
+
+	start := time.Now()
+	id := uuid.New().String()
+
+	// Bodies are teed as they stream through rather than read up front, so
+	// gRPC and other long-lived streams keep flowing while being inspected.
+	var reqBody *captureBody
+	if req.Body != nil && req.Body != http.NoBody {
+		reqBody = &captureBody{ReadCloser: req.Body}
+		req.Body = reqBody
+	}
+
+	reqHeaders := make(map[string]string)
+	for k, v := range req.Header {
+		reqHeaders[k] = strings.Join(v, ", ")
+	}
+
+	res, err := t.Base.RoundTrip(req)
+
+	status := 0
+	if res != nil {
+		status = res.StatusCode
+	} else if err != nil {
+		status = 502
+	}
+
+	if !inspectStatusMatch(t.Config, status) {
+		return res, err
+	}
+
+	payload := tunnel.InspectPayload{
+		ID:         id,
+		Timestamp:  start.UnixMilli(),
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		ReqHeaders: reqHeaders,
+		Status:     status,
+		ResHeaders: make(map[string]string),
+		ClientIP:   req.RemoteAddr,
+		PublicPort: t.PublicPort,
+	}
+
+	finish := func(resBody *captureBody) {
+		payload.DurationMs = time.Since(start).Milliseconds()
+		if reqBody != nil {
+			payload.ReqBody = reqBody.describe("Request")
+		}
+		if resBody != nil {
+			payload.ResBody = resBody.describe("Response")
+		}
+		if res != nil {
+			for k, v := range res.Trailer {
+				payload.ResHeaders[k] = strings.Join(v, ", ")
+			}
+		}
+		t.Session.sendInspectData(payload)
+	}
+
+	if res == nil {
+		if err != nil {
+			payload.ResBody = err.Error()
+		}
+		finish(nil)
+		return res, err
+	}
+
+	for k, v := range res.Header {
+		payload.ResHeaders[k] = strings.Join(v, ", ")
+	}
+	if res.Body == nil || res.Body == http.NoBody {
+		finish(nil)
+		return res, err
+	}
+
+	resBody := &captureBody{ReadCloser: res.Body}
+	resBody.onDone = func() { finish(resBody) }
+	res.Body = resBody
+	return res, err
+}
+
+const maxInspectBody = 4096
+
+// captureBody keeps the first maxInspectBody bytes of a body and calls
+// onDone once it has been read to the end or closed.
+type captureBody struct {
+	io.ReadCloser
+
+	mu     sync.Mutex
+	head   []byte
+	total  int
+	onDone func()
+	once   sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.mu.Lock()
+		b.total += n
+		if room := maxInspectBody + 1 - len(b.head); room > 0 {
+			b.head = append(b.head, p[:min(n, room)]...)
+		}
+		b.mu.Unlock()
+	}
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+func (b *captureBody) done() {
+	if b.onDone != nil {
+		b.once.Do(b.onDone)
+	}
+}
+
+func (b *captureBody) describe(kind string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.total == 0:
+		return ""
+	case b.total > maxInspectBody:
+		return "[" + kind + " Body Too Large]"
+	case isBinary(b.head):
+		return "[Binary " + kind + " Body]"
+	}
+	return string(b.head)
+}
+
+func inspectSampled(cfg *tunnel.InspectConfig) bool {
+	if cfg == nil || !cfg.Enabled {
+		return false
+	}
+	if cfg.SampleRate <= 0 || cfg.SampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < cfg.SampleRate
+}
+
+func inspectStatusMatch(cfg *tunnel.InspectConfig, status int) bool {
+	if len(cfg.Status) == 0 {
+		return true
+	}
+	code := strconv.Itoa(status)
+	for _, rule := range cfg.Status {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if len(rule) == 3 && strings.HasSuffix(rule, "xx") {
+			if len(code) == 3 && code[0] == rule[0] {
+				return true
+			}
+			continue
+		}
+		if rule == code {
+			return true
+		}
+	}
+	return false
+}
+
+// sendInspectData hands the capture to the inspector stream of the session
+// that served the request. It never blocks the proxied request: when the
+// queue is full the record is dropped.
+func (c *ClientSession) sendInspectData(data tunnel.InspectPayload) {
+	select {
+	case c.inspectQueue <- data:
+	default:
+		if GlobalDebug {
+			log.Printf("[INSPECT] Queue full for port %d, dropping %s", data.PublicPort, data.URL)
+		}
+	}
+}
+
+// inspectLoop drains the inspector queue onto a dedicated yamux stream so
+// captures never contend with control traffic.
+func (c *ClientSession) inspectLoop() {
+	var stream net.Conn
+	var encoder *json.Encoder
+
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-c.Session.CloseChan():
+			return
+		case data := <-c.inspectQueue:
+			if stream == nil {
+				s, err := c.Session.Open()
+				if err != nil {
+					log.Printf("[INSPECT] Failed to open inspector stream: %v", err)
+					continue
+				}
+				header := tunnel.ControlMessage{Type: tunnel.MsgTypeInspectStream}
+				if err := json.NewEncoder(s).Encode(header); err != nil {
+					s.Close()
+					continue
+				}
+				stream = s
+				encoder = json.NewEncoder(s)
+			}
+
+			payloadBytes, err := json.Marshal(data)
+			if err != nil {
+				continue
+			}
+			msg := tunnel.ControlMessage{
+				Type:    tunnel.MsgTypeInspectData,
+				Payload: payloadBytes,
+			}
+			if err := encoder.Encode(msg); err != nil {
+				if c.Debug {
+					log.Printf("[INSPECT] Failed to send message: %v", err)
+				}
+				stream.Close()
+				stream = nil
+				continue
+			}
+			if c.Debug {
+				log.Printf("[INSPECT] Sent %d bytes to client (URL: %s)", len(payloadBytes), data.URL)
+			}
+		}
+	}
+}
+
+func isBinary(data []byte) bool {
+	if len(data) > 512 {
+		data = data[:512]
+	}
+	for _, b := range data {
+		if b == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const (
+	jwksTTL     = time.Hour
+	jwksRefetch = time.Minute
+	jwtLeeway   = 60 * time.Second
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims is a decoded token payload.
+type jwtClaims map[string]any
+
+func (c jwtClaims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings reads a claim that may be a single string or a list of them.
+func (c jwtClaims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func (c jwtClaims) Time(name string) (time.Time, bool) {
+	f, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// HasAudience reports whether aud names the given audience.
+func (c jwtClaims) HasAudience(aud string) bool {
+	for _, a := range c.Strings("aud") {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+type keySet struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var jwksCache = struct {
+	mu   sync.Mutex
+	sets map[string]*keySet
+}{sets: make(map[string]*keySet)}
+
+// jwksKey returns the key kid from the set at url. The set is refetched when
+// it is old or, at most once a minute, when it doesn't know kid, so key
+// rotation at the issuer is picked up.
+func jwksKey(url, kid string) (crypto.PublicKey, error) {
+	jwksCache.mu.Lock()
+	set := jwksCache.sets[url]
+	jwksCache.mu.Unlock()
+
+	if set != nil {
+		key, known := set.lookup(kid)
+		if known && time.Since(set.fetched) < jwksTTL {
+			return key, nil
+		}
+		if !known && time.Since(set.fetched) < jwksRefetch {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+	}
+
+	fresh, err := fetchJWKS(url)
+	if err != nil {
+		return nil, err
+	}
+	jwksCache.mu.Lock()
+	jwksCache.sets[url] = fresh
+	jwksCache.mu.Unlock()
+
+	if key, ok := fresh.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup finds kid, or the only key of a set when the token names none.
+func (s *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, true
+		}
+	}
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+func fetchJWKS(url string) (*keySet, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	set, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", url, err)
+	}
+	return set, nil
+}
+
+var inlineKeySets = struct {
+	mu   sync.Mutex
+	sets map[[32]byte]*keySet
+}{sets: make(map[[32]byte]*keySet)}
+
+// inlineKey looks kid up in a JWKS document given with the domain config.
+func inlineKey(doc []byte, kid string) (crypto.PublicKey, error) {
+	sum := sha256.Sum256(doc)
+
+	inlineKeySets.mu.Lock()
+	set, ok := inlineKeySets.sets[sum]
+	if !ok {
+		var err error
+		if set, err = parseJWKS(doc); err != nil {
+			inlineKeySets.mu.Unlock()
+			return nil, err
+		}
+		inlineKeySets.sets[sum] = set
+	}
+	inlineKeySets.mu.Unlock()
+
+	if key, ok := set.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func parseJWKS(data []byte) (*keySet, error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	set := &keySet{keys: make(map[string]crypto.PublicKey), fetched: time.Now()}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) > 4 {
+				continue
+			}
+			set.keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			size := (curve.Params().BitSize + 7) / 8
+			if err1 != nil || err2 != nil || len(x) != size || len(y) != size {
+				continue
+			}
+			pub, err := ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+			if err != nil {
+				continue
+			}
+			set.keys[k.Kid] = pub
+		}
+	}
+	return set, nil
+}
+
+// parseJWT splits a compact JWS into its header, claims, signing input and
+// signature without checking anything.
+func parseJWT(token string) (jwtHeader, jwtClaims, []byte, []byte, error) {
+	var header jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, nil, nil, errors.New("malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, nil, nil, errors.New("malformed token header")
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, nil, nil, errors.New("malformed token claims")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, nil, nil, errors.New("malformed token signature")
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return header, nil, nil, nil, errors.New("malformed token header")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return header, nil, nil, nil, errors.New("malformed token claims")
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	var digest []byte
+	switch h {
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key doesn't match algorithm %s", alg)
+		}
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(pub, h, digest, sig, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, h, digest, sig)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key doesn't match algorithm %s", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+// verifyJWT checks a token signed by a key from keyFor with one of algs
+// (any supported algorithm when empty) and returns its claims if it is
+// currently valid. Issuer and audience are left to the caller.
+func verifyJWT(token string, keyFor func(kid string) (crypto.PublicKey, error), algs []string) (jwtClaims, error) {
+	header, claims, signed, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(algs) == 0 {
+		algs = tunnel.JWTAlgorithms
+	}
+	if !slices.Contains(algs, header.Alg) {
+		return nil, fmt.Errorf("algorithm %q is not allowed", header.Alg)
+	}
+	key, err := keyFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+	if err := checkJWTTimes(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func checkJWTTimes(claims jwtClaims) error {
+	now := time.Now()
+	exp, ok := claims.Time("exp")
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
@@ -1,60 +1,194 @@
 package main
 
 import (
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
+	"tunnelcow/internal/tunnel"
 )
 
+const (
+	// maxLimitBuckets bounds the buckets kept in memory; the least recently
+	// used one is dropped to make room.
+	maxLimitBuckets = 100_000
+	// maxLimitSubkeys bounds the path or header buckets one visitor gets on
+	// a domain. Further values share one overflow bucket, so rotating a
+	// header doesn't buy a fresh allowance each time.
+	maxLimitSubkeys = 16
+)
+
+// RateLimiter keeps a token bucket per key, in least recently used order.
 type RateLimiter struct {
-	mu       sync.Mutex
-	visitors map[string]*visitor
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	lru     list.List
+	subkeys map[string]int
 }
 
-type visitor struct {
-	count     int
-	lastReset time.Time
+type bucket struct {
+	key    string
+	client string
+	sub    bool
+	elem   *list.Element
+
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
 }
 
 var GlobalLimiter = &RateLimiter{
-	visitors: make(map[string]*visitor),
+	buckets: make(map[string]*bucket),
+	subkeys: make(map[string]int),
+}
+
+// limitResult describes the bucket after a Take, for RateLimit-* headers.
+type limitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+func limitBurst(cfg *tunnel.RateLimitConfig) float64 {
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = cfg.Rate
+	}
+	return math.Max(1, math.Floor(burst))
 }
 
-func (rl *RateLimiter) Allow(ip string, limit int) bool {
+func (rl *RateLimiter) remove(b *bucket) {
+	delete(rl.buckets, b.key)
+	rl.lru.Remove(b.elem)
+	if b.sub {
+		if rl.subkeys[b.client]--; rl.subkeys[b.client] <= 0 {
+			delete(rl.subkeys, b.client)
+		}
+	}
+}
+
+// Take spends one token from the bucket of client (a visitor on a domain or
+// port), or of client's bucket for sub when the limit is per path or header
+// value. Buckets are created full.
+func (rl *RateLimiter) Take(client, sub string, cfg *tunnel.RateLimitConfig) limitResult {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	v, exists := rl.visitors[ip]
 	now := time.Now()
+	burst := limitBurst(cfg)
+
+	key := client
+	if sub != "" {
+		key = client + "|" + sub
+		if _, ok := rl.buckets[key]; !ok && rl.subkeys[client] >= maxLimitSubkeys {
+			key, sub = client+"|*", ""
+		}
+	}
 
+	b, exists := rl.buckets[key]
 	if !exists {
-		rl.visitors[ip] = &visitor{
-			count:     1,
-			lastReset: now,
+		if len(rl.buckets) >= maxLimitBuckets {
+			rl.remove(rl.lru.Back().Value.(*bucket))
 		}
+		b = &bucket{key: key, client: client, sub: sub != "", tokens: burst, last: now}
+		b.elem = rl.lru.PushFront(b)
+		rl.buckets[key] = b
+		if b.sub {
+			rl.subkeys[client]++
+		}
+	} else {
+		rl.lru.MoveToFront(b.elem)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*cfg.Rate)
+		b.last = now
+	}
+	b.rate = cfg.Rate
+	b.burst = burst
+
+	res := limitResult{Limit: int(burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / cfg.Rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((burst - b.tokens) / cfg.Rate * float64(time.Second))
+	return res
+}
+
+// domainLimit returns the domain's limiter settings, mapping the legacy
+// requests-per-second RateLimit onto a bucket of the same size.
+func domainLimit(entry DomainEntry) *tunnel.RateLimitConfig {
+	if entry.Limiter != nil && entry.Limiter.Rate > 0 {
+		return entry.Limiter
+	}
+	if entry.RateLimit > 0 {
+		return &tunnel.RateLimitConfig{Rate: float64(entry.RateLimit)}
+	}
+	return nil
+}
+
+// limitKey returns the visitor's bucket on host and, for limits by path or
+// header, the value within it. Values are always scoped to the visitor's
+// address.
+func limitKey(host string, r *http.Request, cfg *tunnel.RateLimitConfig) (string, string) {
+	client := host + "|" + sessionKey(r.RemoteAddr)
+	switch cfg.By {
+	case "path":
+		return client, "path:" + r.URL.Path
+	case "header":
+		return client, "header:" + r.Header.Get(cfg.Header)
+	}
+	return client, ""
+}
+
+// applyRateLimit enforces the domain's limiter and sets RateLimit-* headers.
+// It writes the 429 itself and returns false when the request must stop.
+func applyRateLimit(w http.ResponseWriter, r *http.Request, host string, entry DomainEntry) bool {
+	cfg := domainLimit(entry)
+	if cfg == nil {
 		return true
 	}
 
-	if now.Sub(v.lastReset) > time.Second {
-		v.count = 1
-		v.lastReset = now
+	client, sub := limitKey(host, r, cfg)
+	res := GlobalLimiter.Take(client, sub, cfg)
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", res.Limit, ceilSeconds(time.Duration(float64(res.Limit)/cfg.Rate*float64(time.Second)))))
+	if res.Allowed {
 		return true
 	}
 
-	if v.count >= limit {
-		return false
+	domainCounters(host).limited.Add(1)
+	if GlobalDebug {
+		log.Printf("[LIMIT] %s exceeded %g r/s on %s", r.RemoteAddr, cfg.Rate, host)
 	}
+	h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	return false
+}
 
-	v.count++
-	return true
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
 
 func (rl *RateLimiter) CleanupLoop() {
 	for {
 		time.Sleep(10 * time.Minute)
 		rl.mu.Lock()
-		for ip, v := range rl.visitors {
-			if time.Since(v.lastReset) > 10*time.Minute {
-				delete(rl.visitors, ip)
+		now := time.Now()
+		for _, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst && now.Sub(b.last) > time.Minute {
+				rl.remove(b)
 			}
 		}
 		rl.mu.Unlock()
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const (
+	defaultHeaderTimeout = 10
+	defaultIdleTimeout   = 120
+	defaultMaxBodyBytes  = 100 << 20
+)
+
+// ServerLimits is the "limits" section of data/server_config.json. The
+// embedded LimitsConfig holds the defaults every domain inherits.
+// MaxBodyBytes defaults to 100 MiB. The read, write and upstream timeouts
+// are unlimited unless set, so event streams, long downloads and gRPC
+// streams work without configuration. HeaderTimeout (reading the request
+// line and headers) and IdleTimeout (a keep-alive connection waiting for its
+// next request) are per connection and run before the domain is known, so
+// they exist only here. They default to 10 and 120 seconds. Any of them
+// takes -1 for none. MaxHeaderBytes defaults to 1 MiB.
+type ServerLimits struct {
+	HeaderTimeout int `json:"header_timeout,omitempty"`
+	IdleTimeout   int `json:"idle_timeout,omitempty"`
+	tunnel.LimitsConfig
+}
+
+var serverLimits ServerLimits
+
+func (l ServerLimits) Validate() error {
+	if l.HeaderTimeout < -1 || l.IdleTimeout < -1 {
+		return fmt.Errorf("timeouts must be positive, 0 for the default or -1 for none")
+	}
+	if l.MaxHeaderBytes < 0 {
+		return fmt.Errorf("max header bytes can't be negative")
+	}
+	return l.LimitsConfig.Validate()
+}
+
+// limitDuration turns a limit in seconds into a duration. Unset limits take
+// def and -1 gives 0, which net/http reads as no limit.
+func limitDuration(seconds, def int) time.Duration {
+	if seconds == 0 {
+		seconds = def
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// configure applies the connection-level limits to an edge listener.
+// Read and write timeouts are left to applyLimits so domains can change
+// them and upgraded connections can skip them.
+func (l ServerLimits) configure(s *http.Server) {
+	s.ReadHeaderTimeout = limitDuration(l.HeaderTimeout, defaultHeaderTimeout)
+	s.IdleTimeout = limitDuration(l.IdleTimeout, defaultIdleTimeout)
+	s.MaxHeaderBytes = l.MaxHeaderBytes
+}
+
+// domainLimits is the server-wide LimitsConfig, with defaults for what it
+// leaves unset, and the domain's overrides applied.
+func domainLimits(entry DomainEntry) tunnel.LimitsConfig {
+	l := serverLimits.LimitsConfig
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	o := entry.Limits
+	if o == nil {
+		return l
+	}
+	if o.ReadTimeout != 0 {
+		l.ReadTimeout = o.ReadTimeout
+	}
+	if o.WriteTimeout != 0 {
+		l.WriteTimeout = o.WriteTimeout
+	}
+	if o.UpstreamTimeout != 0 {
+		l.UpstreamTimeout = o.UpstreamTimeout
+	}
+	if o.MaxHeaderBytes != 0 {
+		l.MaxHeaderBytes = o.MaxHeaderBytes
+	}
+	if o.MaxBodyBytes != 0 {
+		l.MaxBodyBytes = o.MaxBodyBytes
+	}
+	return l
+}
+
+// headerSize approximates the request head as sent: the request line plus
+// one "Name: value" line per header.
+func headerSize(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4 + len(r.Host) + 8
+	for name, values := range r.Header {
+		for _, v := range values {
+			n += len(name) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// edgeBody caps a request body and remembers why reading it failed, so the
+// proxy can tell a slow or oversized upload from an upstream failure.
+type edgeBody struct {
+	io.ReadCloser
+	rc  *http.ResponseController
+	err error
+}
+
+func (b *edgeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	switch {
+	case err == io.EOF:
+		// Once the body is in, the read deadline would only cut off the
+		// server's watch for the visitor hanging up.
+		if b.rc != nil {
+			b.rc.SetReadDeadline(time.Time{})
+		}
+	case err != nil:
+		b.err = err
+	}
+	return n, err
+}
+
+// bodyErrorPage names the page for a request whose body ran into the
+// domain's limits, or returns "" if it didn't.
+func bodyErrorPage(r *http.Request) string {
+	b, ok := r.Body.(*edgeBody)
+	if !ok || b.err == nil {
+		return ""
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(b.err, &tooLarge) {
+		return tunnel.Page413
+	}
+	if errors.Is(b.err, os.ErrDeadlineExceeded) {
+		return tunnel.Page408
+	}
+	return ""
+}
+
+// isUpgrade reports whether r asks to switch protocols, which takes the
+// "upgrade" token in Connection as well as an Upgrade header.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyLimits enforces the domain's limits once the request headers are in.
+// Requests already over a size limit get the 431 or 413 page and false.
+// Otherwise the read and write deadlines are set and the body is capped for
+// the rest of the chain.
+func applyLimits(w http.ResponseWriter, r *http.Request, host string, l tunnel.LimitsConfig) bool {
+	if l.MaxHeaderBytes > 0 && headerSize(r) > l.MaxHeaderBytes {
+		serveErrorPage(w, host, tunnel.Page431)
+		return false
+	}
+	if l.MaxBodyBytes > 0 && r.ContentLength > l.MaxBodyBytes {
+		serveErrorPage(w, host, tunnel.Page413)
+		return false
+	}
+
+	// Upgraded connections outlive the request, so its deadlines would cut
+	// them off. The body cap applies either way.
+	deadlines := !isUpgrade(r)
+	rc := http.NewResponseController(w)
+	if deadlines && l.WriteTimeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(time.Duration(l.WriteTimeout) * time.Second))
+	}
+	if r.Body == nil || r.Body == http.NoBody || (l.ReadTimeout <= 0 && l.MaxBodyBytes <= 0) {
+		return true
+	}
+	body := &edgeBody{ReadCloser: r.Body}
+	if l.MaxBodyBytes > 0 {
+		body.ReadCloser = http.MaxBytesReader(w, r.Body, l.MaxBodyBytes)
+	}
+	if deadlines && l.ReadTimeout > 0 {
+		body.rc = rc
+		rc.SetReadDeadline(time.Now().Add(time.Duration(l.ReadTimeout) * time.Second))
+	}
+	r.Body = body
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tunnelcow/internal/tunnel"
+)
+
+func TestDomainLimitDefaults(t *testing.T) {
+	saved := serverLimits
+	t.Cleanup(func() { serverLimits = saved })
+
+	serverLimits = ServerLimits{}
+	l := domainLimits(DomainEntry{})
+	if l.ReadTimeout != 0 || l.WriteTimeout != 0 || l.MaxBodyBytes != defaultMaxBodyBytes {
+		t.Errorf("unset server limits gave %+v", l)
+	}
+
+	serverLimits.LimitsConfig = tunnel.LimitsConfig{ReadTimeout: -1, MaxBodyBytes: 1024}
+	l = domainLimits(DomainEntry{Limits: &tunnel.LimitsConfig{WriteTimeout: -1}})
+	if l.ReadTimeout != -1 || l.WriteTimeout != -1 || l.MaxBodyBytes != 1024 {
+		t.Errorf("explicit limits gave %+v", l)
+	}
+
+	r := httptest.NewRequest("POST", "http://big.test/", strings.NewReader("x"))
+	r.ContentLength = defaultMaxBodyBytes + 1
+	w := httptest.NewRecorder()
+	serverLimits = ServerLimits{}
+	if applyLimits(w, r, "big.test", domainLimits(DomainEntry{})) || w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status %d, want 413", w.Code)
+	}
+}
+
+func TestUpgradeHeaderKeepsBodyCap(t *testing.T) {
+	saved := serverLimits
+	t.Cleanup(func() { serverLimits = saved })
+	serverLimits = ServerLimits{LimitsConfig: tunnel.LimitsConfig{MaxBodyBytes: 16}}
+
+	r := httptest.NewRequest("POST", "http://big.test/", strings.NewReader(strings.Repeat("x", 64)))
+	r.ContentLength = -1
+	r.TransferEncoding = []string{"chunked"}
+	r.Header.Set("Upgrade", "x")
+	w := httptest.NewRecorder()
+	if !applyLimits(w, r, "big.test", domainLimits(DomainEntry{})) {
+		t.Fatal("chunked body refused before it was read")
+	}
+	_, err := io.ReadAll(r.Body)
+	if err == nil {
+		t.Fatal("body over the cap read in full")
+	}
+	upstreamErrorHandler("big.test")(w, r, err)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", w.Code)
+	}
+}
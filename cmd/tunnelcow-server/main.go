@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
@@ -18,9 +16,8 @@ import (
 
 	"math/rand"
 
-	"github.com/google/uuid"
 	"github.com/hashicorp/yamux"
-	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/acme"
 )
 
 var Version = "dev"
@@ -28,15 +25,26 @@ var GlobalDebug = false
 
 func main() {
 	fmt.Printf("TunnelCow Server %s\n", Version)
+
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		os.Exit(runCertCommand(os.Args[2:]))
+	}
+
 	portFlag := flag.Int("port", tunnel.DefaultControlPort, "Port to listen on for client connections")
 	tokenFlag := flag.String("token", "", "Authentication token")
 	debugFlag := flag.Bool("debug", false, "Enable verbose debug logging")
+	acmeDirFlag := flag.String("acme-directory", "", "ACME directory URL (overrides config)")
+	acmeEmailFlag := flag.String("acme-email", "", "ACME account contact email (overrides config)")
+	acmeStagingFlag := flag.Bool("acme-staging", false, "Use the Let's Encrypt staging directory")
 	flag.Parse()
 
 	type ServerConfig struct {
-		Token string `json:"token"`
-		Port  int    `json:"port"`
-		Debug bool   `json:"debug"`
+		Token     string          `json:"token"`
+		Port      int             `json:"port"`
+		Debug     bool            `json:"debug"`
+		ACME      ACMEConfig      `json:"acme,omitzero"`
+		Limits    ServerLimits    `json:"limits,omitzero"`
+		AccessLog AccessLogConfig `json:"access_log,omitzero"`
 	}
 	var serverCfg ServerConfig
 	configPath := "data/server_config.json"
@@ -83,6 +91,32 @@ func main() {
 		log.Println("[DEBUG] Debug Mode: ENABLED")
 	}
 
+	acmeCfg := serverCfg.ACME
+	if *acmeDirFlag != "" {
+		acmeCfg.DirectoryURL = *acmeDirFlag
+	}
+	if *acmeEmailFlag != "" {
+		acmeCfg.Email = *acmeEmailFlag
+	}
+	if *acmeStagingFlag {
+		acmeCfg.Staging = true
+	}
+	acmeService, err := newACMEService(acmeCfg)
+	if err != nil {
+		log.Fatalf("Invalid ACME configuration: %v", err)
+	}
+	serverACME = acmeService
+
+	if err := serverCfg.Limits.Validate(); err != nil {
+		log.Fatalf("Invalid limits configuration: %v", err)
+	}
+	serverLimits = serverCfg.Limits
+
+	if err := serverCfg.AccessLog.Validate(); err != nil {
+		log.Fatalf("Invalid access log configuration: %v", err)
+	}
+	accessLogCfg = serverCfg.AccessLog
+
 	addr := fmt.Sprintf(":%d", finalPort)
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -93,6 +127,9 @@ func main() {
 	log.Printf("Auth Token: %s", finalToken)
 
 	initDomainManager()
+	initCertStore()
+	initEdgeCache()
+	go serverCerts.ExpiryLoop()
 
 	go GlobalLimiter.CleanupLoop()
 
@@ -113,301 +150,130 @@ func main() {
 
 func startHTTPSListener(finalToken string) {
 
-	m := &autocert.Manager{
-		Cache:  autocert.DirCache("certs"),
-		Prompt: autocert.AcceptTOS,
-		HostPolicy: func(ctx context.Context, host string) error {
-
-			if serverDomains.Exists(host) {
-				return nil
+	tlsConfig := serverACME.Manager().TLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return serverACME.GetCertificate(hello)
 			}
-			return fmt.Errorf("domain %s not configured", host)
-		},
+		}
+		if cert := serverCerts.Lookup(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+		return serverACME.GetCertificate(hello)
 	}
+	tlsConfig.GetConfigForClient = clientAuthConfig(tlsConfig)
 
 	server := &http.Server{
 		Addr:      ":443",
-		TLSConfig: m.TLSConfig(),
+		TLSConfig: tlsConfig,
 		ErrorLog:  log.New(&QuietWriter{}, "", 0),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-			host := r.Host
-			if h, _, err := net.SplitHostPort(host); err == nil {
-				host = h
-			}
-
-			entry, ok := serverDomains.Get(host)
-			if !ok {
-				http.Error(w, "Domain not mapped", 404)
-				return
-			}
-
-			if r.URL.Path == "/tunnelcow" && r.Method == "POST" {
-				handleShieldVerify(w, r, finalToken)
-				return
-			}
-
-			if entry.RateLimit > 0 {
-				ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-				if !GlobalLimiter.Allow(ip, entry.RateLimit) {
-					http.Error(w, "Too Many Requests", 429)
-					return
-				}
-			}
-
-			if entry.SmartShield {
-				if !validateShieldCookie(r, finalToken) {
-					serveChallengePage(w)
-					return
-				}
-			}
-
-			if entry.Mode == "http" {
-				http.Error(w, "HTTPS not enabled for this domain", 403)
-				return
-			}
-
-			if entry.AuthUser != "" {
-				valid := validateCookie(r, host, entry.AuthUser, entry.AuthPass, finalToken)
-				if !valid {
-					serveLogin(w, r, host, entry.AuthUser, entry.AuthPass, finalToken)
-					return
-				}
-			}
-
-			director := func(req *http.Request) {
-				req.URL.Scheme = "http"
-				req.URL.Host = fmt.Sprintf("127.0.0.1:%d", entry.PublicPort)
-				req.Host = host
-			}
-			proxy := &httputil.ReverseProxy{
-				Director: director,
-				Transport: &CaptureTransport{
-					Base:       http.DefaultTransport,
-					PublicPort: entry.PublicPort,
-				},
-			}
-			proxy.ServeHTTP(w, r)
-		}),
+		Handler:   edgeHandler(finalToken),
 	}
-
-	httpHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host := r.Host
-		if h, _, err := net.SplitHostPort(host); err == nil {
-			host = h
-		}
-
-		entry, ok := serverDomains.Get(host)
-		if !ok {
-			http.Error(w, "Domain not mapped", 404)
-			return
-		}
-
-		if entry.RateLimit > 0 {
-			ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-			if !GlobalLimiter.Allow(ip, entry.RateLimit) {
-				http.Error(w, "Too Many Requests", 429)
-				return
-			}
-		}
-
-		if entry.SmartShield {
-			if !validateShieldCookie(r, finalToken) {
-				serveChallengePage(w)
-				return
-			}
-		}
-
-		if entry.Mode == "http" {
-
-			if entry.AuthUser != "" {
-				valid := validateCookie(r, host, entry.AuthUser, entry.AuthPass, finalToken)
-				if !valid {
-					serveLogin(w, r, host, entry.AuthUser, entry.AuthPass, finalToken)
-					return
-				}
-			}
-
-			director := func(req *http.Request) {
-				req.URL.Scheme = "http"
-				req.URL.Host = fmt.Sprintf("127.0.0.1:%d", entry.PublicPort)
-				req.Host = host
-			}
-			proxy := &httputil.ReverseProxy{
-				Director: director,
-				Transport: &CaptureTransport{
-					Base:       http.DefaultTransport,
-					PublicPort: entry.PublicPort,
-				},
-			}
-			proxy.ServeHTTP(w, r)
-		} else {
-
-			target := "https://" + r.Host + r.URL.Path
-			if len(r.URL.RawQuery) > 0 {
-				target += "?" + r.URL.RawQuery
-			}
-			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
-		}
-	})
+	serverLimits.configure(server)
 
 	go func() {
 		log.Println("Starting HTTP-01 Listener on :80")
 
-		wrappedHandler := m.HTTPHandler(httpHandler)
-
-		if err := http.ListenAndServe(":80", wrappedHandler); err != nil {
+		// Cleartext HTTP/2 (prior knowledge) lets gRPC clients reach
+		// http-mode domains without TLS. It is enabled for the listener,
+		// but edgeHandler refuses it for domains without an h2c upstream.
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+
+		plain := &http.Server{
+			Addr:      ":80",
+			Handler:   serverACME.HTTPHandler(edgeHandler(finalToken)),
+			Protocols: &protocols,
+		}
+		serverLimits.configure(plain)
+		if err := plain.ListenAndServe(); err != nil {
 			log.Printf("HTTP-01 Listener failed: %v", err)
 		}
 	}()
 
 	log.Println("Starting TLS Server on :443...")
-	if err := server.ListenAndServeTLS("", ""); err != nil {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
 		log.Printf("TLS Server failed: %v (Proceeding with Control Server only)", err)
-	}
-}
-
-func serveLogin(w http.ResponseWriter, r *http.Request, domain, user, pass, secret string) {
-	if r.Method == "POST" {
-		r.ParseForm()
-		u := r.FormValue("username")
-		p := r.FormValue("password")
-
-		if u == user && p == pass {
-			cookie := generateCookie(domain, user, pass, secret)
-			http.SetCookie(w, cookie)
-			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
-			return
-		}
-
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, loginHTML, domain, `<div class="error">Invalid username or password</div>`)
 		return
 	}
-
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusUnauthorized)
-	fmt.Fprintf(w, loginHTML, domain, "")
-}
-
-type CaptureTransport struct {
-	Base       http.RoundTripper
-	PublicPort int
-}
-
-func (t *CaptureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	start := time.Now()
-	id := uuid.New().String()
-
-	var reqBody []byte
-	if req.Body != nil {
-		reqBody, _ = io.ReadAll(req.Body)
-		req.Body = io.NopCloser(bytes.NewBuffer(reqBody))
+	if err := server.ServeTLS(newSNIListener(ln), "", ""); err != nil {
+		log.Printf("TLS Server failed: %v (Proceeding with Control Server only)", err)
 	}
+}
 
-	reqHeaders := make(map[string]string)
-	for k, v := range req.Header {
-		reqHeaders[k] = strings.Join(v, ", ")
+func serveUpstream(w http.ResponseWriter, r *http.Request, host string, entry DomainEntry) {
+	if entry.Maintenance {
+		serveErrorPage(w, host, tunnel.PageOffline)
+		return
 	}
 
-	res, err := t.Base.RoundTrip(req)
-
-	duration := time.Since(start).Milliseconds()
-
-	var resBody []byte
-	status := 0
-	resHeaders := make(map[string]string)
+	w, done := withCompression(w, r, entry.Compression)
+	defer done()
 
-	if res != nil {
-		status = res.StatusCode
-		if res.Body != nil {
-			resBody, _ = io.ReadAll(res.Body)
-			res.Body = io.NopCloser(bytes.NewBuffer(resBody))
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		port, rule, prefixLen := entry.resolveRoute(r.URL.Path)
+		if rule == nil || !rule.StripPrefix {
+			prefixLen = 0
 		}
-		for k, v := range res.Header {
-			resHeaders[k] = strings.Join(v, ", ")
-		}
-	} else if err != nil {
-		status = 502
-		resBody = []byte(err.Error())
-	}
-
-	capturedReqBody := ""
-	if len(reqBody) > 0 {
-		if len(reqBody) > 4096 {
-			capturedReqBody = "[Request Body Too Large]"
-		} else if isBinary(reqBody) {
-			capturedReqBody = "[Binary Request Body]"
-		} else {
-			capturedReqBody = string(reqBody)
-		}
-	}
 
-	capturedResBody := ""
-	if len(resBody) > 0 {
-		if len(resBody) > 4096 {
-			capturedResBody = "[Response Body Too Large]"
-		} else if isBinary(resBody) {
-			capturedResBody = "[Binary Response Body]"
-		} else {
-			capturedResBody = string(resBody)
+		session, ok := pickBackend(w, r, port)
+		if !ok {
+			serveErrorPage(w, host, tunnel.PageOffline)
+			return
 		}
+		newDomainProxy(host, port, session, prefixLen, entry).ServeHTTP(w, r)
+	})
+	if entry.Cache != nil && entry.Cache.Enabled {
+		serveCached(w, r, host, entry, proxy)
+		return
 	}
-
-	payload := tunnel.InspectPayload{
-		ID:         id,
-		Timestamp:  start.UnixMilli(),
-		Method:     req.Method,
-		URL:        req.URL.String(),
-		ReqHeaders: reqHeaders,
-		ReqBody:    capturedReqBody,
-		Status:     status,
-		ResHeaders: resHeaders,
-		ResBody:    capturedResBody,
-		DurationMs: duration,
-		ClientIP:   req.RemoteAddr,
-		PublicPort: t.PublicPort,
-	}
-
-	go sendInspectData(t.PublicPort, payload)
-
-	return res, err
+	proxy.ServeHTTP(w, r)
 }
 
-func sendInspectData(publicPort int, data tunnel.InspectPayload) {
-	if GlobalDebug {
-		log.Printf("[INSPECT] Sending inspection data for port %d (URL: %s)", publicPort, data.URL)
-	}
-	session, ok := GlobalSessions.Get(publicPort)
-	if !ok {
-		log.Printf("[INSPECT] Failed to find session for port %d", publicPort)
-		return
+func newDomainProxy(host string, port int, session *ClientSession, stripLen int, entry DomainEntry) *httputil.ReverseProxy {
+	director := func(req *http.Request) {
+		req.URL.Scheme = upstreamScheme(entry.Upstream)
+		req.URL.Host = upstreamHost(session, port)
+		req.Host = upstreamHostHeader(entry.Upstream, host)
+		if stripLen > 0 {
+			req.URL.Path = stripPath(req.URL.Path, stripLen)
+			req.URL.RawPath = ""
+		}
 	}
 
-	payloadBytes, err := json.Marshal(data)
-	if err != nil {
-		if GlobalDebug {
-			log.Printf("[INSPECT] JSON Marshal failed: %v", err)
+	sni := host
+	if entry.Upstream != nil && entry.Upstream.Host != "" {
+		sni = entry.Upstream.Host
+		if h, _, err := net.SplitHostPort(sni); err == nil {
+			sni = h
 		}
-		return
 	}
-	msg := tunnel.ControlMessage{
-		Type:    tunnel.MsgTypeInspectData,
-		Payload: payloadBytes,
+	timeout := limitDuration(domainLimits(entry).UpstreamTimeout, 0)
+	transport := upstreamTransport(entry.Upstream, sni, timeout)
+	if entry.Inspect != nil && entry.Inspect.Enabled {
+		transport = &CaptureTransport{
+			Base:       transport,
+			Session:    session,
+			PublicPort: port,
+			Config:     entry.Inspect,
+		}
 	}
 
-	session.Mu.Lock()
-	defer session.Mu.Unlock()
-
-	if err := json.NewEncoder(session.Control).Encode(msg); err != nil {
-		if GlobalDebug {
-			log.Printf("[INSPECT] Failed to encode/send message: %v", err)
-		}
-	} else {
-		if GlobalDebug {
-			log.Printf("[INSPECT] Sent %d bytes to client", len(payloadBytes))
+	proxy := &httputil.ReverseProxy{
+		Director:     director,
+		Transport:    transport,
+		ErrorHandler: upstreamErrorHandler(host),
+	}
+	if cfg := entry.Upstream; cfg != nil && cfg.Host != "" && cfg.RewriteHost {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			rewriteUpstreamHost(resp, cfg, host)
+			return nil
 		}
 	}
+	return proxy
 }
 
 func handleClient(conn net.Conn, requiredToken string, controlPort int, debug bool) {
@@ -421,6 +287,7 @@ func handleClient(conn net.Conn, requiredToken string, controlPort int, debug bo
 
 	if string(buf) != requiredToken {
 		log.Printf("Invalid token from %s", conn.RemoteAddr())
+		recordAudit(tunnel.AuditEntry{Action: "connect", Actor: auditActor(conn.RemoteAddr().String()), Addr: conn.RemoteAddr().String(), Error: "invalid token"})
 		conn.Close()
 		return
 	}
@@ -444,21 +311,10 @@ func handleClient(conn net.Conn, requiredToken string, controlPort int, debug bo
 	log.Printf("Control stream established")
 
 	client := NewClientSession(conn, session, controlStream, controlPort, debug)
+	client.audit("connect", "", "", nil)
 	client.HandleControlLoop()
 }
 
-func isBinary(data []byte) bool {
-	if len(data) > 512 {
-		data = data[:512]
-	}
-	for _, b := range data {
-		if b == 0 {
-			return true
-		}
-	}
-	return false
-}
-
 type QuietWriter struct{}
 
 func (w *QuietWriter) Write(p []byte) (n int, err error) {
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"tunnelcow/internal/tunnel"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Headers describing the verified client certificate. Incoming copies are
+// removed on mTLS domains.
+var clientCertHeaders = []string{"X-Client-Cert-Subject", "X-Client-Cert-Issuer", "X-Client-Cert-SAN", "X-Client-Cert-Fingerprint"}
+
+var clientCAPools = struct {
+	mu    sync.Mutex
+	pools map[[32]byte]*x509.CertPool
+}{pools: make(map[[32]byte]*x509.CertPool)}
+
+func clientCAPool(bundle string) *x509.CertPool {
+	sum := sha256.Sum256([]byte(bundle))
+
+	clientCAPools.mu.Lock()
+	defer clientCAPools.mu.Unlock()
+	if pool, ok := clientCAPools.pools[sum]; ok {
+		return pool
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(bundle))
+	clientCAPools.pools[sum] = pool
+	return pool
+}
+
+// clientAuthConfig returns a GetConfigForClient hook that asks for client
+// certificates only on mTLS domains, so every other domain on :443 keeps
+// working without one. ACME challenge handshakes are never asked.
+func clientAuthConfig(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return nil, nil
+		}
+		host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		entry, ok := serverDomains.Get(host)
+		if !ok || entry.MTLS == nil {
+			return nil, nil
+		}
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = clientCAPool(entry.MTLS.CA)
+		return cfg, nil
+	}
+}
+
+// certSANs lists the DNS, email, URI and IP names of cert.
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+func clientCertAllowed(cfg *tunnel.MTLSConfig, cert *x509.Certificate) bool {
+	if len(cfg.AllowedSubjects) == 0 && len(cfg.AllowedSANs) == 0 {
+		return true
+	}
+	subject := cert.Subject.String()
+	for _, s := range cfg.AllowedSubjects {
+		if s == subject || s == cert.Subject.CommonName {
+			return true
+		}
+	}
+	for _, san := range certSANs(cert) {
+		if slices.Contains(cfg.AllowedSANs, san) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyClientCert verifies the peer certificate against the domain's
+// current CA bundle. The handshake's own chains can't be trusted alone: a
+// resumed session carries the chains verified when the ticket was issued,
+// possibly under a CA that has since been removed.
+func verifyClientCert(state *tls.ConnectionState, cfg *tunnel.MTLSConfig) *x509.Certificate {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	cert := state.PeerCertificates[0]
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         clientCAPool(cfg.CA),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		if GlobalDebug {
+			log.Printf("[MTLS] Client certificate %q failed verification: %v", cert.Subject.String(), err)
+		}
+		return nil
+	}
+	return cert
+}
+
+// requireClientCert checks the client certificate and passes its identity
+// to the upstream. Requests reusing a connection negotiated for another name
+// (HTTP/2 coalescing) never had a certificate asked for, so they are sent
+// back with 421 to open their own.
+func requireClientCert(w http.ResponseWriter, r *http.Request, domain string, cfg *tunnel.MTLSConfig) bool {
+	for _, h := range clientCertHeaders {
+		r.Header.Del(h)
+	}
+
+	if r.TLS == nil || !strings.EqualFold(strings.TrimSuffix(r.TLS.ServerName, "."), domain) {
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+		return false
+	}
+	cert := verifyClientCert(r.TLS, cfg)
+	if cert == nil {
+		http.Error(w, "A valid client certificate is required", http.StatusForbidden)
+		return false
+	}
+
+	if !clientCertAllowed(cfg, cert) {
+		if GlobalDebug {
+			log.Printf("[MTLS] Rejected certificate %q for %s", cert.Subject.String(), domain)
+		}
+		http.Error(w, "This client certificate is not allowed", http.StatusForbidden)
+		return false
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set("X-Client-Cert-Subject", cert.Subject.String())
+	r.Header.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	if sans := certSANs(cert); len(sans) > 0 {
+		r.Header.Set("X-Client-Cert-SAN", strings.Join(sans, ","))
+	}
+	r.Header.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(fingerprint[:]))
+	setAccessUser(r, cert.Subject.CommonName)
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate for name, self-signed when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, usage ...x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  usage,
+	}
+	signer, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+}
+
+func TestRequireClientCertReverifies(t *testing.T) {
+	oldCA := newTestCert(t, "old CA", nil)
+	newCA := newTestCert(t, "new CA", nil)
+	client := newTestCert(t, "alice", oldCA, x509.ExtKeyUsageClientAuth)
+	server := newTestCert(t, "server", oldCA, x509.ExtKeyUsageServerAuth)
+
+	check := func(cfg *tunnel.MTLSConfig, peer *testCert) (*httptest.ResponseRecorder, *http.Request, bool) {
+		r := httptest.NewRequest("GET", "https://app.test/", nil)
+		r.Header.Set("X-Client-Cert-Subject", "CN=mallory")
+		// The chains a resumed session would carry from the original
+		// handshake, whatever the CA bundle says now.
+		r.TLS = &tls.ConnectionState{
+			ServerName:       "app.test",
+			PeerCertificates: []*x509.Certificate{peer.cert},
+			VerifiedChains:   [][]*x509.Certificate{{peer.cert, oldCA.cert}},
+		}
+		w := httptest.NewRecorder()
+		ok := requireClientCert(w, r, "app.test", cfg)
+		return w, r, ok
+	}
+
+	w, r, ok := check(&tunnel.MTLSConfig{CA: oldCA.pem()}, client)
+	if !ok {
+		t.Fatalf("certificate from the configured CA refused with %d", w.Code)
+	}
+	if got := r.Header.Get("X-Client-Cert-Subject"); got != "CN=alice" {
+		t.Errorf("X-Client-Cert-Subject = %q", got)
+	}
+
+	if w, _, ok := check(&tunnel.MTLSConfig{CA: newCA.pem()}, client); ok || w.Code != http.StatusForbidden {
+		t.Errorf("certificate from a removed CA: ok=%v status=%d, want 403", ok, w.Code)
+	}
+	if w, _, ok := check(&tunnel.MTLSConfig{CA: oldCA.pem()}, server); ok || w.Code != http.StatusForbidden {
+		t.Errorf("certificate without client auth usage: ok=%v status=%d, want 403", ok, w.Code)
+	}
+	if w, _, ok := check(&tunnel.MTLSConfig{CA: oldCA.pem(), AllowedSubjects: []string{"bob"}}, client); ok || w.Code != http.StatusForbidden {
+		t.Errorf("subject not allowed: ok=%v status=%d, want 403", ok, w.Code)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const (
+	oidcCallbackPath      = "/tunnelcow/oidc/callback"
+	oidcStateCookie       = "tc_oidc_state"
+	oidcStateTTL          = 10 * time.Minute
+	oidcDiscoveryTTL      = time.Hour
+	defaultOIDCSessionTTL = 12 * time.Hour
+)
+
+// Identity headers the edge sets for the upstream. Incoming copies are always
+// removed on OIDC domains so visitors can't forge them.
+var identityHeaders = []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Name", "X-Forwarded-Groups"}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	fetched time.Time
+}
+
+var oidcProviders = struct {
+	mu        sync.Mutex
+	providers map[string]*oidcProvider
+}{providers: make(map[string]*oidcProvider)}
+
+// oidcIdentity is what the session cookie remembers about a signed-in user.
+type oidcIdentity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+func discoverOIDC(issuer string) (*oidcProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	oidcProviders.mu.Lock()
+	p, ok := oidcProviders.providers[issuer]
+	oidcProviders.mu.Unlock()
+	if ok && time.Since(p.fetched) < oidcDiscoveryTTL {
+		return p, nil
+	}
+
+	resp, err := httpClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery for %s: %s", issuer, resp.Status)
+	}
+	p = &oidcProvider{}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, fmt.Errorf("discovery for %s: %v", issuer, err)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery for %s is missing endpoints", issuer)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery for %s names issuer %s", issuer, p.Issuer)
+	}
+	p.fetched = time.Now()
+
+	oidcProviders.mu.Lock()
+	oidcProviders.providers[issuer] = p
+	oidcProviders.mu.Unlock()
+	return p, nil
+}
+
+// sealCookie signs a JSON payload as "<base64>.<hmac>". kind keeps values
+// of one cookie from being replayed as another.
+func sealCookie(kind, secret string, v any) string {
+	payload, _ := json.Marshal(v)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(kind + "|" + encoded))
+	return encoded + "." + hex.EncodeToString(h.Sum(nil))
+}
+
+func openCookie(kind, secret, value string, v any) bool {
+	encoded, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(kind + "|" + encoded))
+	if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(h.Sum(nil)))) {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(payload, v) == nil
+}
+
+func oidcCookieName(domain string) string {
+	nameHash := sha256.Sum256([]byte(domain))
+	return "tc_oidc_" + hex.EncodeToString(nameHash[:])[:8]
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// oidcSession returns the identity from a valid session cookie. The cookie
+// is tied to the domain and issuer, so changing the issuer signs everyone out.
+func oidcSession(r *http.Request, domain string, cfg *tunnel.OIDCConfig, secret string) (*oidcIdentity, bool) {
+	cookie, err := r.Cookie(oidcCookieName(domain))
+	if err != nil {
+		return nil, false
+	}
+	var id oidcIdentity
+	if !openCookie("oidc|"+domain+"|"+cfg.Issuer+"|"+cfg.ClientID, secret, cookie.Value, &id) {
+		return nil, false
+	}
+	if time.Now().Unix() >= id.Expires || !id.allowedBy(cfg) {
+		return nil, false
+	}
+	return &id, true
+}
+
+// allowedBy applies the domain's allow lists. A user passes if any list
+// matches, and everyone passes when no list is set.
+func (id *oidcIdentity) allowedBy(cfg *tunnel.OIDCConfig) bool {
+	if len(cfg.AllowedEmails) == 0 && len(cfg.AllowedDomains) == 0 && len(cfg.AllowedGroups) == 0 {
+		return true
+	}
+	email := strings.ToLower(id.Email)
+	for _, e := range cfg.AllowedEmails {
+		if email != "" && strings.ToLower(e) == email {
+			return true
+		}
+	}
+	if _, emailDomain, ok := strings.Cut(email, "@"); ok {
+		for _, d := range cfg.AllowedDomains {
+			if strings.ToLower(strings.TrimPrefix(d, "@")) == emailDomain {
+				return true
+			}
+		}
+	}
+	for _, g := range cfg.AllowedGroups {
+		for _, have := range id.Groups {
+			if g == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setIdentityHeaders(r *http.Request, id *oidcIdentity) {
+	user := id.Email
+	if user == "" {
+		user = id.Subject
+	}
+	r.Header.Set("X-Forwarded-User", user)
+	if id.Email != "" {
+		r.Header.Set("X-Forwarded-Email", id.Email)
+	}
+	if id.Name != "" {
+		r.Header.Set("X-Forwarded-Name", id.Name)
+	}
+	if len(id.Groups) > 0 {
+		r.Header.Set("X-Forwarded-Groups", strings.Join(id.Groups, ","))
+	}
+}
+
+func stripIdentityHeaders(r *http.Request) {
+	for _, h := range identityHeaders {
+		r.Header.Del(h)
+	}
+}
+
+// startOIDCLogin sends the browser to the issuer. State, nonce and the PKCE
+// verifier travel in a short-lived signed cookie, so nothing is kept on the
+// server between the redirect and the callback.
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, domain string, cfg *tunnel.OIDCConfig, secret string) {
+	provider, err := discoverOIDC(cfg.Issuer)
+	if err != nil {
+		log.Printf("[OIDC] %s: %v", domain, err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	st := oidcState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		Return:   r.URL.RequestURI(),
+		Expires:  time.Now().Add(oidcStateTTL).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    sealCookie("oidc-state|"+domain, secret, st),
+		Path:     oidcCallbackPath,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+	})
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	scopes := append([]string{"openid", "email", "profile"}, cfg.Scopes...)
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {requestScheme(r) + "://" + r.Host + oidcCallbackPath},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target := provider.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOIDCCallback finishes the login: it redeems the code, checks the ID
+// token and, if the user is allowed, sets the session cookie.
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request, domain string, cfg *tunnel.OIDCConfig, secret string) {
+	var st oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || !openCookie("oidc-state|"+domain, secret, cookie.Value, &st) || time.Now().Unix() >= st.Expires {
+		http.Error(w, "Login session expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: oidcCallbackPath, MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	if !hmac.Equal([]byte(q.Get("state")), []byte(st.State)) {
+		http.Error(w, "Login state mismatch, please try again", http.StatusBadRequest)
+		return
+	}
+
+	id, err := redeemOIDCCode(r, cfg, q.Get("code"), st)
+	if err != nil {
+		log.Printf("[OIDC] %s: %v", domain, err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	if !id.allowedBy(cfg) {
+		if GlobalDebug {
+			log.Printf("[OIDC] %s: %s is not allowed", domain, id.Email)
+		}
+		http.Error(w, "Your account is not allowed to access "+domain, http.StatusForbidden)
+		return
+	}
+
+	ttl := defaultOIDCSessionTTL
+	if cfg.SessionTTL > 0 {
+		ttl = time.Duration(cfg.SessionTTL) * time.Second
+	}
+	id.Expires = time.Now().Add(ttl).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName(domain),
+		Value:    sealCookie("oidc|"+domain+"|"+cfg.Issuer+"|"+cfg.ClientID, secret, id),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(ttl.Seconds()),
+	})
+	if GlobalDebug {
+		log.Printf("[OIDC] %s signed in to %s", id.Subject, domain)
+	}
+
+	target := st.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, oidcCallbackPath) {
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func redeemOIDCCode(r *http.Request, cfg *tunnel.OIDCConfig, code string, st oidcState) (*oidcIdentity, error) {
+	if code == "" {
+		return nil, errors.New("no authorization code")
+	}
+	provider, err := discoverOIDC(cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {requestScheme(r) + "://" + r.Host + oidcCallbackPath},
+		"client_id":     {cfg.ClientID},
+		"code_verifier": {st.Verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("token exchange failed: %s %s", resp.Status, tok.Error)
+	}
+
+	claims, err := verifyJWT(tok.IDToken, func(kid string) (crypto.PublicKey, error) {
+		return jwksKey(provider.JWKSURI, kid)
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("id token: %v", err)
+	}
+	if claims.String("iss") != provider.Issuer {
+		return nil, fmt.Errorf("id token issued by %q", claims.String("iss"))
+	}
+	if !claims.HasAudience(cfg.ClientID) {
+		return nil, errors.New("id token is for another client")
+	}
+	if !hmac.Equal([]byte(claims.String("nonce")), []byte(st.Nonce)) {
+		return nil, errors.New("id token nonce mismatch")
+	}
+
+	id := &oidcIdentity{
+		Subject: claims.String("sub"),
+		Name:    claims.String("name"),
+	}
+	// Unverified addresses can't be used to match allow lists.
+	if verified, ok := claims["email_verified"].(bool); !ok || verified {
+		id.Email = claims.String("email")
+	}
+	groupsClaim := cfg.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	id.Groups = claims.Strings(groupsClaim)
+	if id.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return id, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const testSecret = "edge-secret"
+
+// mockIdP is an OpenID provider issuing RS256 ID tokens for codes handed
+// out by authorize.
+type mockIdP struct {
+	t            *testing.T
+	srv          *httptest.Server
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+	issuer       string
+
+	mu     sync.Mutex
+	codes  map[string]idpGrant
+	tokens int
+}
+
+type idpGrant struct {
+	challenge   string
+	redirectURI string
+	claims      map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, clientID: "tunnelcow", clientSecret: "s3cret", codes: make(map[string]idpGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.srv = httptest.NewServer(mux)
+	idp.issuer = idp.srv.URL
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.issuer,
+		"authorization_endpoint": idp.srv.URL + "/authorize",
+		"token_endpoint":         idp.srv.URL + "/token",
+		"jwks_uri":               idp.srv.URL + "/jwks",
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "k1",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+// authorize plays the user signing in at the authorization endpoint the
+// edge redirected to. claims are added to the ID token, and override the
+// defaults, including the nonce.
+func (idp *mockIdP) authorize(location string, claims map[string]any) url.Values {
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, idp.srv.URL+"/authorize?") {
+		idp.t.Fatalf("redirected to %q, not the IdP", location)
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != idp.clientID || q.Get("code_challenge_method") != "S256" {
+		idp.t.Fatalf("bad authorization request %v", q)
+	}
+	if !strings.Contains(" "+q.Get("scope")+" ", " openid ") {
+		idp.t.Fatalf("scope %q lacks openid", q.Get("scope"))
+	}
+
+	all := map[string]any{
+		"iss":   idp.issuer,
+		"aud":   idp.clientID,
+		"sub":   "user-1",
+		"email": "alice@example.com",
+		"name":  "Alice",
+		"nonce": q.Get("nonce"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	code := randomToken()
+	idp.mu.Lock()
+	idp.codes[code] = idpGrant{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), claims: all}
+	idp.mu.Unlock()
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id, secret, _ := r.BasicAuth()
+	idp.mu.Lock()
+	grant, ok := idp.codes[r.Form.Get("code")]
+	delete(idp.codes, r.Form.Get("code"))
+	idp.tokens++
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	switch {
+	case id != idp.clientID || secret != idp.clientSecret:
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	case !ok || r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("redirect_uri") != grant.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(grant.claims), "token_type": "Bearer"})
+}
+
+func (idp *mockIdP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (idp *mockIdP) config() *tunnel.OIDCConfig {
+	return &tunnel.OIDCConfig{Issuer: idp.srv.URL, ClientID: idp.clientID, ClientSecret: idp.clientSecret}
+}
+
+// authResult is what requireAuth did with one request.
+type authResult struct {
+	*httptest.ResponseRecorder
+	passed bool
+	req    *http.Request
+}
+
+func runAuth(entry DomainEntry, target string, cookies []*http.Cookie, header http.Header) authResult {
+	r := httptest.NewRequest("GET", "http://app.test"+target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	passed := requireAuth(w, r, "app.test", entry, testSecret)
+	return authResult{ResponseRecorder: w, passed: passed, req: r}
+}
+
+var browser = http.Header{"Accept": {"text/html"}}
+
+// oidcLogin runs the browser side of a sign-in up to the callback and
+// returns the callback's response.
+func oidcLogin(t *testing.T, idp *mockIdP, entry DomainEntry, claims map[string]any) authResult {
+	t.Helper()
+	start := runAuth(entry, "/private?x=1", nil, browser)
+	if start.passed || start.Code != http.StatusFound {
+		t.Fatalf("unauthenticated request: passed=%v status=%d", start.passed, start.Code)
+	}
+	params := idp.authorize(start.Header().Get("Location"), claims)
+	return runAuth(entry, oidcCallbackPath+"?"+params.Encode(), start.Result().Cookies(), browser)
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	entry := DomainEntry{OIDC: idp.config()}
+
+	cb := oidcLogin(t, idp, entry, nil)
+	if cb.passed || cb.Code != http.StatusSeeOther || cb.Header().Get("Location") != "/private?x=1" {
+		t.Fatalf("callback: passed=%v status=%d location=%q body=%q", cb.passed, cb.Code, cb.Header().Get("Location"), cb.Body)
+	}
+	var session *http.Cookie
+	for _, c := range cb.Result().Cookies() {
+		if c.Name == oidcCookieName("app.test") {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("no session cookie in %v", cb.Result().Cookies())
+	}
+
+	forged := http.Header{"X-Forwarded-User": {"mallory"}, "X-Forwarded-Groups": {"admins"}}
+	res := runAuth(entry, "/private", []*http.Cookie{session}, forged)
+	if !res.passed {
+		t.Fatalf("signed-in request refused with %d", res.Code)
+	}
+	if got := res.req.Header.Get("X-Forwarded-User"); got != "alice@example.com" {
+		t.Errorf("X-Forwarded-User = %q", got)
+	}
+	if got := res.req.Header.Get("X-Forwarded-Name"); got != "Alice" {
+		t.Errorf("X-Forwarded-Name = %q", got)
+	}
+	if got := res.req.Header.Get("X-Forwarded-Groups"); got != "" {
+		t.Errorf("forged X-Forwarded-Groups passed through as %q", got)
+	}
+
+	// The session belongs to this issuer and client; changing either signs
+	// everyone out.
+	other := DomainEntry{OIDC: idp.config()}
+	other.OIDC.ClientID = "another-client"
+	if res := runAuth(other, "/private", []*http.Cookie{session}, nil); res.passed {
+		t.Error("session accepted for another client ID")
+	}
+}
+
+func TestOIDCNonBrowserIsNotRedirected(t *testing.T) {
+	idp := newMockIdP(t)
+	res := runAuth(DomainEntry{OIDC: idp.config()}, "/api", nil, http.Header{"X-Forwarded-User": {"mallory"}})
+	if res.passed || res.Code != http.StatusUnauthorized {
+		t.Fatalf("passed=%v status=%d, want 401", res.passed, res.Code)
+	}
+	if res.req.Header.Get("X-Forwarded-User") != "" {
+		t.Error("forged identity header kept on a refused request")
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	idp := newMockIdP(t)
+	allowAlice := idp.config()
+	allowAlice.AllowedEmails = []string{"alice@example.com"}
+
+	for name, tc := range map[string]struct {
+		cfg    *tunnel.OIDCConfig
+		claims map[string]any
+		want   int
+	}{
+		"wrong nonce":       {idp.config(), map[string]any{"nonce": "replayed"}, http.StatusUnauthorized},
+		"wrong audience":    {idp.config(), map[string]any{"aud": "someone-else"}, http.StatusUnauthorized},
+		"wrong issuer":      {idp.config(), map[string]any{"iss": "https://evil.example"}, http.StatusUnauthorized},
+		"expired token":     {idp.config(), map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, http.StatusUnauthorized},
+		"no subject":        {idp.config(), map[string]any{"sub": ""}, http.StatusUnauthorized},
+		"not allowed":       {allowAlice, map[string]any{"email": "bob@example.com"}, http.StatusForbidden},
+		"unverified email":  {allowAlice, map[string]any{"email_verified": false}, http.StatusForbidden},
+		"allowed by domain": {&tunnel.OIDCConfig{Issuer: idp.srv.URL, ClientID: idp.clientID, ClientSecret: idp.clientSecret, AllowedDomains: []string{"example.com"}}, nil, http.StatusSeeOther},
+		"allowed by group":  {&tunnel.OIDCConfig{Issuer: idp.srv.URL, ClientID: idp.clientID, ClientSecret: idp.clientSecret, AllowedGroups: []string{"ops"}, GroupsClaim: "roles"}, map[string]any{"roles": []string{"dev", "ops"}}, http.StatusSeeOther},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := oidcLogin(t, idp, DomainEntry{OIDC: tc.cfg}, tc.claims)
+			if res.passed || res.Code != tc.want {
+				t.Errorf("callback: passed=%v status=%d, want %d (%s)", res.passed, res.Code, tc.want, strings.TrimSpace(res.Body.String()))
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackChecksStateAndVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	entry := DomainEntry{OIDC: idp.config()}
+
+	start := runAuth(entry, "/", nil, browser)
+	params := idp.authorize(start.Header().Get("Location"), nil)
+	stateCookies := start.Result().Cookies()
+
+	tampered := url.Values{"code": params["code"], "state": {"forged"}}
+	if res := runAuth(entry, oidcCallbackPath+"?"+tampered.Encode(), stateCookies, browser); res.Code != http.StatusBadRequest {
+		t.Errorf("forged state: status %d, want 400", res.Code)
+	}
+	if res := runAuth(entry, oidcCallbackPath+"?"+params.Encode(), nil, browser); res.Code != http.StatusBadRequest {
+		t.Errorf("missing state cookie: status %d, want 400", res.Code)
+	}
+
+	// A state cookie from another login carries another PKCE verifier, so
+	// the IdP refuses to redeem the code.
+	second := runAuth(entry, "/", nil, browser)
+	idp.authorize(second.Header().Get("Location"), nil)
+	q, _ := url.Parse(second.Header().Get("Location"))
+	swapped := url.Values{"code": params["code"], "state": {q.Query().Get("state")}}
+	if res := runAuth(entry, oidcCallbackPath+"?"+swapped.Encode(), second.Result().Cookies(), browser); res.Code != http.StatusUnauthorized {
+		t.Errorf("code redeemed with another login's verifier: status %d, want 401", res.Code)
+	}
+
+	if res := runAuth(entry, oidcCallbackPath+"?error=access_denied&state=x", stateCookies, browser); res.Code != http.StatusUnauthorized {
+		t.Errorf("IdP error: status %d, want 401", res.Code)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.issuer = "https://impostor.example"
+	res := runAuth(DomainEntry{OIDC: idp.config()}, "/", nil, browser)
+	if res.passed || res.Code != http.StatusBadGateway {
+		t.Fatalf("passed=%v status=%d, want 502", res.passed, res.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"tunnelcow/internal/tunnel"
+)
+
+const maxPageSize = 512 * 1024
+
+const errorPageHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>%d - %s</title>
+    <style>
+        body {
+            margin: 0;
+            padding: 0;
+            background: #09090b;
+            color: #e4e4e7;
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            height: 100vh;
+        }
+        .container {
+            text-align: center;
+            max-width: 420px;
+            padding: 20px;
+        }
+        .code {
+            font-family: "JetBrains Mono", monospace;
+            font-size: 48px;
+            font-weight: 700;
+            color: #3f3f46;
+            margin: 0 0 12px;
+        }
+        h1 {
+            font-size: 16px;
+            font-weight: 600;
+            margin: 0 0 10px;
+        }
+        p {
+            font-size: 14px;
+            color: #71717a;
+            margin: 0;
+            line-height: 1.5;
+        }
+        .footer {
+            margin-top: 32px;
+            font-size: 12px;
+            color: #52525b;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="code">%d</div>
+        <h1>%s</h1>
+        <p>%s</p>
+        <div class="footer">%s &middot; Powered by TunnelCow</div>
+    </div>
+</body>
+</html>`
+
+type pageInfo struct {
+	Status  int
+	Title   string
+	Message string
+}
+
+var defaultPages = map[string]pageInfo{
+	tunnel.PageOffline: {http.StatusServiceUnavailable, "Service Offline", "This site is temporarily unavailable. Please try again shortly."},
+	tunnel.Page408:     {http.StatusRequestTimeout, "Request Timeout", "The request took too long to arrive. Please try again."},
+	tunnel.Page413:     {http.StatusRequestEntityTooLarge, "Request Too Large", "The request body is larger than this site accepts."},
+	tunnel.Page431:     {http.StatusRequestHeaderFieldsTooLarge, "Headers Too Large", "The request headers are larger than this site accepts."},
+	tunnel.Page502:     {http.StatusBadGateway, "Bad Gateway", "The service behind this domain is not responding."},
+	tunnel.Page504:     {http.StatusGatewayTimeout, "Gateway Timeout", "The service behind this domain took too long to respond."},
+}
+
+type PageStore struct {
+	Dir string
+	Mu  sync.RWMutex
+
+	pages map[string]map[string][]byte
+}
+
+var serverPages = &PageStore{
+	Dir:   "data/pages",
+	pages: make(map[string]map[string][]byte),
+}
+
+func (ps *PageStore) path(domain, kind string) string {
+	return filepath.Join(ps.Dir, domain, kind+".html")
+}
+
+func validPageDomain(domain string) bool {
+	return domain != "" && !strings.ContainsAny(domain, `/\`) && !strings.Contains(domain, "..")
+}
+
+func (ps *PageStore) Set(domain, kind string, body []byte) error {
+	if !validPageDomain(domain) {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	if !tunnel.ValidPageKind(kind) {
+		return fmt.Errorf("unknown page kind %q", kind)
+	}
+	if len(body) > maxPageSize {
+		return fmt.Errorf("page too large (%d bytes, max %d)", len(body), maxPageSize)
+	}
+
+	ps.Mu.Lock()
+	defer ps.Mu.Unlock()
+
+	if len(body) == 0 {
+		delete(ps.pages[domain], kind)
+		os.Remove(ps.path(domain, kind))
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(ps.Dir, domain), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(ps.path(domain, kind), body, 0644); err != nil {
+		return err
+	}
+	if ps.pages[domain] == nil {
+		ps.pages[domain] = make(map[string][]byte)
+	}
+	ps.pages[domain][kind] = body
+	return nil
+}
+
+func (ps *PageStore) Get(domain, kind string) ([]byte, bool) {
+	ps.Mu.RLock()
+	if body, ok := ps.pages[domain][kind]; ok {
+		ps.Mu.RUnlock()
+		return body, true
+	}
+	ps.Mu.RUnlock()
+
+	if !validPageDomain(domain) {
+		return nil, false
+	}
+	body, err := os.ReadFile(ps.path(domain, kind))
+	if err != nil {
+		return nil, false
+	}
+
+	ps.Mu.Lock()
+	if ps.pages[domain] == nil {
+		ps.pages[domain] = make(map[string][]byte)
+	}
+	ps.pages[domain][kind] = body
+	ps.Mu.Unlock()
+	return body, true
+}
+
+func (ps *PageStore) RemoveDomain(domain string) {
+	if !validPageDomain(domain) {
+		return
+	}
+	ps.Mu.Lock()
+	defer ps.Mu.Unlock()
+	delete(ps.pages, domain)
+	os.RemoveAll(filepath.Join(ps.Dir, domain))
+}
+
+// serveErrorPage writes the domain's uploaded page for kind, falling back to
+// the built-in one.
+func serveErrorPage(w http.ResponseWriter, domain, kind string) {
+	info := defaultPages[kind]
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if body, ok := serverPages.Get(domain, kind); ok {
+		w.WriteHeader(info.Status)
+		w.Write(body)
+		return
+	}
+
+	w.WriteHeader(info.Status)
+	fmt.Fprintf(w, errorPageHTML, info.Status, info.Title, info.Status, info.Title, info.Message, html.EscapeString(domain))
+}
+
+// upstreamErrorHandler replaces ReverseProxy's bare 502 with the domain's
+// 502 or 504 page depending on how the upstream failed, or the 408 or 413
+// page when it was the visitor's request body that broke a limit.
+func upstreamErrorHandler(host string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if kind := bodyErrorPage(r); kind != "" {
+			setBlockedBy(r, "limits")
+			serveErrorPage(w, host, kind)
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if GlobalDebug {
+			log.Printf("[EDGE] Upstream error for %s: %v", host, err)
+		}
+
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			serveErrorPage(w, host, tunnel.Page504)
+			return
+		}
+		serveErrorPage(w, host, tunnel.Page502)
+	}
+}
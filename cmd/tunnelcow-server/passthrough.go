@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const clientHelloTimeout = 10 * time.Second
+
+var errHelloRead = errors.New("client hello read")
+
+// sniListener sits in front of the TLS server on :443. It reads each
+// connection's ClientHello and hands connections for passthrough domains
+// straight to their tunnel; everything else is returned from Accept with the
+// peeked bytes replayed so the TLS server can terminate it as usual.
+type sniListener struct {
+	net.Listener
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// passthroughEntry keeps what the SNI router enforces for a passthrough
+// domain, its port and access list. Logins, limits and the other edge
+// settings need the server to terminate TLS, so they are dropped rather
+// than shown as protecting a domain they don't.
+func passthroughEntry(e DomainEntry) DomainEntry {
+	return DomainEntry{PublicPort: e.PublicPort, Mode: e.Mode, Access: e.Access}
+}
+
+func newSNIListener(ln net.Listener) *sniListener {
+	l := &sniListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			l.Close()
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+func (l *sniListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, peeked, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	wrapped := &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+
+	host := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if entry, ok := serverDomains.Get(host); ok && entry.Mode == "passthrough" {
+		if !accessAllowed(entry.Access, conn.RemoteAddr().String()) {
+			domainCounters(host).denied.Add(1)
+			logConnOpen(conn, host, host, 443, tunnel.StageAccess)
+			if GlobalDebug {
+				log.Printf("[ACL] Rejected %s for %s", conn.RemoteAddr(), host)
+			}
+			conn.Close()
+			return
+		}
+		session, ok := GlobalSessions.Pick(entry.PublicPort, sessionKey(conn.RemoteAddr().String()), 0)
+		if !ok {
+			logConnOpen(conn, host, host, 443, ruleOffline)
+			if GlobalDebug {
+				log.Printf("[EDGE] Passthrough for %s: port %d has no tunnel", host, entry.PublicPort)
+			}
+			conn.Close()
+			return
+		}
+		if GlobalDebug {
+			log.Printf("[EDGE] Passthrough %s -> :%d from %s", host, entry.PublicPort, conn.RemoteAddr())
+		}
+		session.proxyConnection(logConnOpen(wrapped, host, host, 443, ""), entry.PublicPort)
+		return
+	}
+
+	select {
+	case l.conns <- wrapped:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// peekServerName reads the ClientHello from conn and returns its SNI along
+// with every byte consumed, so the caller can replay them.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// readOnlyConn feeds the handshake parser without letting it answer the
+// client.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"tunnelcow/internal/tunnel"
+)
+
+// edgeRequest is what the pipeline stages know about the domain a request
+// is for.
+type edgeRequest struct {
+	Host   string
+	Entry  DomainEntry
+	Secret string
+}
+
+// A stage wraps the rest of a domain's pipeline. It either passes the request
+// on to next or answers it itself. Stages with nothing to do for the domain
+// return next unchanged.
+type stage func(e *edgeRequest, next http.Handler) http.Handler
+
+var edgeStages = map[string]stage{
+	tunnel.StageAccess:  accessStage,
+	tunnel.StageMTLS:    mtlsStage,
+	tunnel.StageLimit:   limitStage,
+	tunnel.StageShield:  shieldStage,
+	tunnel.StageAuth:    authStage,
+	tunnel.StageHeaders: headersStage,
+}
+
+func accessStage(e *edgeRequest, next http.Handler) http.Handler {
+	if e.Entry.Access == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accessAllowed(e.Entry.Access, r.RemoteAddr) {
+			denyAccess(w, e.Host, r.RemoteAddr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func mtlsStage(e *edgeRequest, next http.Handler) http.Handler {
+	if e.Entry.MTLS == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requireClientCert(w, r, e.Host, e.Entry.MTLS) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func limitStage(e *edgeRequest, next http.Handler) http.Handler {
+	if domainLimit(e.Entry) == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if applyRateLimit(w, r, e.Host, e.Entry) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// shieldStage answers challenge solutions posted to /tunnelcow and sends
+// visitors without a clearance cookie to the challenge. Domains without the
+// shield pass /tunnelcow through to their upstream like any other path.
+func shieldStage(e *edgeRequest, next http.Handler) http.Handler {
+	if !e.Entry.SmartShield {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tunnelcow" && r.Method == "POST" {
+			handleShieldVerify(w, r, e.Host, e.Entry, e.Secret)
+			return
+		}
+		if !validateShieldCookie(r, e.Host, e.Entry, e.Secret) {
+			serveChallengePage(w, r, e.Host, e.Entry, e.Secret)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authStage(e *edgeRequest, next http.Handler) http.Handler {
+	if e.Entry.TokenAuth == nil && !e.Entry.requiresLogin() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorizeRequest(w, r, e.Host, e.Entry, e.Secret) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// stageOrder is the domain's pipeline followed by any stages it left out, in
+// their default order.
+func (e DomainEntry) stageOrder() []string {
+	order := make([]string, 0, len(tunnel.DefaultPipeline))
+	for _, name := range e.Pipeline {
+		if _, ok := edgeStages[name]; ok && !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	for _, name := range tunnel.DefaultPipeline {
+		if !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// buildPipeline chains the domain's stages in front of final, inside the
+// response header rules. Each stage is noted as the request's blocking rule
+// while it runs, and the note is cleared once final is reached, so the access
+// log names the stage that answered a request itself.
+func buildPipeline(e *edgeRequest, final http.Handler) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setBlockedBy(r, "")
+		final.ServeHTTP(w, r)
+	})
+	order := e.Entry.stageOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		name, next := order[i], edgeStages[order[i]](e, h)
+		h = func(w http.ResponseWriter, r *http.Request) {
+			setBlockedBy(r, name)
+			next.ServeHTTP(w, r)
+		}
+	}
+	return withResponseHeaders(e, h)
+}
+
+// checkScheme keeps each domain on the listener its mode asks for: http-mode
+// domains are refused on :443 and the others are redirected there from :80.
+func checkScheme(w http.ResponseWriter, r *http.Request, entry DomainEntry) bool {
+	if r.TLS != nil {
+		if entry.Mode == "http" {
+			setBlockedBy(r, "scheme")
+			http.Error(w, "HTTPS not enabled for this domain", 403)
+			return false
+		}
+		return true
+	}
+	if entry.Mode == "http" {
+		return true
+	}
+
+	target := "https://" + r.Host + r.URL.Path
+	if len(r.URL.RawQuery) > 0 {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	return false
+}
+
+// edgeHandler serves mapped domains on both :80 and :443, running each
+// request through its domain's pipeline before the upstream proxy.
+func edgeHandler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		entry, ok := serverDomains.Get(host)
+		if !ok {
+			http.Error(w, "Domain not mapped", 404)
+			return
+		}
+		if r.TLS == nil && r.ProtoMajor == 2 && !entry.acceptsH2C() {
+			http.Error(w, "HTTP/2 cleartext not enabled for this domain", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		withAccessLog(w, r, host, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !checkScheme(w, r, entry) {
+				return
+			}
+			if !applyLimits(w, r, host, domainLimits(entry)) {
+				setBlockedBy(r, "limits")
+				return
+			}
+
+			e := &edgeRequest{Host: host, Entry: entry, Secret: secret}
+			buildPipeline(e, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serveUpstream(w, r, host, entry)
+			})).ServeHTTP(w, r)
+		}))
+	})
+}
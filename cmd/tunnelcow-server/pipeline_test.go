@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"tunnelcow/internal/tunnel"
+)
+
+// pipelineResult is what one request through buildPipeline did.
+type pipelineResult struct {
+	*httptest.ResponseRecorder
+	reached   *http.Request // the request as the upstream saw it, if it got there
+	blockedBy string
+}
+
+func runPipeline(host string, entry DomainEntry, r *http.Request) pipelineResult {
+	rec := &accessRecord{}
+	r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec))
+	res := pipelineResult{ResponseRecorder: httptest.NewRecorder()}
+	e := &edgeRequest{Host: host, Entry: entry, Secret: testSecret}
+	buildPipeline(e, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res.reached = r
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(res, r)
+	res.blockedBy = rec.blockedBy
+	return res
+}
+
+func edgeGet(host, path, remoteAddr string) *http.Request {
+	r := httptest.NewRequest("GET", "http://"+host+path, nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+func TestPipelineStageOrder(t *testing.T) {
+	saved := edgeStages
+	t.Cleanup(func() { edgeStages = saved })
+
+	var ran []string
+	edgeStages = make(map[string]stage)
+	for name := range saved {
+		edgeStages[name] = func(e *edgeRequest, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ran = append(ran, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	want := []string{tunnel.StageAuth, tunnel.StageAccess}
+	for _, name := range tunnel.DefaultPipeline {
+		if !slices.Contains(want, name) {
+			want = append(want, name)
+		}
+	}
+	entry := DomainEntry{Pipeline: []string{tunnel.StageAuth, "bogus", tunnel.StageAccess, tunnel.StageAuth}}
+	if got := entry.stageOrder(); !slices.Equal(got, want) {
+		t.Fatalf("stageOrder() = %v, want %v", got, want)
+	}
+
+	res := runPipeline("order.test", entry, edgeGet("order.test", "/", "192.0.2.1:1234"))
+	if res.reached == nil || !slices.Equal(ran, want) {
+		t.Fatalf("ran %v (upstream reached: %v), want %v", ran, res.reached != nil, want)
+	}
+	if res.blockedBy != "" {
+		t.Errorf("blockedBy = %q after reaching the upstream", res.blockedBy)
+	}
+
+	ran = nil
+	runPipeline("order.test", DomainEntry{}, edgeGet("order.test", "/", "192.0.2.1:1234"))
+	if !slices.Equal(ran, tunnel.DefaultPipeline) {
+		t.Errorf("default order ran %v, want %v", ran, tunnel.DefaultPipeline)
+	}
+}
+
+func TestPipelineShortCircuits(t *testing.T) {
+	sum := sha256.Sum256([]byte("k1"))
+	entry := DomainEntry{
+		Access:    &tunnel.AccessConfig{Deny: []string{"198.51.100.0/24"}},
+		TokenAuth: &tunnel.TokenAuthConfig{APIKeys: []tunnel.APIKey{{Name: "ci", Hash: hex.EncodeToString(sum[:])}}},
+	}
+
+	// A denied address is answered by the access stage, with or without a
+	// valid key, and never gets to auth or the upstream.
+	r := edgeGet("deny.test", "/", "198.51.100.7:1234")
+	r.Header.Set("X-API-Key", "k1")
+	res := runPipeline("deny.test", entry, r)
+	if res.Code != http.StatusForbidden || res.reached != nil || res.blockedBy != tunnel.StageAccess {
+		t.Errorf("denied address: status=%d reached=%v blockedBy=%q", res.Code, res.reached != nil, res.blockedBy)
+	}
+
+	// Reordered, auth answers first.
+	entry.Pipeline = []string{tunnel.StageAuth, tunnel.StageAccess}
+	res = runPipeline("deny.test", entry, edgeGet("deny.test", "/", "198.51.100.7:1234"))
+	if res.Code != http.StatusUnauthorized || res.reached != nil || res.blockedBy != tunnel.StageAuth {
+		t.Errorf("auth first: status=%d reached=%v blockedBy=%q", res.Code, res.reached != nil, res.blockedBy)
+	}
+
+	r = edgeGet("deny.test", "/", "192.0.2.1:1234")
+	r.Header.Set("X-API-Key", "k1")
+	res = runPipeline("deny.test", entry, r)
+	if res.reached == nil {
+		t.Fatalf("allowed address with a key: status=%d blockedBy=%q", res.Code, res.blockedBy)
+	}
+	if res.reached.Header.Get("X-API-Key") != "" {
+		t.Error("API key forwarded to the upstream")
+	}
+}
+
+func TestPipelineStages(t *testing.T) {
+	sum := sha256.Sum256([]byte("k1"))
+	for name, tc := range map[string]struct {
+		entry     DomainEntry
+		req       func(host string) *http.Request
+		repeat    int
+		want      int
+		blockedBy string
+		check     func(t *testing.T, res pipelineResult)
+	}{
+		"no stages": {
+			entry: DomainEntry{},
+			want:  http.StatusOK,
+		},
+		"access allows": {
+			entry: DomainEntry{Access: &tunnel.AccessConfig{Allow: []string{"192.0.2.0/24"}}},
+			want:  http.StatusOK,
+		},
+		"access denies": {
+			entry:     DomainEntry{Access: &tunnel.AccessConfig{Allow: []string{"203.0.113.0/24"}}},
+			want:      http.StatusForbidden,
+			blockedBy: tunnel.StageAccess,
+		},
+		"mtls without a certificate": {
+			entry:     DomainEntry{MTLS: &tunnel.MTLSConfig{CA: "none"}},
+			want:      http.StatusMisdirectedRequest,
+			blockedBy: tunnel.StageMTLS,
+		},
+		"limit": {
+			entry:     DomainEntry{Limiter: &tunnel.RateLimitConfig{Rate: 0.001, Burst: 2}},
+			repeat:    2,
+			want:      http.StatusTooManyRequests,
+			blockedBy: tunnel.StageLimit,
+		},
+		"shield challenges": {
+			entry:     DomainEntry{SmartShield: true},
+			want:      http.StatusServiceUnavailable,
+			blockedBy: tunnel.StageShield,
+		},
+		"shield verifies solutions": {
+			entry: DomainEntry{SmartShield: true},
+			req: func(host string) *http.Request {
+				r := httptest.NewRequest("POST", "http://"+host+"/tunnelcow", strings.NewReader("challenge=x&nonce=1"))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return r
+			},
+			want:      http.StatusForbidden,
+			blockedBy: tunnel.StageShield,
+		},
+		"shield off leaves /tunnelcow to the upstream": {
+			entry: DomainEntry{},
+			req: func(host string) *http.Request {
+				return httptest.NewRequest("POST", "http://"+host+"/tunnelcow", strings.NewReader("{}"))
+			},
+			want: http.StatusOK,
+		},
+		"auth refuses": {
+			entry:     DomainEntry{TokenAuth: &tunnel.TokenAuthConfig{APIKeys: []tunnel.APIKey{{Name: "ci", Hash: hex.EncodeToString(sum[:])}}}},
+			want:      http.StatusUnauthorized,
+			blockedBy: tunnel.StageAuth,
+		},
+		"headers": {
+			entry: DomainEntry{Headers: &tunnel.HeaderConfig{
+				Request:  []tunnel.HeaderRule{{Action: "set", Name: "X-Edge-Host", Value: "{host}"}},
+				Response: []tunnel.HeaderRule{{Action: "set", Name: "X-Served-By", Value: "edge"}},
+			}},
+			want: http.StatusOK,
+			check: func(t *testing.T, res pipelineResult) {
+				if got := res.reached.Header.Get("X-Edge-Host"); got == "" {
+					t.Error("request rule not applied")
+				}
+				if got := res.Header().Get("X-Served-By"); got != "edge" {
+					t.Errorf("X-Served-By = %q", got)
+				}
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			host := strings.NewReplacer(" ", "-", "/", "").Replace(name) + ".test"
+			req := tc.req
+			if req == nil {
+				req = func(host string) *http.Request { return edgeGet(host, "/", "192.0.2.1:1234") }
+			}
+			for range tc.repeat {
+				if res := runPipeline(host, tc.entry, req(host)); res.reached == nil {
+					t.Fatalf("request within the limit refused with %d", res.Code)
+				}
+			}
+			res := runPipeline(host, tc.entry, req(host))
+			if res.Code != tc.want || res.blockedBy != tc.blockedBy || (res.reached != nil) != (tc.blockedBy == "") {
+				t.Fatalf("status=%d blockedBy=%q reached=%v, want %d %q", res.Code, res.blockedBy, res.reached != nil, tc.want, tc.blockedBy)
+			}
+			if tc.check != nil {
+				tc.check(t, res)
+			}
+		})
+	}
+}
+
+func TestPipelineHeaderRules(t *testing.T) {
+	sum := sha256.Sum256([]byte("k1"))
+	entry := DomainEntry{
+		Access:    &tunnel.AccessConfig{Deny: []string{"198.51.100.0/24"}},
+		TokenAuth: &tunnel.TokenAuthConfig{APIKeys: []tunnel.APIKey{{Name: "ci", Hash: hex.EncodeToString(sum[:])}}},
+		Headers: &tunnel.HeaderConfig{
+			Request: []tunnel.HeaderRule{
+				{Action: "set", Name: "X-API-Key", Value: "k1"},
+				{Action: "set", Name: "X-Request-Id", Value: "{request_id}"},
+				{Action: "set", Name: "X-Path", Value: "{path}"},
+			},
+			Response: []tunnel.HeaderRule{{Action: "set", Name: "X-Request-Id", Value: "{request_id}"}},
+		},
+	}
+
+	// Request rules run after auth, so they can't supply the credentials.
+	res := runPipeline("rules.test", entry, edgeGet("rules.test", "/", "192.0.2.1:1234"))
+	if res.Code != http.StatusUnauthorized || res.reached != nil {
+		t.Fatalf("header rule satisfied auth: status=%d", res.Code)
+	}
+	if res.Header().Get("X-Request-Id") == "" {
+		t.Error("response rules skipped on the auth stage's page")
+	}
+
+	res = runPipeline("rules.test", entry, edgeGet("rules.test", "/", "198.51.100.7:1234"))
+	if res.Code != http.StatusForbidden || res.Header().Get("X-Request-Id") == "" {
+		t.Errorf("denied address: status=%d X-Request-Id=%q", res.Code, res.Header().Get("X-Request-Id"))
+	}
+
+	r := edgeGet("rules.test", "/a%0d%0aX-Injected:%201", "192.0.2.1:1234")
+	r.Header.Set("X-API-Key", "k1")
+	res = runPipeline("rules.test", entry, r)
+	if res.reached == nil {
+		t.Fatalf("authorized request refused with %d", res.Code)
+	}
+	if got, want := res.reached.Header.Get("X-Request-Id"), res.Header().Get("X-Request-Id"); got == "" || got != want {
+		t.Errorf("request ID %q upstream, %q in the response", got, want)
+	}
+	if got := res.reached.Header.Get("X-Path"); got != "/aX-Injected: 1" {
+		t.Errorf("X-Path = %q", got)
+	}
+}
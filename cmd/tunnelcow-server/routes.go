@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"tunnelcow/internal/tunnel"
+)
+
+// maxRouteRegexCache bounds the compiled patterns kept around. Patterns of
+// domains that were since edited or removed are dropped when it fills up.
+const maxRouteRegexCache = 1024
+
+var (
+	routeRegexCache   = make(map[string]*regexp.Regexp)
+	routeRegexCacheMu sync.Mutex
+)
+
+func routeRegex(expr string) *regexp.Regexp {
+	routeRegexCacheMu.Lock()
+	defer routeRegexCacheMu.Unlock()
+
+	if re, ok := routeRegexCache[expr]; ok {
+		return re
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.Printf("Invalid route regex %q: %v", expr, err)
+	}
+	if len(routeRegexCache) >= maxRouteRegexCache {
+		clear(routeRegexCache)
+	}
+	routeRegexCache[expr] = re
+	return re
+}
+
+// matchRoute reports whether rule matches path and, if so, the length of the
+// leading part of path that StripPrefix would remove.
+func matchRoute(rule tunnel.RouteRule, path string) (bool, int) {
+	if rule.PathRegex != "" {
+		re := routeRegex(rule.PathRegex)
+		if re == nil {
+			return false, 0
+		}
+		loc := re.FindStringIndex(path)
+		if loc == nil {
+			return false, 0
+		}
+		if loc[0] != 0 {
+			return true, 0
+		}
+		return true, loc[1]
+	}
+
+	prefix := rule.PathPrefix
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return false, 0
+	}
+	// Prefixes match whole path segments: /api covers /api and /api/v1 but
+	// not /apiary.
+	if len(path) > len(prefix) && !strings.HasSuffix(prefix, "/") && path[len(prefix)] != '/' {
+		return false, 0
+	}
+	return true, len(prefix)
+}
+
+// resolveRoute picks the tunnel port for a request path. The returned rule is
+// nil when the domain's default port is used.
+func (e DomainEntry) resolveRoute(path string) (int, *tunnel.RouteRule, int) {
+	for i := range e.Routes {
+		if ok, n := matchRoute(e.Routes[i], path); ok {
+			return e.Routes[i].PublicPort, &e.Routes[i], n
+		}
+	}
+	return e.PublicPort, nil, 0
+}
+
+func stripPath(path string, n int) string {
+	path = path[n:]
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
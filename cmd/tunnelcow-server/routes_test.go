@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"tunnelcow/internal/tunnel"
+)
+
+func TestMatchRoutePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, path string
+		match        bool
+		stripped     string
+	}{
+		{"/api", "/api", true, "/"},
+		{"/api", "/api/", true, "/"},
+		{"/api", "/api/v1/users", true, "/v1/users"},
+		{"/api", "/apiary", false, ""},
+		{"/api", "/ap", false, ""},
+		{"/api/", "/api/v1", true, "/v1"},
+		{"/api/", "/api", false, ""},
+		{"/", "/anything", true, "/anything"},
+		{"/static.", "/static.css", false, ""},
+	} {
+		ok, n := matchRoute(tunnel.RouteRule{PathPrefix: tc.prefix, StripPrefix: true}, tc.path)
+		if ok != tc.match {
+			t.Errorf("prefix %q, path %q: match = %v, want %v", tc.prefix, tc.path, ok, tc.match)
+			continue
+		}
+		if ok {
+			if got := stripPath(tc.path, n); got != tc.stripped {
+				t.Errorf("prefix %q, path %q: stripped to %q, want %q", tc.prefix, tc.path, got, tc.stripped)
+			}
+		}
+	}
+}
@@ -1,33 +1,279 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"tunnelcow/internal/tunnel"
 )
 
+// SessionPool is the set of client sessions serving one public port. A port
+// bound without a balance config has exactly one member; ports bound with one
+// accept further clients that ask to balance the same port.
+type SessionPool struct {
+	Port     int
+	Policy   string
+	Listener net.Listener
+	Members  []*ClientSession
+	Config   tunnel.PortConfig
+
+	next atomic.Uint64
+}
+
+var errPortTaken = errors.New("port is already bound by another client")
+
 type SessionManager struct {
-	Mu       sync.RWMutex
-	Sessions map[int]*ClientSession
+	Mu    sync.RWMutex
+	Pools map[int]*SessionPool
 }
 
 var GlobalSessions = &SessionManager{
-	Sessions: make(map[int]*ClientSession),
+	Pools: make(map[int]*SessionPool),
 }
 
-func (sm *SessionManager) Register(publicPort int, session *ClientSession) {
+// Join adds session as a backend for publicPort, opening the public listener
+// for the first member. It fails if the port is held by a session that did
+// not opt into balancing.
+func (sm *SessionManager) Join(publicPort int, session *ClientSession, balance *tunnel.BalanceConfig) (net.Listener, error) {
 	sm.Mu.Lock()
 	defer sm.Mu.Unlock()
-	sm.Sessions[publicPort] = session
+
+	if pool, ok := sm.Pools[publicPort]; ok {
+		if pool.Policy == "" || balance == nil {
+			return nil, errPortTaken
+		}
+		if balance.Policy != "" && balance.Policy != pool.Policy {
+			log.Printf("[LB] Port %d already balances with %s, ignoring %s", publicPort, pool.Policy, balance.Policy)
+		}
+		pool.Members = append(pool.Members, session)
+		return pool.Listener, nil
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", publicPort))
+	if err != nil {
+		return nil, err
+	}
+	pool := &SessionPool{Port: publicPort, Listener: ln, Members: []*ClientSession{session}}
+	if balance != nil {
+		pool.Policy = balance.Policy
+		if pool.Policy == "" {
+			pool.Policy = tunnel.BalanceRoundRobin
+		}
+	}
+	sm.Pools[publicPort] = pool
+	go sm.acceptPublicConnections(pool)
+	return ln, nil
 }
 
-func (sm *SessionManager) Unregister(publicPort int) {
+// errSharedPool refuses to turn balancing off on a port other clients
+// still serve.
+var errSharedPool = errors.New("port is shared with other clients; remove the tunnel to leave the pool")
+
+// Rebalance changes the balance setting of a port session already serves.
+// The pool and its listener stay in place, so the port keeps its backends
+// throughout. A port shared with other clients keeps its policy, and
+// turning balancing off there returns errSharedPool.
+func (sm *SessionManager) Rebalance(publicPort int, session *ClientSession, balance *tunnel.BalanceConfig) error {
 	sm.Mu.Lock()
 	defer sm.Mu.Unlock()
-	delete(sm.Sessions, publicPort)
+
+	pool, ok := sm.Pools[publicPort]
+	if !ok || !slices.Contains(pool.Members, session) {
+		return fmt.Errorf("port %d is not bound by this client", publicPort)
+	}
+	if len(pool.Members) > 1 {
+		if balance == nil {
+			return errSharedPool
+		}
+		if balance.Policy != "" && balance.Policy != pool.Policy {
+			log.Printf("[LB] Port %d already balances with %s, ignoring %s", publicPort, pool.Policy, balance.Policy)
+		}
+		return nil
+	}
+
+	pool.Policy = ""
+	if balance != nil {
+		pool.Policy = balance.Policy
+		if pool.Policy == "" {
+			pool.Policy = tunnel.BalanceRoundRobin
+		}
+	}
+	return nil
 }
 
+// Leave removes session from publicPort's pool and closes the listener once
+// the last member is gone. Remaining members keep serving the port.
+func (sm *SessionManager) Leave(publicPort int, session *ClientSession) {
+	sm.Mu.Lock()
+	defer sm.Mu.Unlock()
+
+	pool, ok := sm.Pools[publicPort]
+	if !ok {
+		return
+	}
+	for i, m := range pool.Members {
+		if m == session {
+			pool.Members = append(pool.Members[:i:i], pool.Members[i+1:]...)
+			break
+		}
+	}
+	if len(pool.Members) == 0 {
+		pool.Listener.Close()
+		delete(sm.Pools, publicPort)
+	} else if GlobalDebug {
+		log.Printf("[LB] Session %d left port %d, %d backend(s) remain", session.ID, publicPort, len(pool.Members))
+	}
+}
+
+// Get returns a live session for publicPort using the port's policy.
 func (sm *SessionManager) Get(publicPort int) (*ClientSession, bool) {
+	return sm.Pick(publicPort, "", 0)
+}
+
+// Pick chooses a backend for publicPort. key is the visitor address used by
+// the sticky policy when there is no cookie; preferID, when it names a live
+// member, wins regardless of policy so sticky cookies keep their backend.
+func (sm *SessionManager) Pick(publicPort int, key string, preferID uint64) (*ClientSession, bool) {
+	sm.Mu.RLock()
+	defer sm.Mu.RUnlock()
+
+	pool, ok := sm.Pools[publicPort]
+	if !ok {
+		return nil, false
+	}
+
+	live := make([]*ClientSession, 0, len(pool.Members))
+	for _, m := range pool.Members {
+		if !m.Session.IsClosed() {
+			live = append(live, m)
+		}
+	}
+	if len(live) == 0 {
+		return nil, false
+	}
+	if len(live) == 1 {
+		return live[0], true
+	}
+
+	if preferID != 0 {
+		for _, m := range live {
+			if m.ID == preferID {
+				return m, true
+			}
+		}
+	}
+
+	switch pool.Policy {
+	case tunnel.BalanceLeastConn:
+		// Ties rotate so idle backends share sequential traffic.
+		start := int(pool.next.Add(1) % uint64(len(live)))
+		best := live[start]
+		for i := 1; i < len(live); i++ {
+			if m := live[(start+i)%len(live)]; m.active.Load() < best.active.Load() {
+				best = m
+			}
+		}
+		return best, true
+	case tunnel.BalanceSticky:
+		if key != "" {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return live[h.Sum32()%uint32(len(live))], true
+		}
+	}
+	return live[pool.next.Add(1)%uint64(len(live))], true
+}
+
+// Policy returns the balancing policy of publicPort, or "" when unbalanced.
+func (sm *SessionManager) Policy(publicPort int) string {
 	sm.Mu.RLock()
 	defer sm.Mu.RUnlock()
-	sess, ok := sm.Sessions[publicPort]
-	return sess, ok
+	if pool, ok := sm.Pools[publicPort]; ok {
+		return pool.Policy
+	}
+	return ""
+}
+
+// ServedByOthers reports whether publicPort has a member other than session.
+func (sm *SessionManager) ServedByOthers(publicPort int, session *ClientSession) bool {
+	sm.Mu.RLock()
+	defer sm.Mu.RUnlock()
+	if pool, ok := sm.Pools[publicPort]; ok {
+		for _, m := range pool.Members {
+			if m != session {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetConfig replaces the edge settings of publicPort.
+func (sm *SessionManager) SetConfig(publicPort int, cfg tunnel.PortConfig) bool {
+	sm.Mu.Lock()
+	defer sm.Mu.Unlock()
+	pool, ok := sm.Pools[publicPort]
+	if ok {
+		pool.Config = cfg
+	}
+	return ok
+}
+
+func (sm *SessionManager) portConfig(pool *SessionPool) tunnel.PortConfig {
+	sm.Mu.RLock()
+	defer sm.Mu.RUnlock()
+	return pool.Config
+}
+
+func (sm *SessionManager) acceptPublicConnections(pool *SessionPool) {
+	for {
+		conn, err := pool.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		cfg := sm.portConfig(pool)
+		if !accessAllowed(cfg.Access, conn.RemoteAddr().String()) {
+			portCounters(pool.Port).denied.Add(1)
+			logConnOpen(conn, portLogName(pool.Port), "", pool.Port, tunnel.StageAccess)
+			if GlobalDebug {
+				log.Printf("[ACL] Rejected %s on port %d", conn.RemoteAddr(), pool.Port)
+			}
+			conn.Close()
+			continue
+		}
+		if cfg.ConnLimit != nil && cfg.ConnLimit.Rate > 0 {
+			key := fmt.Sprintf("port:%d|%s", pool.Port, sessionKey(conn.RemoteAddr().String()))
+			if !GlobalLimiter.Take(key, "", cfg.ConnLimit).Allowed {
+				portCounters(pool.Port).limited.Add(1)
+				logConnOpen(conn, portLogName(pool.Port), "", pool.Port, tunnel.StageLimit)
+				if GlobalDebug {
+					log.Printf("[LIMIT] Connection rate exceeded by %s on port %d", conn.RemoteAddr(), pool.Port)
+				}
+				conn.Close()
+				continue
+			}
+		}
+
+		session, ok := sm.Pick(pool.Port, sessionKey(conn.RemoteAddr().String()), 0)
+		if !ok {
+			logConnOpen(conn, portLogName(pool.Port), "", pool.Port, ruleOffline)
+			conn.Close()
+			continue
+		}
+		conn = logConnOpen(conn, portLogName(pool.Port), "", pool.Port, "")
+		go session.proxyConnection(conn, pool.Port)
+	}
+}
+
+func sessionKey(remoteAddr string) string {
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return ip
+	}
+	return remoteAddr
 }
@@ -2,10 +2,20 @@ package main
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"log"
+	"math/bits"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
 )
 
 const shieldHTML = `<!DOCTYPE html>
@@ -72,15 +82,85 @@ const shieldHTML = `<!DOCTYPE html>
 
     <script>
         const statusEl = document.getElementById('status');
-        
-        
-        setTimeout(() => {
+        const challenge = "{{CHALLENGE}}";
+        const difficulty = {{DIFFICULTY}};
+
+        const K = [
+            0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+            0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+            0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+            0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+            0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+            0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+            0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+            0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+        ];
+        const w = new Int32Array(64);
+
+        // sha256 of an ASCII string, as eight 32-bit words.
+        function sha256(text) {
+            const bytes = [];
+            for (let i = 0; i < text.length; i++) bytes.push(text.charCodeAt(i) & 0xff);
+            const bitLen = bytes.length * 8;
+            bytes.push(0x80);
+            while (bytes.length % 64 !== 56) bytes.push(0);
+            for (let i = 7; i >= 0; i--) bytes.push(i > 3 ? 0 : (bitLen >>> (i * 8)) & 0xff);
+
+            const h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+            for (let off = 0; off < bytes.length; off += 64) {
+                for (let i = 0; i < 16; i++) {
+                    const j = off + i * 4;
+                    w[i] = (bytes[j] << 24) | (bytes[j + 1] << 16) | (bytes[j + 2] << 8) | bytes[j + 3];
+                }
+                for (let i = 16; i < 64; i++) {
+                    const x = w[i - 15], y = w[i - 2];
+                    const s0 = ((x >>> 7) | (x << 25)) ^ ((x >>> 18) | (x << 14)) ^ (x >>> 3);
+                    const s1 = ((y >>> 17) | (y << 15)) ^ ((y >>> 19) | (y << 13)) ^ (y >>> 10);
+                    w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+                }
+                let [a, b, c, d, e, f, g, k] = h;
+                for (let i = 0; i < 64; i++) {
+                    const S1 = ((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7));
+                    const t1 = (k + S1 + ((e & f) ^ (~e & g)) + K[i] + w[i]) | 0;
+                    const S0 = ((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10));
+                    const t2 = (S0 + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+                    k = g; g = f; f = e; e = (d + t1) | 0; d = c; c = b; b = a; a = (t1 + t2) | 0;
+                }
+                h[0] = (h[0] + a) | 0; h[1] = (h[1] + b) | 0; h[2] = (h[2] + c) | 0; h[3] = (h[3] + d) | 0;
+                h[4] = (h[4] + e) | 0; h[5] = (h[5] + f) | 0; h[6] = (h[6] + g) | 0; h[7] = (h[7] + k) | 0;
+            }
+            return h;
+        }
+
+        function zeroBits(h) {
+            let n = 0;
+            for (const word of h) {
+                const z = Math.clz32(word);
+                n += z;
+                if (z < 32) break;
+            }
+            return n;
+        }
+
+        let nonce = 0;
+        function work() {
+            const end = nonce + 20000;
+            for (; nonce < end; nonce++) {
+                if (zeroBits(sha256(challenge + ":" + nonce)) >= difficulty) {
+                    return submit(nonce);
+                }
+            }
+            statusEl.innerText = "Verifying your browser... (" + Math.floor(nonce / 1000) + "k)";
+            setTimeout(work, 0);
+        }
+
+        function submit(solution) {
             fetch('/tunnelcow', {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/x-www-form-urlencoded'
                 },
-                body: 'domain=' + encodeURIComponent(window.location.hostname)
+                body: 'challenge=' + encodeURIComponent(challenge) + '&nonce=' + solution
             })
             .then(res => {
                 if (res.ok) {
@@ -94,42 +174,196 @@ const shieldHTML = `<!DOCTYPE html>
                 statusEl.innerText = "Connection error. Please refresh.";
                 statusEl.style.color = "#ef4444";
             });
-        }, 2000);
+        }
+
+        setTimeout(work, 50);
     </script>
 </body>
 </html>`
 
-func validateShieldCookie(r *http.Request, secret string) bool {
-	cookie, err := r.Cookie("tc_shield")
+const (
+	shieldCookie            = "tc_shield"
+	defaultShieldDifficulty = 18
+	defaultShieldTTL        = 24 * time.Hour
+	shieldChallengeTTL      = 5 * time.Minute
+)
+
+var shieldUsed = struct {
+	mu    sync.Mutex
+	nonce map[string]time.Time
+}{nonce: make(map[string]time.Time)}
+
+func shieldSettings(entry DomainEntry) (difficulty int, ttl time.Duration, bind string) {
+	difficulty, ttl, bind = defaultShieldDifficulty, defaultShieldTTL, "ip"
+	if cfg := entry.Shield; cfg != nil {
+		if cfg.Difficulty >= tunnel.MinShieldDifficulty && cfg.Difficulty <= tunnel.MaxShieldDifficulty {
+			difficulty = cfg.Difficulty
+		}
+		if cfg.TTL > 0 {
+			ttl = time.Duration(cfg.TTL) * time.Second
+		}
+		if cfg.Bind == "subnet" {
+			bind = "subnet"
+		}
+	}
+	return
+}
+
+// shieldBindKey is what clearance is tied to: the visitor IP without its
+// ephemeral port, or its subnet.
+func shieldBindKey(remoteAddr, bind string) string {
+	ip := sessionKey(remoteAddr)
+	if bind != "subnet" {
+		return ip
+	}
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return false
+		return ip
 	}
+	addr = addr.Unmap()
+	bitsLen := 24
+	if addr.Is6() {
+		bitsLen = 64
+	}
+	prefix, _ := addr.Prefix(bitsLen)
+	return prefix.String()
+}
 
+func shieldSign(kind, payload, secret string) string {
 	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(r.RemoteAddr + secret))
-	expected := hex.EncodeToString(h.Sum(nil))
+	h.Write([]byte(kind + "|" + payload))
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	return cookie.Value == expected
+// shieldToken encodes fields as "<base64 payload>.<signature>".
+func shieldToken(kind, secret string, fields ...string) string {
+	payload := strings.Join(fields, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + shieldSign(kind, payload, secret)
 }
 
-func serveChallengePage(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusServiceUnavailable)
+// parseShieldToken checks the signature and expiry (the last field) of a
+// token and returns its fields.
+func parseShieldToken(kind, token, secret string) ([]string, bool) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	payload := string(raw)
+	if !hmac.Equal([]byte(sig), []byte(shieldSign(kind, payload, secret))) {
+		return nil, false
+	}
+	fields := strings.Split(payload, "|")
+	expires, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, false
+	}
+	return fields, true
+}
+
+func validateShieldCookie(r *http.Request, host string, entry DomainEntry, secret string) bool {
+	cookie, err := r.Cookie(shieldCookie)
+	if err != nil {
+		return false
+	}
+	_, _, bind := shieldSettings(entry)
+
+	fields, ok := parseShieldToken("clearance", cookie.Value, secret)
+	if !ok || len(fields) != 3 {
+		return false
+	}
+	return fields[0] == host && fields[1] == shieldBindKey(r.RemoteAddr, bind)
+}
+
+func serveChallengePage(w http.ResponseWriter, r *http.Request, host string, entry DomainEntry, secret string) {
+	difficulty, _, bind := shieldSettings(entry)
+
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	expires := time.Now().Add(shieldChallengeTTL).Unix()
+	challenge := shieldToken("challenge", secret,
+		host, shieldBindKey(r.RemoteAddr, bind), strconv.Itoa(difficulty), hex.EncodeToString(nonce), strconv.FormatInt(expires, 10))
+
+	domainCounters(host).shieldIssued.Add(1)
+
+	page := strings.NewReplacer("{{CHALLENGE}}", challenge, "{{DIFFICULTY}}", strconv.Itoa(difficulty)).Replace(shieldHTML)
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, shieldHTML)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprint(w, page)
 }
 
-func handleShieldVerify(w http.ResponseWriter, r *http.Request, secret string) {
+// handleShieldVerify checks a proof-of-work solution and grants clearance.
+// Each challenge can be redeemed once, from the address it was issued to.
+func handleShieldVerify(w http.ResponseWriter, r *http.Request, host string, entry DomainEntry, secret string) {
+	counters := domainCounters(host)
+	_, ttl, bind := shieldSettings(entry)
+	bindKey := shieldBindKey(r.RemoteAddr, bind)
 
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(r.RemoteAddr + secret))
-	signature := hex.EncodeToString(h.Sum(nil))
+	r.ParseForm()
+	challenge := r.FormValue("challenge")
+	fields, ok := parseShieldToken("challenge", challenge, secret)
+	if !ok || len(fields) != 5 || fields[0] != host || fields[1] != bindKey {
+		counters.shieldFailed.Add(1)
+		http.Error(w, "Invalid or expired challenge", http.StatusForbidden)
+		return
+	}
+	difficulty, _ := strconv.Atoi(fields[2])
 
+	sum := sha256.Sum256([]byte(challenge + ":" + r.FormValue("nonce")))
+	if leadingZeroBits(sum[:]) < difficulty || !redeemShieldNonce(fields[3]) {
+		counters.shieldFailed.Add(1)
+		if GlobalDebug {
+			log.Printf("[SHIELD] Rejected solution from %s for %s", r.RemoteAddr, host)
+		}
+		http.Error(w, "Verification failed", http.StatusForbidden)
+		return
+	}
+
+	counters.shieldSolved.Add(1)
+	expires := time.Now().Add(ttl)
 	http.SetCookie(w, &http.Cookie{
-		Name:     "tc_shield",
-		Value:    signature,
+		Name:     shieldCookie,
+		Value:    shieldToken("clearance", secret, host, bindKey, strconv.FormatInt(expires.Unix(), 10)),
 		Path:     "/",
 		HttpOnly: true,
-		MaxAge:   3600 * 24,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(ttl.Seconds()),
 	})
 	w.WriteHeader(http.StatusOK)
 }
+
+func redeemShieldNonce(nonce string) bool {
+	shieldUsed.mu.Lock()
+	defer shieldUsed.mu.Unlock()
+
+	now := time.Now()
+	if _, used := shieldUsed.nonce[nonce]; used {
+		return false
+	}
+	if len(shieldUsed.nonce) >= 1024 {
+		for n, at := range shieldUsed.nonce {
+			if now.Sub(at) > shieldChallengeTTL {
+				delete(shieldUsed.nonce, n)
+			}
+		}
+	}
+	shieldUsed.nonce[nonce] = now
+	return true
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		z := bits.LeadingZeros8(b)
+		n += z
+		if z < 8 {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"tunnelcow/internal/tunnel"
+)
+
+const defaultAPIKeyHeader = "X-API-Key"
+
+var errNoCredentials = errors.New("no credentials")
+
+func apiKeyHeader(cfg *tunnel.TokenAuthConfig) string {
+	if cfg.APIKeyHeader != "" {
+		return cfg.APIKeyHeader
+	}
+	return defaultAPIKeyHeader
+}
+
+// checkToken validates the credentials on r against the domain's policy. It
+// returns errNoCredentials when the request carries none.
+func checkToken(r *http.Request, cfg *tunnel.TokenAuthConfig) (jwtClaims, error) {
+	if len(cfg.APIKeys) > 0 {
+		if key := r.Header.Get(apiKeyHeader(cfg)); key != "" {
+			sum := sha256.Sum256([]byte(key))
+			hash := hex.EncodeToString(sum[:])
+			for _, k := range cfg.APIKeys {
+				if subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) == 1 {
+					setAccessUser(r, k.Name)
+					return nil, nil
+				}
+			}
+			return nil, errors.New("invalid API key")
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !cfg.UsesJWT() || len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, errNoCredentials
+	}
+
+	claims, err := verifyJWT(strings.TrimSpace(auth[7:]), func(kid string) (crypto.PublicKey, error) {
+		if len(cfg.JWKS) > 0 {
+			return inlineKey(cfg.JWKS, kid)
+		}
+		return jwksKey(cfg.JWKSURL, kid)
+	}, cfg.Algorithms)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Issuer != "" && claims.String("iss") != cfg.Issuer {
+		return nil, errors.New("token has the wrong issuer")
+	}
+	if len(cfg.Audiences) > 0 {
+		matched := false
+		for _, aud := range cfg.Audiences {
+			if claims.HasAudience(aud) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, errors.New("token has the wrong audience")
+		}
+	}
+	return claims, nil
+}
+
+// tokenChallenge answers 401 with a WWW-Authenticate header describing what
+// the domain accepts.
+func tokenChallenge(w http.ResponseWriter, domain string, cfg *tunnel.TokenAuthConfig, err error) {
+	var challenges []string
+	if cfg.UsesJWT() {
+		c := fmt.Sprintf("Bearer realm=%q", domain)
+		if err != errNoCredentials {
+			c += fmt.Sprintf(", error=\"invalid_token\", error_description=%q", err.Error())
+		}
+		challenges = append(challenges, c)
+	}
+	if len(cfg.APIKeys) > 0 {
+		challenges = append(challenges, fmt.Sprintf("APIKey realm=%q, header=%q", domain, apiKeyHeader(cfg)))
+	}
+	for _, c := range challenges {
+		w.Header().Add("WWW-Authenticate", c)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// forwardClaims copies the configured claims to upstream headers. Headers
+// named in the policy are cleared first so they can't be forged.
+func forwardClaims(r *http.Request, cfg *tunnel.TokenAuthConfig, claims jwtClaims) {
+	for claim, header := range cfg.ForwardClaims {
+		r.Header.Del(header)
+		v, ok := claims[claim]
+		if !ok {
+			continue
+		}
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case []any:
+			value = strings.Join(claims.Strings(claim), ",")
+		default:
+			b, _ := json.Marshal(v)
+			value = string(b)
+		}
+		r.Header.Set(header, stripCRLF.Replace(value))
+	}
+}
+
+// authorizeRequest runs the domain's machine and login checks. A valid token
+// or API key lets the request through; without one, domains that also have a
+// login fall back to it. It returns false once it has answered the request.
+func authorizeRequest(w http.ResponseWriter, r *http.Request, domain string, entry DomainEntry, secret string) bool {
+	if cfg := entry.TokenAuth; cfg != nil {
+		claims, err := checkToken(r, cfg)
+		if err == nil {
+			// API keys are for the edge only; bearer tokens stay for the
+			// upstream to use.
+			if len(cfg.APIKeys) > 0 {
+				r.Header.Del(apiKeyHeader(cfg))
+			}
+			forwardClaims(r, cfg, claims)
+			if sub := claims.String("sub"); sub != "" {
+				setAccessUser(r, sub)
+			}
+			return true
+		}
+		if err != errNoCredentials || !entry.requiresLogin() {
+			if err != errNoCredentials && GlobalDebug {
+				log.Printf("[AUTH] Rejected credentials from %s for %s: %v", r.RemoteAddr, domain, err)
+			}
+			tokenChallenge(w, domain, cfg, err)
+			return false
+		}
+	}
+	if entry.requiresLogin() {
+		return requireAuth(w, r, domain, entry, secret)
+	}
+	return true
+}
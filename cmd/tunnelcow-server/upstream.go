@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tunnelcow/internal/tunnel"
+)
+
+const backendCookie = "tunnelcow_backend"
+
+var errNoBackend = errors.New("no client is serving this port")
+
+var (
+	upstreamTransports   = make(map[upstreamTransportKey]*http.Transport)
+	upstreamTransportsMu sync.Mutex
+)
+
+// upstreamScheme is the URL scheme the edge uses to reach the tunnel.
+func upstreamScheme(cfg *tunnel.UpstreamConfig) string {
+	if cfg != nil && cfg.Protocol == tunnel.UpstreamHTTPS {
+		return "https"
+	}
+	return "http"
+}
+
+// upstreamHost names the backend in the outgoing URL. Each session gets its
+// own host so the transport pools connections per client.
+func upstreamHost(session *ClientSession, port int) string {
+	return fmt.Sprintf("session-%d.tunnel:%d", session.ID, port)
+}
+
+// dialTunnel opens a stream to the session named by addr. If that session
+// has gone away, another backend of the port takes over.
+func dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(host, "session-"), ".tunnel"), 10, 64)
+
+	session, ok := GlobalSessions.Pick(port, "", id)
+	if !ok {
+		return nil, errNoBackend
+	}
+	if session.ID != id && GlobalDebug {
+		log.Printf("[LB] Session %d gone, failing over :%d to session %d", id, port, session.ID)
+	}
+	return session.openStream(port, "")
+}
+
+// pickBackend chooses the session that serves r. Under the sticky policy the
+// choice is pinned with a cookie and only moves if that session goes away.
+func pickBackend(w http.ResponseWriter, r *http.Request, port int) (*ClientSession, bool) {
+	if GlobalSessions.Policy(port) != tunnel.BalanceSticky {
+		return GlobalSessions.Get(port)
+	}
+
+	name := fmt.Sprintf("%s_%d", backendCookie, port)
+	var prefer uint64
+	if c, err := r.Cookie(name); err == nil {
+		prefer, _ = strconv.ParseUint(c.Value, 10, 64)
+	}
+
+	session, ok := GlobalSessions.Pick(port, sessionKey(r.RemoteAddr), prefer)
+	if ok && session.ID != prefer {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    strconv.FormatUint(session.ID, 10),
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return session, ok
+}
+
+// upstreamHostHeader is the Host the upstream sees: the override if one is
+// set, otherwise the public domain.
+func upstreamHostHeader(cfg *tunnel.UpstreamConfig, host string) string {
+	if cfg != nil && cfg.Host != "" {
+		return cfg.Host
+	}
+	return host
+}
+
+// rewriteUpstreamHost maps Location headers and cookie domains that name the
+// overridden upstream host back to the public domain.
+func rewriteUpstreamHost(resp *http.Response, cfg *tunnel.UpstreamConfig, host string) {
+	local := cfg.Host
+	localName := local
+	if h, _, err := net.SplitHostPort(local); err == nil {
+		localName = h
+	}
+
+	for _, name := range []string{"Location", "Content-Location"} {
+		v := resp.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || !strings.EqualFold(u.Host, local) {
+			continue
+		}
+		u.Host = host
+		if u.Scheme != "" {
+			u.Scheme = requestScheme(resp.Request)
+		}
+		resp.Header.Set(name, u.String())
+	}
+
+	cookies := resp.Header.Values("Set-Cookie")
+	for i, c := range cookies {
+		parts := strings.Split(c, ";")
+		for j, attr := range parts {
+			k, v, ok := strings.Cut(strings.TrimSpace(attr), "=")
+			if ok && strings.EqualFold(k, "domain") && strings.EqualFold(strings.TrimPrefix(strings.TrimSpace(v), "."), localName) {
+				parts[j] = " Domain=" + host
+			}
+		}
+		cookies[i] = strings.Join(parts, ";")
+	}
+}
+
+type upstreamTransportKey struct {
+	tunnel.UpstreamConfig
+	timeout time.Duration
+}
+
+// upstreamTransport returns a shared transport for cfg so connections to
+// the tunnel are pooled across requests. host is the default SNI for https
+// and timeout, if set, bounds the wait for response headers.
+func upstreamTransport(cfg *tunnel.UpstreamConfig, host string, timeout time.Duration) http.RoundTripper {
+	key := upstreamTransportKey{timeout: timeout}
+	if cfg != nil {
+		key.UpstreamConfig = *cfg
+	}
+	if key.Protocol == "" {
+		key.Protocol = tunnel.UpstreamHTTP1
+	}
+	if key.Protocol == tunnel.UpstreamHTTPS && key.SNI == "" {
+		key.SNI = host
+	}
+	if key.Protocol != tunnel.UpstreamHTTPS {
+		key.SNI = ""
+		key.InsecureSkipVerify = false
+	}
+	key.Host, key.RewriteHost = "", false
+
+	upstreamTransportsMu.Lock()
+	defer upstreamTransportsMu.Unlock()
+
+	if t, ok := upstreamTransports[key]; ok {
+		return t
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialTunnel
+	t.ResponseHeaderTimeout = timeout
+	switch key.Protocol {
+	case tunnel.UpstreamH2C:
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		t.Protocols = &protocols
+	case tunnel.UpstreamHTTPS:
+		t.ForceAttemptHTTP2 = true
+		t.TLSClientConfig = &tls.Config{
+			ServerName:         key.SNI,
+			InsecureSkipVerify: key.InsecureSkipVerify,
+		}
+	}
+	upstreamTransports[key] = t
+	return t
+}
+
+// acceptsH2C reports whether visitors may speak cleartext HTTP/2 to the
+// domain on :80, which only domains with an h2c upstream opt in to.
+func (e DomainEntry) acceptsH2C() bool {
+	return e.Upstream != nil && e.Upstream.Protocol == tunnel.UpstreamH2C
+}
@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultAuditLimit = 500
+
+// AuditEntry records one control-plane action. Actor names who acted (the
+// client's IP address on the server, "dashboard" on the client) and Addr
+// where they connected from. Error is set when the action was refused or failed.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Addr   string    `json:"addr,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// AuditQuery selects entries from Since up to, but not including, Until;
+// zero times leave that end open. At most Limit entries are returned
+// (default 500), newest first.
+type AuditQuery struct {
+	Since  time.Time `json:"since,omitzero"`
+	Until  time.Time `json:"until,omitzero"`
+	Action string    `json:"action,omitempty"`
+	Limit  int       `json:"limit,omitempty"`
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	return q.Action == "" || e.Action == q.Action
+}
+
+// AuditLog is an append-only JSON Lines file of AuditEntry records.
+type AuditLog struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Record stamps e with the current time and appends it to the log.
+func (l *AuditLog) Record(e AuditEntry) error {
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Query reads back the entries q selects.
+func (l *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	return l.Select(q, nil)
+}
+
+// Select reads back the entries q selects that keep, if set, also accepts.
+// The limit counts only the accepted entries.
+func (l *AuditLog) Select(q AuditQuery, keep func(AuditEntry) bool) ([]AuditEntry, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.Path)
+	if os.IsNotExist(err) {
+		return []AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var matched []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || !q.matches(e) || (keep != nil && !keep(e)) {
+			continue
+		}
+		matched = append(matched, e)
+		if len(matched) > 2*limit {
+			matched = append(matched[:0], matched[len(matched)-limit:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	out := make([]AuditEntry, len(matched))
+	for i, e := range matched {
+		out[len(matched)-1-i] = e
+	}
+	return out, nil
+}
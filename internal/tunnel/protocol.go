@@ -1,6 +1,18 @@
 package tunnel
 
-import "encoding/json"
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 const (
 	MsgTypeReqBind        = "REQ_BIND"
@@ -9,6 +21,17 @@ const (
 	MsgTypePing           = "PING"
 	MsgTypeReqDomainMap   = "REQ_DOMAIN_MAP"
 	MsgTypeReqDomainUnmap = "REQ_DOMAIN_UNMAP"
+	MsgTypeReqDomainPage  = "REQ_DOMAIN_PAGE"
+	MsgTypeReqCertUpload  = "REQ_CERT_UPLOAD"
+	MsgTypeReqCertDelete  = "REQ_CERT_DELETE"
+	MsgTypeReqCertAction  = "REQ_CERT_ACTION"
+	MsgTypeCertStatus     = "CERT_STATUS"
+	MsgTypeReqPortConfig  = "REQ_PORT_CONFIG"
+	MsgTypeEdgeStats      = "EDGE_STATS"
+	MsgTypeReqCachePurge  = "REQ_CACHE_PURGE"
+	MsgTypeReqAuditLog    = "REQ_AUDIT_LOG"
+	MsgTypeAuditLog       = "AUDIT_LOG"
+	MsgTypeBindStatus     = "BIND_STATUS"
 )
 
 type ControlMessage struct {
@@ -16,9 +39,48 @@ type ControlMessage struct {
 	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
+// ReqBindPayload binds a public port, or changes the balance setting of one
+// the client already holds. With an ID set the server answers with a
+// BIND_STATUS message carrying it.
 type ReqBindPayload struct {
-	PublicPort int `json:"public_port"`
-	LocalPort  int `json:"local_port"`
+	PublicPort int    `json:"public_port"`
+	LocalPort  int    `json:"local_port"`
+	ID         string `json:"id,omitempty"`
+
+	Balance *BalanceConfig `json:"balance,omitempty"`
+}
+
+type BindStatusPayload struct {
+	ID         string `json:"id"`
+	PublicPort int    `json:"public_port"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BalanceConfig lets several clients bind the same public port. The server
+// spreads HTTP requests and TCP connections across them with Policy:
+// "round_robin" (default), "least_conn", or "sticky" (a cookie for HTTP,
+// the visitor IP for TCP). Every client must send a BalanceConfig to share.
+type BalanceConfig struct {
+	Policy string `json:"policy,omitempty"`
+}
+
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceSticky     = "sticky"
+)
+
+func ValidBalancePolicy(p string) bool {
+	switch p {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceSticky:
+		return true
+	}
+	return false
+}
+
+type NewConnPayload struct {
+	PublicPort int    `json:"public_port"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
 }
 
 type ReqUnbindPayload struct {
@@ -29,20 +91,678 @@ type ReqDomainMapPayload struct {
 	Domain      string `json:"domain"`
 	PublicPort  int    `json:"public_port"`
 	Mode        string `json:"mode"`
-	AuthUser    string `json:"auth_user,omitempty"`
-	AuthPass    string `json:"auth_pass,omitempty"`
 	RateLimit   int    `json:"rate_limit,omitempty"`
 	SmartShield bool   `json:"smart_shield,omitempty"`
+	Maintenance bool   `json:"maintenance,omitempty"`
+
+	// AuthUser and AuthPass are the plaintext login of older clients. The
+	// server hashes them into Users on arrival.
+	AuthUser string `json:"auth_user,omitempty"`
+	AuthPass string `json:"auth_pass,omitempty"`
+
+	Pipeline    []string           `json:"pipeline,omitempty"`
+	Users       []DomainUser       `json:"users,omitempty"`
+	Inspect     *InspectConfig     `json:"inspect,omitempty"`
+	Routes      []RouteRule        `json:"routes,omitempty"`
+	Upstream    *UpstreamConfig    `json:"upstream,omitempty"`
+	Access      *AccessConfig      `json:"access,omitempty"`
+	Limiter     *RateLimitConfig   `json:"limiter,omitempty"`
+	Shield      *ShieldConfig      `json:"shield,omitempty"`
+	OIDC        *OIDCConfig        `json:"oidc,omitempty"`
+	TokenAuth   *TokenAuthConfig   `json:"token_auth,omitempty"`
+	MTLS        *MTLSConfig        `json:"mtls,omitempty"`
+	Headers     *HeaderConfig      `json:"headers,omitempty"`
+	Compression *CompressionConfig `json:"compression,omitempty"`
+	Cache       *CacheConfig       `json:"cache,omitempty"`
+	Limits      *LimitsConfig      `json:"limits,omitempty"`
+}
+
+// Edge pipeline stages. A domain's Pipeline lists them in the order they
+// run; stages it leaves out follow in DefaultPipeline order, so reordering
+// can never switch a check off. A stage the domain has no settings for does
+// nothing.
+const (
+	StageAccess  = "access"
+	StageMTLS    = "mtls"
+	StageLimit   = "limit"
+	StageShield  = "shield"
+	StageAuth    = "auth"
+	StageHeaders = "headers"
+)
+
+var DefaultPipeline = []string{StageAccess, StageMTLS, StageLimit, StageShield, StageAuth, StageHeaders}
+
+// ValidatePipeline checks that stages names known stages at most once each.
+func ValidatePipeline(stages []string) error {
+	seen := make(map[string]bool)
+	for _, st := range stages {
+		if !slices.Contains(DefaultPipeline, st) {
+			return fmt.Errorf("unknown pipeline stage %q", st)
+		}
+		if seen[st] {
+			return fmt.Errorf("pipeline stage %q is listed twice", st)
+		}
+		seen[st] = true
+	}
+	return nil
+}
+
+// DomainUser is a login for a protected domain. Hash is a bcrypt hash, so
+// the password itself never reaches the server. Expires is a Unix time after
+// which the login stops working; zero means never.
+type DomainUser struct {
+	Name    string `json:"name"`
+	Hash    string `json:"hash,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+func NewDomainUser(name, password string, expires int64) (DomainUser, error) {
+	if name == "" || password == "" {
+		return DomainUser{}, fmt.Errorf("username and password are required")
+	}
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return DomainUser{}, fmt.Errorf("username can't contain control characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return DomainUser{}, err
+	}
+	return DomainUser{Name: name, Hash: string(hash), Expires: expires}, nil
+}
+
+// Expired reports whether the login can no longer be used.
+func (u DomainUser) Expired() bool {
+	return u.Expires != 0 && time.Now().Unix() >= u.Expires
+}
+
+// RouteRule sends matching paths of a domain to another tunnel. Rules are
+// tried in order and the first match wins; unmatched requests go to the
+// domain's own PublicPort. A rule matches by PathPrefix or, if set,
+// PathRegex. StripPrefix removes the matched prefix before proxying.
+type RouteRule struct {
+	PathPrefix  string `json:"path_prefix,omitempty"`
+	PathRegex   string `json:"path_regex,omitempty"`
+	StripPrefix bool   `json:"strip_prefix,omitempty"`
+	PublicPort  int    `json:"public_port"`
+}
+
+// UpstreamConfig selects how the edge talks to a domain's tunnel. Protocol
+// is "http1" (default), "h2c" for cleartext HTTP/2 such as gRPC, or "https"
+// when the local service terminates TLS itself. SNI overrides the server name
+// sent and verified for https (defaults to the domain); InsecureSkipVerify
+// accepts self-signed backends.
+//
+// Host replaces the public domain in the Host header sent upstream, for dev
+// servers that only answer to e.g. "localhost:3000". With RewriteHost,
+// Location headers and cookie domains naming that host are mapped back to
+// the public domain in responses.
+type UpstreamConfig struct {
+	Protocol           string `json:"protocol,omitempty"`
+	SNI                string `json:"sni,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+
+	Host        string `json:"host,omitempty"`
+	RewriteHost bool   `json:"rewrite_host,omitempty"`
+}
+
+func (c *UpstreamConfig) Validate() error {
+	if !ValidUpstreamProtocol(c.Protocol) {
+		return fmt.Errorf("unknown upstream protocol %q", c.Protocol)
+	}
+	if c.Host != "" {
+		if u, err := url.Parse("http://" + c.Host); err != nil || u.Host != c.Host || u.User != nil {
+			return fmt.Errorf("invalid upstream host %q", c.Host)
+		}
+	}
+	return nil
+}
+
+const (
+	UpstreamHTTP1 = "http1"
+	UpstreamH2C   = "h2c"
+	UpstreamHTTPS = "https"
+)
+
+func ValidUpstreamProtocol(p string) bool {
+	switch p {
+	case "", UpstreamHTTP1, UpstreamH2C, UpstreamHTTPS:
+		return true
+	}
+	return false
+}
+
+// AccessConfig restricts who can reach a domain or public port. Entries are
+// CIDRs ("10.0.0.0/8") or single addresses. Deny wins over Allow; when Allow
+// is non-empty, only matching visitors get through.
+type AccessConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// ParseAccessEntry parses one AccessConfig entry.
+func ParseAccessEntry(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (a *AccessConfig) Validate() error {
+	for _, list := range [][]string{a.Allow, a.Deny} {
+		for _, entry := range list {
+			if _, err := ParseAccessEntry(entry); err != nil {
+				return fmt.Errorf("invalid address or CIDR %q", entry)
+			}
+		}
+	}
+	return nil
+}
+
+// RateLimitConfig is a token bucket: Rate tokens per second refill a bucket
+// of Burst (defaults to Rate, at least 1). Buckets are per domain and
+// visitor IP; By "path" or "header" (with Header set) splits them further.
+type RateLimitConfig struct {
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst,omitempty"`
+	By     string  `json:"by,omitempty"`
+	Header string  `json:"header,omitempty"`
+}
+
+func (c *RateLimitConfig) Validate() error {
+	if c.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst can't be negative")
+	}
+	switch c.By {
+	case "", "ip", "path":
+	case "header":
+		if c.Header == "" {
+			return fmt.Errorf("limiting by header needs a header name")
+		}
+	default:
+		return fmt.Errorf("unknown rate limit key %q", c.By)
+	}
+	return nil
+}
+
+// ShieldConfig tunes Smart Shield for a domain. Difficulty is the number of
+// leading zero bits the proof-of-work hash needs (default 18). Clearance
+// lasts TTL seconds (default one day) and is bound to the visitor's IP, or
+// to its /24 (IPv4) or /64 (IPv6) subnet when Bind is "subnet".
+type ShieldConfig struct {
+	Difficulty int    `json:"difficulty,omitempty"`
+	TTL        int    `json:"ttl,omitempty"`
+	Bind       string `json:"bind,omitempty"`
+}
+
+const (
+	MinShieldDifficulty = 8
+	MaxShieldDifficulty = 28
+)
+
+func (c *ShieldConfig) Validate() error {
+	if c.Difficulty != 0 && (c.Difficulty < MinShieldDifficulty || c.Difficulty > MaxShieldDifficulty) {
+		return fmt.Errorf("difficulty must be between %d and %d", MinShieldDifficulty, MaxShieldDifficulty)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("ttl can't be negative")
+	}
+	if c.Bind != "" && c.Bind != "ip" && c.Bind != "subnet" {
+		return fmt.Errorf("unknown shield binding %q", c.Bind)
+	}
+	return nil
+}
+
+// OIDCConfig puts a domain behind an OpenID Connect login. The edge runs the
+// authorization code flow against Issuer and admits users whose email, email
+// domain or group is allowed; with no allow lists, anyone who signs in gets
+// through. GroupsClaim names the ID token claim listing groups (default
+// "groups"). Sessions last SessionTTL seconds (default 12 hours).
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+
+	AllowedEmails  []string `json:"allowed_emails,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	AllowedGroups  []string `json:"allowed_groups,omitempty"`
+	GroupsClaim    string   `json:"groups_claim,omitempty"`
+	SessionTTL     int      `json:"session_ttl,omitempty"`
+}
+
+func (c *OIDCConfig) Validate() error {
+	u, err := url.Parse(c.Issuer)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("issuer must be an http(s) URL")
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("client id is required")
+	}
+	if c.SessionTTL < 0 {
+		return fmt.Errorf("session ttl can't be negative")
+	}
+	return nil
+}
+
+// TokenAuthConfig asks machine clients for credentials instead of showing a
+// login page. A request passes with a bearer JWT signed by a key from JWKSURL
+// or the inline JWKS (read from JWKSFile by the client), or with one of
+// APIKeys in APIKeyHeader (default X-API-Key). Issuer, Audiences and
+// Algorithms restrict which tokens are accepted. ForwardClaims maps token
+// claims to headers sent to the upstream.
+type TokenAuthConfig struct {
+	JWKSURL    string          `json:"jwks_url,omitempty"`
+	JWKSFile   string          `json:"jwks_file,omitempty"`
+	JWKS       json.RawMessage `json:"jwks,omitempty"`
+	Issuer     string          `json:"issuer,omitempty"`
+	Audiences  []string        `json:"audiences,omitempty"`
+	Algorithms []string        `json:"algorithms,omitempty"`
+
+	APIKeyHeader string   `json:"api_key_header,omitempty"`
+	APIKeys      []APIKey `json:"api_keys,omitempty"`
+
+	ForwardClaims map[string]string `json:"forward_claims,omitempty"`
+}
+
+// APIKey is a static key for TokenAuthConfig. Only the SHA-256 Hash of the
+// key is stored and sent; Key carries it from the dashboard until hashed.
+type APIKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// JWTAlgorithms are the signature algorithms the edge can verify.
+var JWTAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+func (c *TokenAuthConfig) UsesJWT() bool {
+	return c.JWKSURL != "" || len(c.JWKS) > 0
+}
+
+func (c *TokenAuthConfig) Validate() error {
+	if !c.UsesJWT() && len(c.APIKeys) == 0 {
+		return fmt.Errorf("token auth needs a JWKS or at least one API key")
+	}
+	if c.JWKSURL != "" {
+		if u, err := url.Parse(c.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("jwks url must be an http(s) URL")
+		}
+	}
+	if len(c.JWKS) > 0 {
+		var doc struct {
+			Keys []json.RawMessage `json:"keys"`
+		}
+		if err := json.Unmarshal(c.JWKS, &doc); err != nil || len(doc.Keys) == 0 {
+			return fmt.Errorf("jwks must be a JSON key set")
+		}
+	}
+	for _, alg := range c.Algorithms {
+		valid := false
+		for _, known := range JWTAlgorithms {
+			if alg == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unsupported JWT algorithm %q", alg)
+		}
+	}
+	for _, k := range c.APIKeys {
+		if k.Name == "" || len(k.Hash) != 64 {
+			return fmt.Errorf("every API key needs a name and key")
+		}
+	}
+	return nil
+}
+
+// MTLSConfig makes the edge demand a client certificate for a domain. CA is
+// a PEM bundle of the authorities that may issue them (the client loads it
+// from CAFile when set). When AllowedSubjects or AllowedSANs are given, the
+// certificate's subject (full DN or common name) or one of its DNS, email,
+// URI or IP SANs must be listed.
+type MTLSConfig struct {
+	CA     string `json:"ca,omitempty"`
+	CAFile string `json:"ca_file,omitempty"`
+
+	AllowedSubjects []string `json:"allowed_subjects,omitempty"`
+	AllowedSANs     []string `json:"allowed_sans,omitempty"`
+}
+
+func (c *MTLSConfig) Validate() error {
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(c.CA)) {
+		return fmt.Errorf("CA bundle has no PEM certificates")
+	}
+	return nil
+}
+
+// Header rule actions.
+const (
+	HeaderSet    = "set"
+	HeaderAdd    = "add"
+	HeaderRemove = "remove"
+)
+
+// HeaderVars are the placeholders header values may use. {request_id} is
+// the same for the request and response rules of one request.
+var HeaderVars = []string{"client_ip", "domain", "request_id", "scheme", "method", "path"}
+
+// HeaderRule sets, adds or removes one header. Value may contain
+// placeholders from HeaderVars in braces, e.g. "{client_ip}".
+type HeaderRule struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+}
+
+// HeaderConfig rewrites headers at the edge. Request rules apply before the
+// request is proxied; response rules apply to every response the edge sends
+// for the domain, including its own error pages.
+type HeaderConfig struct {
+	Request  []HeaderRule `json:"request,omitempty"`
+	Response []HeaderRule `json:"response,omitempty"`
+}
+
+// Headers the edge manages itself and that rules may not touch.
+var reservedHeaders = []string{"Host", "Connection", "Content-Length", "Transfer-Encoding", "Upgrade", "Te", "Trailer", "Keep-Alive", "Proxy-Connection"}
+
+func (c *HeaderConfig) Validate() error {
+	for _, rules := range [][]HeaderRule{c.Request, c.Response} {
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r HeaderRule) validate() error {
+	if r.Name == "" || strings.IndexFunc(r.Name, func(c rune) bool {
+		return c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+	}) >= 0 {
+		return fmt.Errorf("invalid header name %q", r.Name)
+	}
+	for _, h := range reservedHeaders {
+		if strings.EqualFold(r.Name, h) {
+			return fmt.Errorf("header %s can't be rewritten", h)
+		}
+	}
+	switch r.Action {
+	case HeaderSet, HeaderAdd:
+	case HeaderRemove:
+		return nil
+	default:
+		return fmt.Errorf("unknown header action %q", r.Action)
+	}
+	if strings.ContainsAny(r.Value, "\r\n") {
+		return fmt.Errorf("header %s: value can't contain line breaks", r.Name)
+	}
+	// Only {lowercase_word} is taken for a placeholder, so JSON and other
+	// braces in values are left alone.
+	rest := r.Value
+	for {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			return nil
+		}
+		rest = rest[i+1:]
+		j := strings.IndexByte(rest, '}')
+		if j < 0 {
+			return nil
+		}
+		name := rest[:j]
+		if name != "" && strings.Trim(name, "abcdefghijklmnopqrstuvwxyz_") == "" && !slices.Contains(HeaderVars, name) {
+			return fmt.Errorf("header %s: unknown placeholder {%s}", r.Name, name)
+		}
+	}
+}
+
+// CompressionConfig lets the edge gzip or deflate responses the upstream
+// sent uncompressed. Compression is off unless Enabled is set. Types lists
+// the media types to compress ("text/*" matches a whole family; a built-in
+// list of text formats when empty), responses declaring fewer than MinSize
+// bytes (default 1024) are left alone, and Level runs from 1 (fastest) to 9
+// (smallest), default 6.
+type CompressionConfig struct {
+	Enabled bool     `json:"enabled"`
+	Types   []string `json:"types,omitempty"`
+	MinSize int      `json:"min_size,omitempty"`
+	Level   int      `json:"level,omitempty"`
+}
+
+func (c *CompressionConfig) Validate() error {
+	if c.Level < 0 || c.Level > 9 {
+		return fmt.Errorf("compression level must be between 1 and 9")
+	}
+	if c.MinSize < 0 {
+		return fmt.Errorf("minimum compression size can't be negative")
+	}
+	for _, t := range c.Types {
+		if !strings.Contains(t, "/") {
+			return fmt.Errorf("invalid media type %q", t)
+		}
+	}
+	return nil
+}
+
+// CacheConfig lets the edge answer repeat requests for a domain from stored
+// copies of upstream responses. Caching is off unless Enabled is set.
+// Storage is "memory" (default) or "disk", which keeps bodies under
+// data/cache on the server. MaxSize caps what one domain may hold (default
+// 64 MiB) and MaxObject a single response (default 8 MiB). Freshness comes
+// from Cache-Control and Expires; DefaultTTL, in seconds, applies to
+// responses that carry neither, which are otherwise not kept.
+type CacheConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Storage    string `json:"storage,omitempty"`
+	MaxSize    int64  `json:"max_size,omitempty"`
+	MaxObject  int64  `json:"max_object,omitempty"`
+	DefaultTTL int    `json:"default_ttl,omitempty"`
+}
+
+const (
+	CacheMemory = "memory"
+	CacheDisk   = "disk"
+)
+
+func (c *CacheConfig) Validate() error {
+	if c.Storage != "" && c.Storage != CacheMemory && c.Storage != CacheDisk {
+		return fmt.Errorf("unknown cache storage %q", c.Storage)
+	}
+	if c.MaxSize < 0 || c.MaxObject < 0 || c.DefaultTTL < 0 {
+		return fmt.Errorf("cache sizes and TTL can't be negative")
+	}
+	if c.MaxSize > 0 && c.MaxObject > c.MaxSize {
+		return fmt.Errorf("max object size can't exceed the cache size")
+	}
+	return nil
+}
+
+// LimitsConfig overrides the server's request limits for one domain.
+// Timeouts are in seconds and sizes in bytes; 0 keeps the server-wide value
+// and -1 removes the limit. ReadTimeout covers reading the request body and
+// WriteTimeout writing the response, both counted from the end of the request
+// headers. UpstreamTimeout bounds the wait for the upstream's response
+// headers. MaxHeaderBytes can only tighten the server-wide cap, which applies
+// before the domain is known.
+type LimitsConfig struct {
+	ReadTimeout     int   `json:"read_timeout,omitempty"`
+	WriteTimeout    int   `json:"write_timeout,omitempty"`
+	UpstreamTimeout int   `json:"upstream_timeout,omitempty"`
+	MaxHeaderBytes  int   `json:"max_header_bytes,omitempty"`
+	MaxBodyBytes    int64 `json:"max_body_bytes,omitempty"`
+}
+
+func (c *LimitsConfig) Validate() error {
+	if c.ReadTimeout < -1 || c.WriteTimeout < -1 || c.UpstreamTimeout < -1 ||
+		c.MaxHeaderBytes < -1 || c.MaxBodyBytes < -1 {
+		return fmt.Errorf("limits must be positive, 0 to inherit or -1 for none")
+	}
+	return nil
+}
+
+// ReqCachePurgePayload drops cached responses of a domain: all of them when
+// Path is empty, those under a prefix when Path ends in "*", otherwise the
+// responses for that path with any query string.
+type ReqCachePurgePayload struct {
+	Domain string `json:"domain"`
+	Path   string `json:"path,omitempty"`
+}
+
+// ReqAuditLogPayload asks the server for its audit log. The reply is an
+// AUDIT_LOG message carrying the same ID.
+type ReqAuditLogPayload struct {
+	ID string `json:"id"`
+	AuditQuery
+}
+
+type AuditLogPayload struct {
+	ID      string       `json:"id"`
+	Entries []AuditEntry `json:"entries"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// PortConfig holds edge settings for a raw TCP public port. It is sent with
+// REQ_PORT_CONFIG after the port is bound and can be updated at any time.
+type PortConfig struct {
+	Access *AccessConfig `json:"access,omitempty"`
+
+	// ConnLimit caps new connections per visitor IP. By is ignored.
+	ConnLimit *RateLimitConfig `json:"conn_limit,omitempty"`
+}
+
+type ReqPortConfigPayload struct {
+	PublicPort int `json:"public_port"`
+	PortConfig
+}
+
+// EdgeCounters are cumulative counters the server keeps for a domain or
+// public port.
+type EdgeCounters struct {
+	Denied  uint64 `json:"denied,omitempty"`
+	Limited uint64 `json:"limited,omitempty"`
+
+	ShieldIssued uint64 `json:"shield_issued,omitempty"`
+	ShieldSolved uint64 `json:"shield_solved,omitempty"`
+	ShieldFailed uint64 `json:"shield_failed,omitempty"`
+
+	CacheHits   uint64 `json:"cache_hits,omitempty"`
+	CacheMisses uint64 `json:"cache_misses,omitempty"`
+	CacheBytes  int64  `json:"cache_bytes,omitempty"`
+}
+
+// EdgeStatsPayload is pushed periodically to each client for the domains and
+// ports it serves.
+type EdgeStatsPayload struct {
+	Domains map[string]EdgeCounters `json:"domains,omitempty"`
+	Ports   map[int]EdgeCounters    `json:"ports,omitempty"`
 }
 
 type ReqDomainUnmapPayload struct {
 	Domain string `json:"domain"`
 }
 
+// Error page kinds a domain can override. An empty HTML body in
+// ReqDomainPagePayload restores the built-in page.
 const (
-	MsgTypeInspectData = "INSPECT_DATA"
+	PageOffline = "offline"
+	Page408     = "408"
+	Page413     = "413"
+	Page431     = "431"
+	Page502     = "502"
+	Page504     = "504"
 )
 
+type ReqDomainPagePayload struct {
+	Domain string `json:"domain"`
+	Kind   string `json:"kind"`
+	HTML   string `json:"html,omitempty"`
+}
+
+func ValidPageKind(kind string) bool {
+	switch kind {
+	case PageOffline, Page408, Page413, Page431, Page502, Page504:
+		return true
+	}
+	return false
+}
+
+// ReqCertUploadPayload installs a PEM certificate chain and private key on
+// the server. Domain may be a wildcard such as "*.example.com".
+type ReqCertUploadPayload struct {
+	Domain  string `json:"domain"`
+	CertPEM string `json:"cert_pem"`
+	KeyPEM  string `json:"key_pem"`
+}
+
+type ReqCertDeletePayload struct {
+	Domain string `json:"domain"`
+}
+
+// Certificate actions for REQ_CERT_ACTION. List replies with every
+// certificate the server knows about; renew and revoke act on the ACME
+// certificate of one domain.
+const (
+	CertActionList   = "list"
+	CertActionRenew  = "renew"
+	CertActionRevoke = "revoke"
+)
+
+type ReqCertActionPayload struct {
+	Action string `json:"action"`
+	Domain string `json:"domain,omitempty"`
+}
+
+// CertInfo describes a certificate the server holds for a domain. Source is
+// "custom" for uploaded certificates and "acme" for issued ones. Error holds
+// the last issuance failure. Removed marks a certificate that is no longer
+// installed.
+type CertInfo struct {
+	Domain    string   `json:"domain"`
+	Source    string   `json:"source"`
+	Issuer    string   `json:"issuer,omitempty"`
+	DNSNames  []string `json:"dns_names,omitempty"`
+	NotBefore int64    `json:"not_before,omitempty"`
+	NotAfter  int64    `json:"not_after,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Removed   bool     `json:"removed,omitempty"`
+}
+
+// CertStatusPayload carries certificate updates. When Full is set it is the
+// complete list and replaces whatever the client had.
+type CertStatusPayload struct {
+	Certs []CertInfo `json:"certs"`
+	Full  bool       `json:"full,omitempty"`
+}
+
+const (
+	MsgTypeInspectData   = "INSPECT_DATA"
+	MsgTypeInspectStream = "INSPECT_STREAM"
+)
+
+// InspectConfig controls request capture for a domain. Capture is off unless
+// Enabled is set. SampleRate is the fraction of requests captured (0 or >= 1
+// captures everything) and Status restricts capture to matching response
+// codes, either exact ("404") or by class ("5xx").
+type InspectConfig struct {
+	Enabled    bool     `json:"enabled"`
+	SampleRate float64  `json:"sample_rate,omitempty"`
+	Status     []string `json:"status,omitempty"`
+}
+
 type InspectPayload struct {
 	ID         string            `json:"id"`
 	Timestamp  int64             `json:"timestamp"`
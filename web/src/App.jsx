@@ -80,7 +80,7 @@ function App() {
   const [activeTab, setActiveTab] = useState('tunnels');
   const [newTunnel, setNewTunnel] = useState({ public_port: '', local_port: '', protocol: 'TCP' });
   const [editTunnel, setEditTunnel] = useState(null);
-  const [newDomain, setNewDomain] = useState({ domain: '', target_port: '', mode: 'auto', auth_user: '', auth_pass: '', rate_limit: 0, smart_shield: false });
+  const [newDomain, setNewDomain] = useState({ domain: '', target_port: '', mode: 'auto', users: [], rate_limit: 0, smart_shield: false, inspect: null, upstream: null, access: null, burst: 0, shield: null, oidc: null, token_auth: null, mtls: null, headers: null, compression: null, cache: null, limits: null });
   const [isEditMode, setIsEditMode] = useState(false);
   const [data, setData] = useState([]);
   const [lastStats, setLastStats] = useState({ up: 0, down: 0, time: Date.now() });
@@ -391,17 +391,28 @@ function App() {
       domain: domainName,
       target_port: portData.public_port,
       mode: portData.mode || 'auto',
-      auth_user: portData.auth_user || '',
-      auth_pass: portData.auth_pass || '',
+      users: (portData.users || []).map(u => ({ name: u.name, password: '', expires: u.expires || 0 })),
       rate_limit: portData.rate_limit || 0,
-      smart_shield: portData.smart_shield || false
+      smart_shield: portData.smart_shield || false,
+      inspect: portData.inspect || null,
+      upstream: portData.upstream || null,
+      access: portData.access || null,
+      burst: portData.limiter?.burst || 0,
+      shield: portData.shield || null,
+      oidc: portData.oidc || null,
+      token_auth: portData.token_auth || null,
+      mtls: portData.mtls || null,
+      headers: portData.headers || null,
+      compression: portData.compression || null,
+      cache: portData.cache || null,
+      limits: portData.limits || null
     });
     setIsEditMode(true);
     window.scrollTo({ top: 0, behavior: 'smooth' });
   };
 
   const resetDomainForm = () => {
-    setNewDomain({ domain: '', target_port: '', mode: 'auto', auth_user: '', auth_pass: '', rate_limit: 0, smart_shield: false });
+    setNewDomain({ domain: '', target_port: '', mode: 'auto', users: [], rate_limit: 0, smart_shield: false, inspect: null, upstream: null, access: null, burst: 0, shield: null, oidc: null, token_auth: null, mtls: null, headers: null, compression: null, cache: null, limits: null });
     setIsEditMode(false);
   };
 
@@ -420,14 +431,28 @@ function App() {
           domain: newDomain.domain,
           public_port: port,
           mode: newDomain.mode,
-          auth_user: newDomain.auth_user,
-          auth_pass: newDomain.auth_pass,
+          users: newDomain.users.filter(u => u.name),
           rate_limit: parseInt(newDomain.rate_limit) || 0,
-          smart_shield: newDomain.smart_shield
+          smart_shield: newDomain.smart_shield,
+          shield: newDomain.shield || {},
+          oidc: newDomain.oidc || { issuer: '' },
+          token_auth: newDomain.token_auth || {},
+          mtls: newDomain.mtls || { ca: '' },
+          headers: {
+            request: (newDomain.headers?.request || []).filter(h => h.name),
+            response: (newDomain.headers?.response || []).filter(h => h.name)
+          },
+          inspect: newDomain.inspect || { enabled: false },
+          compression: newDomain.compression || { enabled: false },
+          cache: newDomain.cache || { enabled: false },
+          limits: newDomain.limits || {},
+          upstream: newDomain.upstream || { protocol: 'http1' },
+          access: newDomain.access || {},
+          limiter: { rate: parseInt(newDomain.rate_limit) || 0, burst: parseInt(newDomain.burst) || 0 }
         })
       });
       if (!res.ok) throw new Error(await res.text());
-      setNewDomain({ domain: '', target_port: '', mode: 'auto', auth_user: '', auth_pass: '', rate_limit: 0, smart_shield: false });
+      setNewDomain({ domain: '', target_port: '', mode: 'auto', users: [], rate_limit: 0, smart_shield: false, inspect: null, upstream: null, access: null, burst: 0, shield: null, oidc: null, token_auth: null, mtls: null, headers: null, compression: null, cache: null, limits: null });
       setIsEditMode(false);
       fetchStatus();
       addToast(`Mapped ${newDomain.domain}`, "success");
@@ -461,6 +486,20 @@ function App() {
     });
   };
 
+  const purgeCache = async (domain) => {
+    try {
+      const res = await fetch(`${API_BASE}/cache/purge`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ domain })
+      });
+      if (!res.ok) throw new Error(await res.text());
+      addToast(`Purged cache of ${domain}`, "success");
+    } catch (err) {
+      addToast("Failed to purge cache: " + err.message, "error");
+    }
+  };
+
   const replayLog = async (id) => {
     try {
       const res = await fetch(`${API_BASE}/replay`, {
@@ -485,6 +524,11 @@ function App() {
   const tunnelsArr = Object.entries(status.tunnels || {});
   const domainsArr = Object.entries(status.domains || {});
 
+  const certFor = (domain) => {
+    const certs = status.certs || {};
+    return certs[domain] || certs['*.' + domain.split('.').slice(1).join('.')];
+  };
+
 
 
 
@@ -779,7 +823,7 @@ function App() {
                           <span className="text-[10px] text-zinc-600 font-bold uppercase">Domain</span>
                           <span className="text-lg font-mono text-white flex items-center gap-2">
                             {domain} <Shield className="w-3 h-3 text-green-500" />
-                            {port && port.auth_user && (
+                            {port && port.users?.length > 0 && (
                               <div className="flex items-center gap-1 text-[10px] text-yellow-500 border border-yellow-900/50 bg-yellow-900/10 px-1.5 rounded">
                                 <Lock className="w-2 h-2" /> Secured
                               </div>
@@ -794,6 +838,11 @@ function App() {
                                 <Shield className="w-2 h-2" /> Electric Fence
                               </div>
                             )}
+                            {port && port.inspect && port.inspect.enabled && (
+                              <div className="flex items-center gap-1 text-[10px] text-sky-500 border border-sky-900/50 bg-sky-900/10 px-1.5 rounded">
+                                <Activity className="w-2 h-2" /> Inspect
+                              </div>
+                            )}
                           </span>
                         </div>
                         <ArrowUpRight className="text-zinc-800 w-4 h-4" />
@@ -809,9 +858,40 @@ function App() {
                                 {port.mode || 'AUTO'}
                               </span>
                             )}
+                            {port && typeof port === 'object' && port.mode !== 'http' && port.mode !== 'passthrough' && certFor(domain) && (() => {
+                              const cert = certFor(domain);
+                              if (cert.error) {
+                                return (
+                                  <span className="text-[10px] px-1.5 py-0.5 rounded border uppercase font-bold border-red-900 text-red-500 bg-red-950/20" title={cert.error}>
+                                    Cert Error
+                                  </span>
+                                );
+                              }
+                              const days = Math.floor((cert.not_after * 1000 - Date.now()) / 86400000);
+                              return (
+                                <span
+                                  className={clsx(
+                                    "text-[10px] px-1.5 py-0.5 rounded border uppercase font-bold",
+                                    days < 14 ? "border-amber-900 text-amber-500 bg-amber-950/20" : "border-zinc-700 text-zinc-500"
+                                  )}
+                                  title={`${cert.source} certificate, expires ${new Date(cert.not_after * 1000).toLocaleDateString()}`}
+                                >
+                                  Cert {days}d
+                                </span>
+                              );
+                            })()}
                           </span>
                         </div>
                       </div>
+                      {port?.cache?.enabled && (
+                        <button
+                          onClick={() => purgeCache(domain)}
+                          className="p-2 text-zinc-600 hover:text-white hover:bg-zinc-800 rounded-full transition-all"
+                          title="Purge Cache"
+                        >
+                          <RefreshCw className="w-4 h-4" />
+                        </button>
+                      )}
                       <button
                         onClick={() => handleEditDomain(domain, port)}
                         className="p-2 text-zinc-600 hover:text-white hover:bg-zinc-800 rounded-full transition-all"
@@ -877,24 +957,277 @@ function App() {
                   <label className="block text-[10px] uppercase text-zinc-500 font-bold mb-2 flex items-center gap-1">
                     <Lock className="w-3 h-3" /> Basic Auth (Optional)
                   </label>
-                  <div className="grid grid-cols-2 gap-2">
+                  {newDomain.users.map((user, i) => {
+                    const setUser = (patch) => setNewDomain({
+                      ...newDomain,
+                      users: newDomain.users.map((u, j) => j === i ? { ...u, ...patch } : u)
+                    });
+                    return (
+                      <div key={i} className="grid grid-cols-[1fr_1fr_1fr_auto] gap-2 mb-2">
+                        <input
+                          type="text"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          placeholder="Username"
+                          value={user.name}
+                          onChange={e => setUser({ name: e.target.value })}
+                          autoComplete="off"
+                        />
+                        <input
+                          type="password"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          placeholder={isEditMode ? "Unchanged" : "Password"}
+                          value={user.password}
+                          onChange={e => setUser({ password: e.target.value })}
+                          autoComplete="new-password"
+                        />
+                        <input
+                          type="date"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          title="Expires (optional)"
+                          value={user.expires ? new Date(user.expires * 1000).toISOString().slice(0, 10) : ''}
+                          onChange={e => setUser({ expires: e.target.value ? Math.floor(new Date(e.target.value).getTime() / 1000) : 0 })}
+                        />
+                        <button
+                          type="button"
+                          className="px-3 border border-zinc-800 text-zinc-500 hover:text-red-500 hover:border-red-900 rounded-sm"
+                          onClick={() => setNewDomain({ ...newDomain, users: newDomain.users.filter((_, j) => j !== i) })}
+                        >
+                          <Trash2 className="w-3 h-3" />
+                        </button>
+                      </div>
+                    );
+                  })}
+                  <button
+                    type="button"
+                    className="text-[10px] uppercase font-bold text-zinc-500 hover:text-white flex items-center gap-1"
+                    onClick={() => setNewDomain({ ...newDomain, users: [...newDomain.users, { name: '', password: '', expires: 0 }] })}
+                  >
+                    <Plus className="w-3 h-3" /> Add User
+                  </button>
+                </div>
+
+                <div className="border-t border-zinc-900 components-separator pt-4 mt-2">
+                  <label className="block text-[10px] uppercase text-zinc-500 font-bold mb-2 flex items-center gap-1">
+                    <Globe className="w-3 h-3" /> OpenID Connect (Optional)
+                  </label>
+                  <input
+                    type="text"
+                    className="w-full bg-black border border-zinc-800 p-3 mb-2 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                    placeholder="Issuer (https://accounts.google.com)"
+                    value={newDomain.oidc?.issuer || ''}
+                    onChange={e => setNewDomain({ ...newDomain, oidc: { ...(newDomain.oidc || {}), issuer: e.target.value } })}
+                  />
+                  {newDomain.oidc?.issuer && (
+                    <>
+                      <div className="grid grid-cols-2 gap-2 mb-2">
+                        <input
+                          type="text"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          placeholder="Client ID"
+                          value={newDomain.oidc.client_id || ''}
+                          onChange={e => setNewDomain({ ...newDomain, oidc: { ...newDomain.oidc, client_id: e.target.value } })}
+                        />
+                        <input
+                          type="password"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          placeholder={isEditMode ? "Client Secret (unchanged)" : "Client Secret"}
+                          value={newDomain.oidc.client_secret || ''}
+                          onChange={e => setNewDomain({ ...newDomain, oidc: { ...newDomain.oidc, client_secret: e.target.value } })}
+                          autoComplete="new-password"
+                        />
+                      </div>
+                      <div className="grid grid-cols-3 gap-2">
+                        {[['allowed_emails', 'Allowed Emails'], ['allowed_domains', 'Email Domains'], ['allowed_groups', 'Groups']].map(([key, label]) => (
+                          <input
+                            key={key}
+                            type="text"
+                            className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                            placeholder={label}
+                            value={(newDomain.oidc[key] || []).join(', ')}
+                            onChange={e => setNewDomain({
+                              ...newDomain,
+                              oidc: { ...newDomain.oidc, [key]: e.target.value.split(',').map(v => v.trim()).filter(Boolean) }
+                            })}
+                          />
+                        ))}
+                      </div>
+                      <p className="text-[10px] text-zinc-600 mt-1">* Redirect URI: https://{newDomain.domain || 'your-domain'}/tunnelcow/oidc/callback</p>
+                    </>
+                  )}
+                </div>
+
+                <div className="border-t border-zinc-900 components-separator pt-4 mt-2">
+                  <label className="block text-[10px] uppercase text-zinc-500 font-bold mb-2 flex items-center gap-1">
+                    <Code className="w-3 h-3" /> API Auth (Optional)
+                  </label>
+                  <div className="grid grid-cols-3 gap-2 mb-2">
+                    {[['jwks_url', 'JWKS URL'], ['issuer', 'Issuer']].map(([key, label]) => (
+                      <input
+                        key={key}
+                        type="text"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder={label}
+                        value={newDomain.token_auth?.[key] || ''}
+                        onChange={e => setNewDomain({ ...newDomain, token_auth: { ...(newDomain.token_auth || {}), [key]: e.target.value } })}
+                      />
+                    ))}
                     <input
                       type="text"
                       className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
-                      placeholder="Username"
-                      value={newDomain.auth_user}
-                      onChange={e => setNewDomain({ ...newDomain, auth_user: e.target.value })}
-                      autoComplete="off"
-                    />
-                    <input
-                      type="password"
-                      className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
-                      placeholder="Password"
-                      value={newDomain.auth_pass}
-                      onChange={e => setNewDomain({ ...newDomain, auth_pass: e.target.value })}
-                      autoComplete="new-password"
+                      placeholder="Audiences"
+                      value={(newDomain.token_auth?.audiences || []).join(', ')}
+                      onChange={e => setNewDomain({
+                        ...newDomain,
+                        token_auth: { ...(newDomain.token_auth || {}), audiences: e.target.value.split(',').map(v => v.trim()).filter(Boolean) }
+                      })}
                     />
                   </div>
+                  {(newDomain.token_auth?.api_keys || []).map((k, i) => {
+                    const keys = newDomain.token_auth.api_keys;
+                    const setKey = (patch) => setNewDomain({
+                      ...newDomain,
+                      token_auth: { ...newDomain.token_auth, api_keys: keys.map((x, j) => j === i ? { ...x, ...patch } : x) }
+                    });
+                    return (
+                      <div key={i} className="grid grid-cols-[1fr_2fr_auto] gap-2 mb-2">
+                        <input
+                          type="text"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          placeholder="Key name"
+                          value={k.name}
+                          onChange={e => setKey({ name: e.target.value })}
+                        />
+                        <input
+                          type="password"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          placeholder={isEditMode ? "Unchanged" : "Key"}
+                          value={k.key || ''}
+                          onChange={e => setKey({ key: e.target.value })}
+                          autoComplete="new-password"
+                        />
+                        <button
+                          type="button"
+                          className="px-3 border border-zinc-800 text-zinc-500 hover:text-red-500 hover:border-red-900 rounded-sm"
+                          onClick={() => setNewDomain({ ...newDomain, token_auth: { ...newDomain.token_auth, api_keys: keys.filter((_, j) => j !== i) } })}
+                        >
+                          <Trash2 className="w-3 h-3" />
+                        </button>
+                      </div>
+                    );
+                  })}
+                  <button
+                    type="button"
+                    className="text-[10px] uppercase font-bold text-zinc-500 hover:text-white flex items-center gap-1"
+                    onClick={() => setNewDomain({
+                      ...newDomain,
+                      token_auth: { ...(newDomain.token_auth || {}), api_keys: [...(newDomain.token_auth?.api_keys || []), { name: '', key: '' }] }
+                    })}
+                  >
+                    <Plus className="w-3 h-3" /> Add API Key
+                  </button>
+                </div>
+
+                <div className="border-t border-zinc-900 components-separator pt-4 mt-2">
+                  <label className="block text-[10px] uppercase text-zinc-500 font-bold mb-2 flex items-center gap-1">
+                    <Lock className="w-3 h-3" /> Client Certificates (Optional)
+                  </label>
+                  <div className="flex items-center gap-2 mb-2">
+                    <label className="px-3 py-2 border border-zinc-800 text-xs text-zinc-400 hover:text-white hover:border-zinc-600 rounded-sm cursor-pointer">
+                      {newDomain.mtls?.ca ? 'Replace CA Bundle' : 'Upload CA Bundle'}
+                      <input
+                        type="file"
+                        accept=".pem,.crt"
+                        className="hidden"
+                        onChange={async e => {
+                          const file = e.target.files[0];
+                          if (file) setNewDomain({ ...newDomain, mtls: { ...(newDomain.mtls || {}), ca: await file.text() } });
+                        }}
+                      />
+                    </label>
+                    {newDomain.mtls?.ca && (
+                      <button
+                        type="button"
+                        className="text-[10px] uppercase font-bold text-zinc-500 hover:text-red-500"
+                        onClick={() => setNewDomain({ ...newDomain, mtls: null })}
+                      >
+                        Remove
+                      </button>
+                    )}
+                  </div>
+                  {newDomain.mtls?.ca && (
+                    <div className="grid grid-cols-2 gap-2">
+                      {[['allowed_subjects', 'Allowed Subjects (CN)'], ['allowed_sans', 'Allowed SANs']].map(([key, label]) => (
+                        <input
+                          key={key}
+                          type="text"
+                          className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                          placeholder={label}
+                          value={(newDomain.mtls[key] || []).join(', ')}
+                          onChange={e => setNewDomain({
+                            ...newDomain,
+                            mtls: { ...newDomain.mtls, [key]: e.target.value.split(',').map(v => v.trim()).filter(Boolean) }
+                          })}
+                        />
+                      ))}
+                    </div>
+                  )}
+                </div>
+
+                <div className="border-t border-zinc-900 components-separator pt-4 mt-2">
+                  <label className="block text-[10px] uppercase text-zinc-500 font-bold mb-2 flex items-center gap-1">
+                    <Code className="w-3 h-3" /> Header Rules (Optional)
+                  </label>
+                  <p className="text-[10px] text-zinc-600 mb-2">Values may use {'{client_ip}'}, {'{domain}'}, {'{request_id}'}, {'{scheme}'}, {'{method}'} and {'{path}'}.</p>
+                  {['request', 'response'].map(dir => {
+                    const rules = newDomain.headers?.[dir] || [];
+                    const setRules = (next) => setNewDomain({ ...newDomain, headers: { ...(newDomain.headers || {}), [dir]: next } });
+                    return (
+                      <div key={dir} className="mb-2">
+                        {rules.map((rule, i) => (
+                          <div key={i} className="grid grid-cols-[auto_1fr_2fr_auto] gap-2 mb-2">
+                            <select
+                              className="bg-black border border-zinc-800 p-3 text-white focus:outline-none focus:border-white font-mono text-sm rounded-sm"
+                              value={rule.action}
+                              onChange={e => setRules(rules.map((x, j) => j === i ? { ...x, action: e.target.value } : x))}
+                            >
+                              <option value="set">Set</option>
+                              <option value="add">Add</option>
+                              <option value="remove">Remove</option>
+                            </select>
+                            <input
+                              type="text"
+                              className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                              placeholder="Header"
+                              value={rule.name}
+                              onChange={e => setRules(rules.map((x, j) => j === i ? { ...x, name: e.target.value } : x))}
+                            />
+                            <input
+                              type="text"
+                              className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm disabled:opacity-30"
+                              placeholder="Value"
+                              value={rule.value || ''}
+                              disabled={rule.action === 'remove'}
+                              onChange={e => setRules(rules.map((x, j) => j === i ? { ...x, value: e.target.value } : x))}
+                            />
+                            <button
+                              type="button"
+                              className="px-3 border border-zinc-800 text-zinc-500 hover:text-red-500 hover:border-red-900 rounded-sm"
+                              onClick={() => setRules(rules.filter((_, j) => j !== i))}
+                            >
+                              <Trash2 className="w-3 h-3" />
+                            </button>
+                          </div>
+                        ))}
+                        <button
+                          type="button"
+                          className="text-[10px] uppercase font-bold text-zinc-500 hover:text-white flex items-center gap-1"
+                          onClick={() => setRules([...rules, { action: 'set', name: '', value: '' }])}
+                        >
+                          <Plus className="w-3 h-3" /> Add {dir === 'request' ? 'Request' : 'Response'} Header Rule
+                        </button>
+                      </div>
+                    );
+                  })}
                 </div>
 
                 <div>
@@ -909,7 +1242,33 @@ function App() {
                     value={newDomain.rate_limit || ''}
                     onChange={e => setNewDomain({ ...newDomain, rate_limit: e.target.value })}
                   />
-                  <p className="text-[10px] text-zinc-600 mt-1">* 0 means no limit. Protection against abuse.</p>
+                  <input
+                    type="number"
+                    min="0"
+                    className="w-full bg-black border border-zinc-800 p-3 mt-2 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                    placeholder="Burst (defaults to rate)"
+                    value={newDomain.burst || ''}
+                    onChange={e => setNewDomain({ ...newDomain, burst: e.target.value })}
+                  />
+                  <p className="text-[10px] text-zinc-600 mt-1">* 0 means no limit. Limits apply per visitor IP.</p>
+                </div>
+
+                <div className="grid grid-cols-2 gap-4">
+                  {['allow', 'deny'].map(kind => (
+                    <div key={kind}>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">{kind === 'allow' ? 'Allowed IPs' : 'Denied IPs'}</label>
+                      <input
+                        type="text"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder={kind === 'allow' ? 'Anyone' : 'None'}
+                        value={(newDomain.access?.[kind] || []).join(', ')}
+                        onChange={e => setNewDomain({
+                          ...newDomain,
+                          access: { ...(newDomain.access || {}), [kind]: e.target.value.split(',').map(v => v.trim()).filter(Boolean) }
+                        })}
+                      />
+                    </div>
+                  ))}
                 </div>
 
                 <div className="flex items-center gap-3 border border-zinc-800 p-3 rounded-sm bg-zinc-900/30">
@@ -930,6 +1289,164 @@ function App() {
                   </div>
                 </div>
 
+                {newDomain.smart_shield && (
+                  <div className="grid grid-cols-2 gap-4">
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Difficulty (bits)</label>
+                      <input
+                        type="number"
+                        min="8"
+                        max="28"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder="18"
+                        value={newDomain.shield?.difficulty || ''}
+                        onChange={e => setNewDomain({ ...newDomain, shield: { ...(newDomain.shield || {}), difficulty: parseInt(e.target.value) || 0 } })}
+                      />
+                    </div>
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Clearance Bound To</label>
+                      <select
+                        className="w-full bg-black border border-zinc-800 p-3 text-white focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        value={newDomain.shield?.bind || 'ip'}
+                        onChange={e => setNewDomain({ ...newDomain, shield: { ...(newDomain.shield || {}), bind: e.target.value } })}
+                      >
+                        <option value="ip">Visitor IP</option>
+                        <option value="subnet">Subnet (/24, /64)</option>
+                      </select>
+                    </div>
+                  </div>
+                )}
+
+                <div className="flex items-center gap-3 border border-zinc-800 p-3 rounded-sm bg-zinc-900/30">
+                  <div
+                    className={`w-5 h-5 rounded border flex items-center justify-center cursor-pointer transition-colors ${newDomain.inspect?.enabled ? 'bg-sky-500 border-sky-500' : 'border-zinc-700 bg-black'}`}
+                    onClick={() => setNewDomain({ ...newDomain, inspect: { ...(newDomain.inspect || {}), enabled: !newDomain.inspect?.enabled } })}
+                  >
+                    {newDomain.inspect?.enabled && <div className="w-2 h-2 bg-black rounded-sm" />}
+                  </div>
+                  <div className="flex-1 cursor-pointer" onClick={() => setNewDomain({ ...newDomain, inspect: { ...(newDomain.inspect || {}), enabled: !newDomain.inspect?.enabled } })}>
+                    <label className="text-xs font-bold text-white uppercase flex items-center gap-2 cursor-pointer select-none">
+                      <Activity className="w-3 h-3 text-sky-500" />
+                      Request Inspector
+                    </label>
+                    <p className="text-[10px] text-zinc-500 mt-0.5 select-none">
+                      Capture requests for the Inspector tab. Off by default to keep the edge fast.
+                    </p>
+                  </div>
+                </div>
+
+                <div className="flex items-center gap-3 border border-zinc-800 p-3 rounded-sm bg-zinc-900/30">
+                  <div
+                    className={`w-5 h-5 rounded border flex items-center justify-center cursor-pointer transition-colors ${newDomain.compression?.enabled ? 'bg-emerald-500 border-emerald-500' : 'border-zinc-700 bg-black'}`}
+                    onClick={() => setNewDomain({ ...newDomain, compression: { ...(newDomain.compression || {}), enabled: !newDomain.compression?.enabled } })}
+                  >
+                    {newDomain.compression?.enabled && <div className="w-2 h-2 bg-black rounded-sm" />}
+                  </div>
+                  <div className="flex-1 cursor-pointer" onClick={() => setNewDomain({ ...newDomain, compression: { ...(newDomain.compression || {}), enabled: !newDomain.compression?.enabled } })}>
+                    <label className="text-xs font-bold text-white uppercase flex items-center gap-2 cursor-pointer select-none">
+                      <Zap className="w-3 h-3 text-emerald-500" />
+                      Edge Compression
+                    </label>
+                    <p className="text-[10px] text-zinc-500 mt-0.5 select-none">
+                      Gzip text responses your app sends uncompressed before they reach visitors.
+                    </p>
+                  </div>
+                </div>
+
+                <div className="flex items-center gap-3 border border-zinc-800 p-3 rounded-sm bg-zinc-900/30">
+                  <div
+                    className={`w-5 h-5 rounded border flex items-center justify-center cursor-pointer transition-colors ${newDomain.cache?.enabled ? 'bg-violet-500 border-violet-500' : 'border-zinc-700 bg-black'}`}
+                    onClick={() => setNewDomain({ ...newDomain, cache: { ...(newDomain.cache || {}), enabled: !newDomain.cache?.enabled } })}
+                  >
+                    {newDomain.cache?.enabled && <div className="w-2 h-2 bg-black rounded-sm" />}
+                  </div>
+                  <div className="flex-1 cursor-pointer" onClick={() => setNewDomain({ ...newDomain, cache: { ...(newDomain.cache || {}), enabled: !newDomain.cache?.enabled } })}>
+                    <label className="text-xs font-bold text-white uppercase flex items-center gap-2 cursor-pointer select-none">
+                      <Server className="w-3 h-3 text-violet-500" />
+                      Edge Cache
+                    </label>
+                    <p className="text-[10px] text-zinc-500 mt-0.5 select-none">
+                      Serve cacheable responses from the server, following your app's Cache-Control headers.
+                    </p>
+                  </div>
+                </div>
+
+                {newDomain.cache?.enabled && (
+                  <div className="grid grid-cols-2 gap-4">
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Cache Storage</label>
+                      <select
+                        className="w-full bg-black border border-zinc-800 p-3 text-white focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        value={newDomain.cache?.storage || 'memory'}
+                        onChange={e => setNewDomain({ ...newDomain, cache: { ...newDomain.cache, storage: e.target.value } })}
+                      >
+                        <option value="memory">Memory</option>
+                        <option value="disk">Disk</option>
+                      </select>
+                    </div>
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Size Limit (MB)</label>
+                      <input
+                        type="number"
+                        min="0"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder="64"
+                        value={newDomain.cache?.max_size ? newDomain.cache.max_size / 1048576 : ''}
+                        onChange={e => setNewDomain({ ...newDomain, cache: { ...newDomain.cache, max_size: (parseInt(e.target.value) || 0) * 1048576 } })}
+                      />
+                    </div>
+                  </div>
+                )}
+
+                {newDomain.mode !== 'passthrough' && (
+                  <div className="grid grid-cols-2 gap-4">
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Max Body (MB)</label>
+                      <input
+                        type="number"
+                        min="-1"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder="server default"
+                        value={newDomain.limits?.max_body_bytes > 0 ? newDomain.limits.max_body_bytes / 1048576 : (newDomain.limits?.max_body_bytes || '')}
+                        onChange={e => setNewDomain({ ...newDomain, limits: { ...(newDomain.limits || {}), max_body_bytes: (v => v > 0 ? v * 1048576 : v)(parseInt(e.target.value) || 0) } })}
+                      />
+                    </div>
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Upstream Timeout (s)</label>
+                      <input
+                        type="number"
+                        min="-1"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder="server default"
+                        value={newDomain.limits?.upstream_timeout || ''}
+                        onChange={e => setNewDomain({ ...newDomain, limits: { ...(newDomain.limits || {}), upstream_timeout: parseInt(e.target.value) || 0 } })}
+                      />
+                    </div>
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Body Read Timeout (s)</label>
+                      <input
+                        type="number"
+                        min="-1"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder="server default"
+                        value={newDomain.limits?.read_timeout || ''}
+                        onChange={e => setNewDomain({ ...newDomain, limits: { ...(newDomain.limits || {}), read_timeout: parseInt(e.target.value) || 0 } })}
+                      />
+                    </div>
+                    <div>
+                      <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Response Write Timeout (s)</label>
+                      <input
+                        type="number"
+                        min="-1"
+                        className="w-full bg-black border border-zinc-800 p-3 text-white placeholder-zinc-800 focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                        placeholder="server default"
+                        value={newDomain.limits?.write_timeout || ''}
+                        onChange={e => setNewDomain({ ...newDomain, limits: { ...(newDomain.limits || {}), write_timeout: parseInt(e.target.value) || 0 } })}
+                      />
+                    </div>
+                  </div>
+                )}
+
                 <div>
                   <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">SSL Mode</label>
                   <select
@@ -940,9 +1457,63 @@ function App() {
                     <option value="auto">Auto HTTPS (Standard)</option>
                     <option value="http">HTTP Only (Insecure)</option>
                     <option value="https">HTTPS Only (Strict)</option>
+                    <option value="passthrough">TLS Passthrough (End-to-End)</option>
                   </select>
                 </div>
 
+                {newDomain.mode !== 'passthrough' && (
+                  <div>
+                    <label className="block text-[10px] uppercase text-zinc-600 font-bold mb-1">Upstream Protocol</label>
+                    <select
+                      className="w-full bg-black border border-zinc-800 p-3 text-white focus:outline-none focus:border-white transition-colors font-mono text-sm rounded-sm"
+                      value={newDomain.upstream?.protocol || 'http1'}
+                      onChange={e => setNewDomain({ ...newDomain, upstream: { ...(newDomain.upstream || {}), protocol: e.target.value } })}
+                    >
+                      <option value="http1">HTTP/1.1 (Default)</option>
+                      <option value="h2c">HTTP/2 Cleartext (gRPC)</option>
+                      <option value="https">HTTPS (Local TLS)</option>
+                    </select>
+                    {newDomain.upstream?.protocol === 'https' && (
+                      <div className="grid grid-cols-2 gap-2 mt-2">
+                        <input
+                          type="text"
+                          placeholder="SNI (default: domain)"
+                          className="w-full bg-black border border-zinc-800 p-2 text-white placeholder-zinc-700 focus:outline-none focus:border-white transition-colors font-mono text-xs rounded-sm"
+                          value={newDomain.upstream?.sni || ''}
+                          onChange={e => setNewDomain({ ...newDomain, upstream: { ...newDomain.upstream, sni: e.target.value } })}
+                        />
+                        <label className="flex items-center gap-2 text-[10px] uppercase text-zinc-500 font-bold select-none cursor-pointer">
+                          <input
+                            type="checkbox"
+                            checked={!!newDomain.upstream?.insecure_skip_verify}
+                            onChange={e => setNewDomain({ ...newDomain, upstream: { ...newDomain.upstream, insecure_skip_verify: e.target.checked } })}
+                          />
+                          Skip Verify
+                        </label>
+                      </div>
+                    )}
+                    <div className="grid grid-cols-2 gap-2 mt-2">
+                      <input
+                        type="text"
+                        placeholder="Host header (default: domain)"
+                        className="w-full bg-black border border-zinc-800 p-2 text-white placeholder-zinc-700 focus:outline-none focus:border-white transition-colors font-mono text-xs rounded-sm"
+                        value={newDomain.upstream?.host || ''}
+                        onChange={e => setNewDomain({ ...newDomain, upstream: { ...(newDomain.upstream || {}), host: e.target.value.trim() } })}
+                      />
+                      {newDomain.upstream?.host && (
+                        <label className="flex items-center gap-2 text-[10px] uppercase text-zinc-500 font-bold select-none cursor-pointer">
+                          <input
+                            type="checkbox"
+                            checked={!!newDomain.upstream?.rewrite_host}
+                            onChange={e => setNewDomain({ ...newDomain, upstream: { ...newDomain.upstream, rewrite_host: e.target.checked } })}
+                          />
+                          Rewrite Redirects & Cookies
+                        </label>
+                      )}
+                    </div>
+                  </div>
+                )}
+
                 <button type="submit" className={`w-full font-bold text-sm uppercase py-3 transition-colors flex items-center justify-center gap-2 mt-2 rounded-sm active:scale-95 transform duration-100 ${isEditMode ? 'bg-amber-500 text-black hover:bg-amber-400' : 'bg-white text-black hover:bg-zinc-200'}`}>
                   {isEditMode ? (
                     <> <Pencil className="w-4 h-4" /> Update Settings </>